@@ -19,22 +19,59 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/utils"
 
 	flag "github.com/spf13/pflag"
 )
 
 var ErrExit = flag.ErrHelp
 
-func ParseArgs(args []string) ([]config.OperationPlan, error) {
+// Command is what ddb-sync does with the operation plans
+type Command string
+
+const (
+	SyncCommand     Command = "sync"
+	VerifyCommand   Command = "verify"
+	RepairCommand   Command = "repair"
+	SettingsCommand Command = "settings"
+	CleanupCommand  Command = "cleanup"
+	EstimateCommand Command = "estimate"
+)
+
+var commands = []struct {
+	Command     Command
+	Description string
+}{
+	{SyncCommand, "Backfill and stream the input table to the output table (default)"},
+	{VerifyCommand, "Compare the input and output tables and write the differences to a report"},
+	{RepairCommand, "Rewrite the items that differ between the input and output tables"},
+	{SettingsCommand, "Copy the input table's settings to the output table"},
+	{CleanupCommand, "Disable a stream ddb-sync enabled and restore capacity a backfill raised"},
+	{EstimateCommand, "Project the capacity, duration, and cost of a full backfill without running it"},
+}
+
+func ParseArgs(args []string) (Command, []config.OperationPlan, error) {
 	flagSet := newFlagSet()
 
+	command := SyncCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = Command(args[0])
+		if !knownCommand(command) {
+			printUsage(flagSet)
+			return "", nil, fmt.Errorf("Unknown command: %s", command)
+		}
+		args = args[1:]
+	}
+
 	if len(args) == 0 {
-		fmt.Println("ddb-sync:")
-		fmt.Println(flagSet.FlagUsages())
-		return nil, fmt.Errorf("Improper usage")
+		printUsage(flagSet)
+		return "", nil, fmt.Errorf("Improper usage")
 	}
 
 	err := flagSet.Parse(args)
@@ -42,32 +79,30 @@ func ParseArgs(args []string) ([]config.OperationPlan, error) {
 		// spf13/pflag does weirdness on "-h", "-help", or "--help" and throws a special error and prints usage.
 		// We don't want to double message or print a weird error message out.
 		if err != ErrExit {
-			fmt.Println("ddb-sync:")
-			fmt.Println(flagSet.FlagUsages())
+			printUsage(flagSet)
 		}
-		return nil, err
+		return "", nil, err
 	}
 
 	if flagSet.NArg() > 0 {
-		return nil, fmt.Errorf("Unknown argument(s): %v", flagSet.Args())
+		return "", nil, fmt.Errorf("Unknown argument(s): %v", flagSet.Args())
 	}
 
 	if file, _ := flagSet.GetString("config-file"); file != "" {
 		// Parse the plans from the config file
 		plans, err := config.ParseConfigFile(file)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-		return plans, nil
+		return command, plans, nil
 	}
 
 	bsChanged := flagSet.Lookup("backfill-segments").Changed
 	btsChanged := flagSet.Lookup("backfill-total-segments").Changed
 	if bsChanged && !btsChanged {
-		fmt.Println("ddb-sync:")
-		fmt.Println(flagSet.FlagUsages())
+		printUsage(flagSet)
 
-		return nil, fmt.Errorf("To specify \"backfill-segments\" you must configure \"backfill-total-segments\"")
+		return "", nil, fmt.Errorf("To specify \"backfill-segments\" you must configure \"backfill-total-segments\"")
 	}
 
 	inputRegion, _ := flagSet.GetString("input-region")
@@ -77,9 +112,66 @@ func ParseArgs(args []string) ([]config.OperationPlan, error) {
 	outputRegion, _ := flagSet.GetString("output-region")
 	outputRole, _ := flagSet.GetString("output-role-arn")
 	outputTable, _ := flagSet.GetString("output-table")
+	outputCreateIfMissing, _ := flagSet.GetBool("output-create-if-missing")
+	outputBackfillOnDemand, _ := flagSet.GetBool("output-backfill-on-demand")
+	outputBackfillWriteCapacity, _ := flagSet.GetInt64("output-backfill-write-capacity")
 
 	backfillSegments, _ := flagSet.GetIntSlice("backfill-segments")
 	backfillTotalSegments, _ := flagSet.GetInt("backfill-total-segments")
+	backfillResume, _ := flagSet.GetBool("backfill-resume")
+	backfillRetentionGuard, _ := flagSet.GetString("backfill-retention-guard")
+	backfillDeferIndexes, _ := flagSet.GetBool("backfill-defer-indexes")
+	backfillReadCapacityLimit, _ := flagSet.GetFloat64("backfill-read-capacity-limit")
+	backfillWriteCapacityLimit, _ := flagSet.GetFloat64("backfill-write-capacity-limit")
+	backfillTargetUtilization, _ := flagSet.GetFloat64("backfill-target-utilization")
+	backfillFilterExpression, _ := flagSet.GetString("backfill-filter-expression")
+	backfillProjectionExpression, _ := flagSet.GetString("backfill-projection-expression")
+	backfillExpressionAttributeNames, _ := flagSet.GetStringToString("backfill-expression-attribute-names")
+
+	var backfillExpressionAttributeValues utils.Item
+	if values, _ := flagSet.GetString("backfill-expression-attribute-values"); values != "" {
+		err := json.Unmarshal([]byte(values), &backfillExpressionAttributeValues)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid \"backfill-expression-attribute-values\": %v", err)
+		}
+	}
+
+	streamStartPosition, _ := flagSet.GetString("stream-start-position")
+	streamWriters, _ := flagSet.GetInt("stream-writers")
+	streamCoalesceWindow, _ := flagSet.GetDuration("stream-coalesce-window")
+	streamTrimmedDataPolicy, _ := flagSet.GetString("stream-trimmed-data-policy")
+	streamMaxPollInterval, _ := flagSet.GetDuration("stream-max-poll-interval")
+	streamFetchFromSource, _ := flagSet.GetBool("stream-fetch-from-source")
+	streamConcurrent, _ := flagSet.GetBool("stream-concurrent")
+	streamConsistencyCheckInterval, _ := flagSet.GetDuration("stream-consistency-check-interval")
+	streamConsistencyCheckSamples, _ := flagSet.GetInt("stream-consistency-check-samples")
+	streamAutoEnable, _ := flagSet.GetBool("stream-auto-enable")
+	streamReadCapacityLimit, _ := flagSet.GetFloat64("stream-read-capacity-limit")
+	streamWriteCapacityLimit, _ := flagSet.GetFloat64("stream-write-capacity-limit")
+
+	verifyReportFile, _ := flagSet.GetString("verify-report-file")
+	verifyStrategy, _ := flagSet.GetString("verify-strategy")
+	verifyDigestRanges, _ := flagSet.GetInt("verify-digest-ranges")
+	verifyDigestKeyLimit, _ := flagSet.GetInt("verify-digest-key-limit")
+
+	repairReportFile, _ := flagSet.GetString("repair-report-file")
+	repairDeleteExtra, _ := flagSet.GetBool("repair-delete-extra")
+
+	settingsSync, _ := flagSet.GetBool("settings-sync")
+	settingsDryRun, _ := flagSet.GetBool("settings-dry-run")
+
+	estimateSampleSize, _ := flagSet.GetInt("estimate-sample-size")
+	estimateReadRate, _ := flagSet.GetFloat64("estimate-read-rate")
+	estimateWriteRate, _ := flagSet.GetFloat64("estimate-write-rate")
+	estimateReadRequestUnitPrice, _ := flagSet.GetFloat64("estimate-read-request-unit-price")
+	estimateWriteRequestUnitPrice, _ := flagSet.GetFloat64("estimate-write-request-unit-price")
+	estimateReadCapacityHourPrice, _ := flagSet.GetFloat64("estimate-read-capacity-hour-price")
+	estimateWriteCapacityHourPrice, _ := flagSet.GetFloat64("estimate-write-capacity-hour-price")
+
+	stateFile, _ := flagSet.GetString("state-file")
+	strictSchema, _ := flagSet.GetBool("strict-schema")
+	readCapacityLimit, _ := flagSet.GetFloat64("read-capacity-limit")
+	writeCapacityLimit, _ := flagSet.GetFloat64("write-capacity-limit")
 
 	backfill, _ := flagSet.GetBool("backfill")
 	stream, _ := flagSet.GetBool("stream")
@@ -97,19 +189,103 @@ func ParseArgs(args []string) ([]config.OperationPlan, error) {
 				TableName: outputTable,
 
 				RoleARN: outputRole,
+
+				CreateIfMissing: outputCreateIfMissing,
+				BackfillCapacity: config.BackfillCapacity{
+					OnDemand:      outputBackfillOnDemand,
+					WriteCapacity: outputBackfillWriteCapacity,
+				},
 			},
 			Backfill: config.Backfill{
-				Disabled:      !backfill,
-				Segments:      backfillSegments,
-				TotalSegments: backfillTotalSegments,
+				Disabled:       !backfill,
+				Segments:       backfillSegments,
+				TotalSegments:  backfillTotalSegments,
+				Resume:         backfillResume,
+				RetentionGuard: backfillRetentionGuard,
+				DeferIndexes:   backfillDeferIndexes,
+
+				ReadCapacityLimit:  backfillReadCapacityLimit,
+				WriteCapacityLimit: backfillWriteCapacityLimit,
+				TargetUtilization:  backfillTargetUtilization,
+
+				FilterExpression:          backfillFilterExpression,
+				ProjectionExpression:      backfillProjectionExpression,
+				ExpressionAttributeNames:  backfillExpressionAttributeNames,
+				ExpressionAttributeValues: backfillExpressionAttributeValues,
 			},
 			Stream: config.Stream{
-				Disabled: !stream,
+				Disabled:          !stream,
+				StartPosition:     streamStartPosition,
+				Writers:           streamWriters,
+				CoalesceWindow:    streamCoalesceWindow,
+				TrimmedDataPolicy: streamTrimmedDataPolicy,
+				MaxPollInterval:   streamMaxPollInterval,
+				FetchFromSource:   streamFetchFromSource,
+				Concurrent:        streamConcurrent,
+
+				ConsistencyCheckInterval: streamConsistencyCheckInterval,
+				ConsistencyCheckSamples:  streamConsistencyCheckSamples,
+
+				AutoEnable: streamAutoEnable,
+
+				ReadCapacityLimit:  streamReadCapacityLimit,
+				WriteCapacityLimit: streamWriteCapacityLimit,
 			},
+			Verify: config.Verify{
+				ReportFile:   verifyReportFile,
+				Strategy:     verifyStrategy,
+				DigestRanges: verifyDigestRanges,
+
+				DigestKeyLimit: verifyDigestKeyLimit,
+			},
+			Repair: config.Repair{
+				ReportFile:  repairReportFile,
+				DeleteExtra: repairDeleteExtra,
+			},
+			Settings: config.Settings{
+				Sync:   settingsSync,
+				DryRun: settingsDryRun,
+			},
+			Estimate: config.Estimate{
+				SampleSize: estimateSampleSize,
+				ReadRate:   estimateReadRate,
+				WriteRate:  estimateWriteRate,
+				Prices: config.Prices{
+					ReadRequestUnit:   estimateReadRequestUnitPrice,
+					WriteRequestUnit:  estimateWriteRequestUnitPrice,
+					ReadCapacityHour:  estimateReadCapacityHourPrice,
+					WriteCapacityHour: estimateWriteCapacityHourPrice,
+				},
+			},
+			StateFile:    stateFile,
+			StrictSchema: strictSchema,
+
+			ReadCapacityLimit:  readCapacityLimit,
+			WriteCapacityLimit: writeCapacityLimit,
 		},
 	}
 
-	return plan, err
+	return command, plan, err
+}
+
+func knownCommand(command Command) bool {
+	for _, known := range commands {
+		if known.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+func printUsage(flagSet *flag.FlagSet) {
+	fmt.Println("ddb-sync [command] <options>:")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, command := range commands {
+		fmt.Printf("  %-8s %s\n", command.Command, command.Description)
+	}
+	fmt.Println()
+	fmt.Println(flagSet.FlagUsages())
 }
 
 func newFlagSet() *flag.FlagSet {
@@ -124,9 +300,64 @@ func newFlagSet() *flag.FlagSet {
 	flag.String("output-region", "", "The output region")
 	flag.String("output-table", "", "Name of the output table")
 	flag.String("output-role-arn", "", "ARN of the output role")
+	flag.Bool("output-create-if-missing", false, "[Optional] Create the output table like the input table when it doesn't exist")
+	flag.Bool("output-backfill-on-demand", false, "[Optional] Switch the output table to on demand capacity while the backfill runs, \"state-file\" is required")
+	flag.Int64("output-backfill-write-capacity", 0, "[Optional] Raise the output table's and its indexes' provisioned WCUs to at least this many while the backfill runs, \"state-file\" is required")
 
 	flag.IntSlice("backfill-segments", []int{}, "[Optional] Specify backfill scan segment(s) to target in this operation, 0-indexed. Example: \"0,1,2\". Prohibits streaming and \"backfill-total-segments\" must be specified.")
 	flag.Int("backfill-total-segments", 0, "Specify backfill 'Scan' concurrency segments")
+	flag.Bool("backfill-resume", false, "[Optional] Resume each backfill segment from the progress saved in \"state-file\"")
+	flag.Bool("backfill-defer-indexes", false, "[Optional] Take the input table's global secondary indexes off the output table while backfilling and create them again before streaming, \"state-file\" is required to record them")
+	flag.Float64("backfill-read-capacity-limit", 0, "[Optional] Most RCUs per second the backfill's scan reads")
+	flag.Float64("backfill-write-capacity-limit", 0, "[Optional] Most WCUs per second the backfill writes")
+	flag.Float64("backfill-target-utilization", 0, "[Optional] Percentage of each table's provisioned capacity the backfill tunes its scan page size and writers to consume, e.g. 50")
+	flag.String("backfill-filter-expression", "", "[Optional] Only backfill the items matching this scan filter expression, e.g. \"tenant = :tenant\". Requires \"stream\" to be false.")
+	flag.String("backfill-projection-expression", "", "[Optional] Only backfill these attributes, which must include the table's key. Requires \"stream\" to be false.")
+	flag.StringToString("backfill-expression-attribute-names", nil, "[Optional] Expression attribute names for the backfill's expressions, e.g. \"#s=status\"")
+	flag.String("backfill-expression-attribute-values", "", "[Optional] Expression attribute values for the backfill's expressions in DynamoDB JSON, e.g. '{\":tenant\": {\"S\": \"acme\"}}'")
+	flag.String("backfill-retention-guard", config.RetentionGuardWarn, "What to do when the backfill is projected to outlast the stream's 24 hour retention: \"warn\", \"abort\", or \"concurrent\" to start streaming alongside it")
+
+	flag.String("stream-start-position", config.StartPositionTrimHorizon, "Where to begin reading the stream: \"trim_horizon\", \"latest\", \"auto\" (from when the backfill started), or an RFC 3339 timestamp")
+
+	flag.Int("stream-writers", 1, "Number of concurrent stream writers, changes to an item are always written in order")
+
+	flag.Duration("stream-coalesce-window", 0, "[Optional] Collect stream records for this long and batch write the last change to each item, e.g. \"500ms\"")
+
+	flag.Duration("stream-consistency-check-interval", 0, "[Optional] How often to compare a sample of recently written items between the tables, e.g. \"1m\"")
+	flag.Int("stream-consistency-check-samples", 25, "Number of recently written items each consistency check compares")
+	flag.Bool("stream-auto-enable", false, "[Optional] Enable a NEW_AND_OLD_IMAGES stream on the input table when it has none, \"state-file\" is required to record it for the cleanup command")
+	flag.Float64("stream-read-capacity-limit", 0, "[Optional] Most RCUs per second the stream reads from the input table with \"stream-fetch-from-source\"")
+	flag.Float64("stream-write-capacity-limit", 0, "[Optional] Most WCUs per second the stream writes")
+	flag.Bool("stream-concurrent", false, "[Optional] Stream while the backfill runs rather than after it")
+	flag.Bool("stream-fetch-from-source", false, "[Optional] Write the source table's current item for each change, required for KEYS_ONLY and OLD_IMAGE streams")
+	flag.Duration("stream-max-poll-interval", 5*time.Second, "Longest wait between reads of a stream shard with no new records")
+	flag.String("stream-trimmed-data-policy", config.TrimmedDataFail, "What to do when unread records have been trimmed from the stream: \"fail\", \"skip\" to the oldest available record, or \"backfill\" the table again")
+
+	flag.String("verify-report-file", "", "[Optional] File the verify command writes differences to (default \"<output table>.verify.jsonl\")")
+	flag.String("verify-strategy", config.VerifyStrategyFull, "How the verify command compares tables: \"full\" looks up every item, \"digest\" compares hashes of ranges of keys and only looks up the differing items in ranges whose hashes differ")
+	flag.Int("verify-digest-ranges", 4096, "Number of key hash ranges the \"digest\" verify strategy compares")
+	flag.Int("verify-digest-key-limit", 1000000, "Most keys the \"digest\" verify strategy keeps from each table to look up differing items, beyond it both tables are scanned again when any range differs")
+
+	flag.String("repair-report-file", "", "[Optional] Verify report the repair command rewrites the differing items of, the tables are compared inline without one")
+	flag.Bool("repair-delete-extra", false, "[Optional] Delete items that are only in the output table when repairing")
+
+	flag.Bool("settings-sync", false, "[Optional] Copy the input table's time to live, tags, point in time recovery, and auto scaling to the output table before the backfill")
+	flag.Bool("settings-dry-run", false, "[Optional] Log the settings changes that would be made without making them")
+
+	flag.Int("estimate-sample-size", 1000, "Number of items the estimate command samples to measure item size and index writes")
+	flag.Float64("estimate-read-rate", 0, "[Optional] RCUs per second the estimate command expects the backfill to read at (default the backfill's limit or the input table's capacity)")
+	flag.Float64("estimate-write-rate", 0, "[Optional] WCUs per second the estimate command expects the backfill to write at (default the backfill's limit or the output table's capacity)")
+	flag.Float64("estimate-read-request-unit-price", 0, "[Optional] Dollars per on demand read request unit (default the approximate us-east-1 price)")
+	flag.Float64("estimate-write-request-unit-price", 0, "[Optional] Dollars per on demand write request unit (default the approximate us-east-1 price)")
+	flag.Float64("estimate-read-capacity-hour-price", 0, "[Optional] Dollars per provisioned RCU per hour (default the approximate us-east-1 price)")
+	flag.Float64("estimate-write-capacity-hour-price", 0, "[Optional] Dollars per provisioned WCU per hour (default the approximate us-east-1 price)")
+
+	flag.String("state-file", "", "[Optional] File used to persist progress so an interrupted operation can resume")
+
+	flag.Bool("strict-schema", false, "[Optional] Fail preflight checks on schema differences that are only warnings, such as a missing secondary index")
+
+	flag.Float64("read-capacity-limit", 0, "[Optional] Most RCUs per second read from the input table, shared with other plans reading it")
+	flag.Float64("write-capacity-limit", 0, "[Optional] Most WCUs per second written to the output table, shared with other plans writing it")
 
 	flag.Bool("backfill", true, "Perform the backfill operation")
 	flag.Bool("stream", true, "Perform the streaming operation")
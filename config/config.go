@@ -23,6 +23,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"github.com/instructure/ddb-sync/utils"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
@@ -33,6 +36,59 @@ import (
 
 const MaxRetries int = 15
 
+// Stream start positions
+const (
+	StartPositionTrimHorizon = "trim_horizon"
+	StartPositionLatest      = "latest"
+	StartPositionAuto        = "auto"
+)
+
+const defaultStartMargin = 5 * time.Minute
+
+// DynamoDB Streams allows 5 GetRecords calls per second on a shard, so never
+// poll a shard more often than this
+const MinPollInterval = 250 * time.Millisecond
+
+const defaultMaxPollInterval = 5 * time.Second
+
+const defaultConsistencyCheckSamples = 25
+
+// Retention guard policies, applied when a backfill is projected to outlast the
+// stream's retention
+const (
+	RetentionGuardWarn       = "warn"
+	RetentionGuardAbort      = "abort"
+	RetentionGuardConcurrent = "concurrent"
+)
+
+// Trimmed data policies, applied when unread records age out of the stream
+const (
+	TrimmedDataFail     = "fail"
+	TrimmedDataSkip     = "skip"
+	TrimmedDataBackfill = "backfill"
+)
+
+// Verify strategies
+const (
+	VerifyStrategyFull   = "full"
+	VerifyStrategyDigest = "digest"
+)
+
+const defaultVerifyDigestRanges = 4096
+
+const defaultVerifyDigestKeyLimit = 1000000
+
+const defaultEstimateSampleSize = 1000
+
+// Approximate us-east-1 prices in dollars, used by the estimate command when
+// none are configured
+const (
+	defaultReadRequestUnitPrice   = 0.125 / 1000000
+	defaultWriteRequestUnitPrice  = 0.625 / 1000000
+	defaultReadCapacityHourPrice  = 0.00013
+	defaultWriteCapacityHourPrice = 0.00065
+)
+
 var (
 	ErrInputRegionRequired    = errors.New("Input region is required")
 	ErrInputTableNameRequired = errors.New("Input table name is required")
@@ -42,9 +98,42 @@ var (
 
 	ErrInputAndOutputTablesCannotMatch = errors.New("Input and output tables cannot match")
 
-	ErrBackfillSegmentConfiguration       = errors.New("Backfill segment configuration is invalid")
-	ErrBackfillTotalSegmentsConfiguration = errors.New("Backfill total segments configuration is invalid")
-	ErrStreamCannotRunWithSegmentedScan   = errors.New("Stream must be disabled if scan segment target is specified")
+	ErrBackfillSegmentConfiguration           = errors.New("Backfill segment configuration is invalid")
+	ErrBackfillTotalSegmentsConfiguration     = errors.New("Backfill total segments configuration is invalid")
+	ErrStreamCannotRunWithSegmentedScan       = errors.New("Stream must be disabled if scan segment target is specified")
+	ErrBackfillResumeRequiresStateFile        = errors.New("Backfill resume requires a state file")
+	ErrBackfillRetentionGuardConfiguration    = errors.New("Backfill retention guard must be \"warn\", \"abort\", or \"concurrent\"")
+	ErrBackfillDeferIndexesConfiguration      = errors.New("Backfill defer indexes cannot be used with scan segment targets or streaming alongside the backfill")
+	ErrBackfillDeferIndexesRequiresStateFile  = errors.New("Backfill defer indexes requires a state file")
+	ErrBackfillTargetUtilizationConfiguration = errors.New("Backfill target utilization must be a percentage from 0 to 100")
+
+	ErrBackfillExpressionAttributesConfiguration = errors.New("Backfill expression attribute names and values require a filter or projection expression")
+	ErrBackfillExpressionsWithStream             = errors.New("Backfill filter and projection expressions require the stream to be disabled, it writes every change")
+
+	ErrOutputBackfillCapacityConfiguration     = errors.New("Output backfill capacity must be on demand or a positive write capacity, and cannot be used with scan segment targets")
+	ErrOutputBackfillCapacityRequiresStateFile = errors.New("Output backfill capacity requires a state file")
+
+	ErrStreamConcurrentRequiresBackfill  = errors.New("Stream concurrent mode requires the backfill to be enabled")
+	ErrStreamWritersConfiguration        = errors.New("Stream writers must be at least 1")
+	ErrStreamCoalesceConfiguration       = errors.New("Stream coalesce window cannot be negative")
+	ErrStreamPollConfiguration           = errors.New("Stream max poll interval must be at least 250ms")
+	ErrStreamTrimmedDataConfiguration    = errors.New("Stream trimmed data policy must be \"fail\", \"skip\", or \"backfill\"")
+	ErrStreamConsistencyConfiguration    = errors.New("Stream consistency check interval cannot be negative and samples must be at least 1")
+	ErrStreamStartPositionConfiguration  = errors.New("Stream start position must be \"trim_horizon\", \"latest\", \"auto\", or an RFC 3339 timestamp")
+	ErrStreamStartMarginConfiguration    = errors.New("Stream start margin cannot be negative")
+	ErrStreamAutoEnableRequiresStateFile = errors.New("Stream auto enable requires a state file")
+
+	ErrVerifyStrategyConfiguration       = errors.New("Verify strategy must be \"full\" or \"digest\"")
+	ErrVerifyDigestRangesConfiguration   = errors.New("Verify digest ranges must be at least 1")
+	ErrVerifyDigestKeyLimitConfiguration = errors.New("Verify digest key limit must be at least 1")
+
+	ErrEstimateConfiguration = errors.New("Estimate sample size must be at least 1, and rates and prices cannot be negative")
+
+	ErrCapacityLimitConfiguration = errors.New("Capacity limits cannot be negative")
+
+	ErrStateFileShared          = errors.New("State file cannot be shared between operations")
+	ErrCleanupRequiresStateFile = errors.New("Cleanup requires the state file of the sync it cleans up after")
+	ErrReportFileShared         = errors.New("Verify report file cannot be shared between operations")
 )
 
 type PlanConfig struct {
@@ -63,16 +152,193 @@ type Output struct {
 	TableName string `yaml:"table"`  // defaults to the Input table name
 
 	RoleARN string `yaml:"role_arn"`
+
+	// Create the table like the input table when it doesn't exist
+	CreateIfMissing bool `yaml:"create_if_missing"`
+
+	// Raise the table's capacity while the backfill runs
+	BackfillCapacity BackfillCapacity `yaml:"backfill_capacity"`
+}
+
+// BackfillCapacity raises the output table's capacity while the backfill runs.
+// The previous capacity is saved to the state file and restored afterwards.
+type BackfillCapacity struct {
+	// Switch the table to on demand capacity
+	OnDemand bool `yaml:"on_demand"`
+
+	// Raise the provisioned WCUs of the table and its indexes to at least this many
+	WriteCapacity int64 `yaml:"write_capacity"`
+}
+
+// Enabled reports whether the capacity is raised
+func (c BackfillCapacity) Enabled() bool {
+	return c.OnDemand || c.WriteCapacity > 0
 }
 
 type Backfill struct {
 	Disabled      bool  `yaml:"disabled"`
 	Segments      []int `yaml:"segments"`
 	TotalSegments int   `yaml:"total_segments"`
+
+	// Resume restarts each segment from the progress recorded in the state file
+	Resume bool `yaml:"resume"`
+
+	// What to do when the backfill is projected to outlast the stream's
+	// retention: "warn", "abort", or start streaming "concurrent"ly
+	RetentionGuard string `yaml:"retention_guard"`
+
+	// Take the input table's global secondary indexes off the output table
+	// while backfilling, creating them again before the stream starts
+	DeferIndexes bool `yaml:"defer_indexes"`
+
+	// The most RCUs per second the scan reads and WCUs per second the backfill
+	// writes, unlimited when zero
+	ReadCapacityLimit  float64 `yaml:"read_capacity_limit"`
+	WriteCapacityLimit float64 `yaml:"write_capacity_limit"`
+
+	// Tune the scan page size and writer concurrency to consume this
+	// percentage of each table's provisioned capacity, disabled when zero
+	TargetUtilization float64 `yaml:"target_utilization"`
+
+	// Copy only the items matching FilterExpression, and only the attributes
+	// in ProjectionExpression, which must include the table's key.  Both are
+	// passed to the scan with the expression attribute names and values.
+	FilterExpression          string            `yaml:"filter_expression"`
+	ProjectionExpression      string            `yaml:"projection_expression"`
+	ExpressionAttributeNames  map[string]string `yaml:"expression_attribute_names"`
+	ExpressionAttributeValues utils.Item        `yaml:"expression_attribute_values"`
+}
+
+// Partial reports whether the backfill copies only some items or attributes
+func (b Backfill) Partial() bool {
+	return b.FilterExpression != "" || b.ProjectionExpression != ""
 }
 
 type Stream struct {
 	Disabled bool `yaml:"disabled"`
+
+	// Where to begin reading shards without saved progress: "trim_horizon",
+	// "latest", "auto", or an RFC 3339 timestamp.  "auto" skips records created
+	// more than StartMargin before the backfill started, which defaults to
+	// five minutes when it isn't set and may be zero.
+	StartPosition string         `yaml:"start_position"`
+	StartMargin   *time.Duration `yaml:"start_margin"`
+
+	// Number of concurrent writers, records are routed to writers by key so
+	// changes to an item are always written in order
+	Writers int `yaml:"writers"`
+
+	// When set, writers collect records for this long and write the last
+	// change to each key with BatchWriteItem
+	CoalesceWindow time.Duration `yaml:"coalesce_window"`
+
+	// Stream while the backfill runs rather than after it, changes written
+	// by the stream are never overwritten by the backfill
+	Concurrent bool `yaml:"concurrent"`
+
+	// Write the source table's current item for each change rather than the
+	// stream's new image, allowing KEYS_ONLY and OLD_IMAGE streams
+	FetchFromSource bool `yaml:"fetch_from_source"`
+
+	// The longest to wait between GetRecords calls on a shard with no new records
+	MaxPollInterval time.Duration `yaml:"max_poll_interval"`
+
+	// What to do when unread records have been trimmed from the stream: "fail",
+	// "skip" to the oldest available record, or "backfill" the table again
+	TrimmedDataPolicy string `yaml:"trimmed_data_policy"`
+
+	// How often to compare a random sample of recently written items between
+	// the tables, the check is disabled when zero
+	ConsistencyCheckInterval time.Duration `yaml:"consistency_check_interval"`
+
+	// The most recently written items each consistency check compares
+	ConsistencyCheckSamples int `yaml:"consistency_check_samples"`
+
+	// Enable a NEW_AND_OLD_IMAGES stream on the input table when it has none,
+	// recording it in the state file for the cleanup command to disable
+	AutoEnable bool `yaml:"auto_enable"`
+
+	// The most RCUs per second read from the source table with
+	// fetch_from_source and WCUs per second the stream writes, unlimited when zero
+	ReadCapacityLimit  float64 `yaml:"read_capacity_limit"`
+	WriteCapacityLimit float64 `yaml:"write_capacity_limit"`
+}
+
+// StartTimestamp returns the timestamp when the start position is one
+func (s Stream) StartTimestamp() (time.Time, bool) {
+	switch s.StartPosition {
+	case StartPositionTrimHorizon, StartPositionLatest, StartPositionAuto:
+		return time.Time{}, false
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, s.StartPosition)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return timestamp, true
+}
+
+// Verify configures the verify command, which scans with the backfill's segments
+type Verify struct {
+	// Where the differences found are written, one JSON object per line
+	ReportFile string `yaml:"report_file"`
+
+	// "full" looks up every item in the other table, "digest" first compares
+	// hashes of ranges of keys and only looks up items in ranges that differ
+	Strategy string `yaml:"strategy"`
+
+	// How many ranges of key hashes the digest strategy compares
+	DigestRanges int `yaml:"digest_ranges"`
+
+	// The most keys the digest strategy keeps from each table to look up the
+	// items in ranges that differ, it scans the tables again beyond it
+	DigestKeyLimit int `yaml:"digest_key_limit"`
+}
+
+// Settings configures copying the input table's time to live, tags, point in
+// time recovery, and auto scaling to the output table
+type Settings struct {
+	// Copy the settings before the backfill, the settings command always does
+	Sync bool `yaml:"sync"`
+
+	// Log the changes that would be made without making them
+	DryRun bool `yaml:"dry_run"`
+}
+
+// Estimate configures the estimate command, which projects the capacity,
+// duration, and cost of a full backfill
+type Estimate struct {
+	// Items sampled to measure the average item size and index writes
+	SampleSize int `yaml:"sample_size"`
+
+	// The RCUs and WCUs per second the backfill is expected to run at, its
+	// capacity limits or the tables' provisioned capacity when zero
+	ReadRate  float64 `yaml:"read_rate"`
+	WriteRate float64 `yaml:"write_rate"`
+
+	Prices Prices `yaml:"prices"`
+}
+
+// Prices are what DynamoDB capacity costs in dollars, approximate us-east-1
+// prices are used for any left unset
+type Prices struct {
+	// Per on demand request unit
+	ReadRequestUnit  float64 `yaml:"read_request_unit"`
+	WriteRequestUnit float64 `yaml:"write_request_unit"`
+
+	// Per provisioned capacity unit per hour
+	ReadCapacityHour  float64 `yaml:"read_capacity_hour"`
+	WriteCapacityHour float64 `yaml:"write_capacity_hour"`
+}
+
+// Repair configures the repair command, which rewrites the items a
+// verification found differing
+type Repair struct {
+	// A verify report to repair from, the tables are compared inline without one
+	ReportFile string `yaml:"report_file"`
+
+	// Delete items that are only in the destination table
+	DeleteExtra bool `yaml:"delete_extra"`
 }
 
 type OperationPlan struct {
@@ -83,6 +349,27 @@ type OperationPlan struct {
 	Backfill Backfill `yaml:"backfill"`
 
 	Stream Stream `yaml:"stream"`
+
+	Verify Verify `yaml:"verify"`
+
+	Repair Repair `yaml:"repair"`
+
+	Settings Settings `yaml:"settings"`
+
+	Estimate Estimate `yaml:"estimate"`
+
+	// Path of a file used to persist progress so an interrupted run can resume
+	StateFile string `yaml:"state_file"`
+
+	// Fail preflight checks on schema differences that are only warnings,
+	// such as a secondary index missing from the output table
+	StrictSchema bool `yaml:"strict_schema"`
+
+	// The most RCUs per second read from the input table and WCUs per second
+	// written to the output table by the backfill and stream together,
+	// unlimited when zero.  Plans with the same table share its limit.
+	ReadCapacityLimit  float64 `yaml:"read_capacity_limit"`
+	WriteCapacityLimit float64 `yaml:"write_capacity_limit"`
 }
 
 func (p OperationPlan) WithDefaults() OperationPlan {
@@ -96,6 +383,69 @@ func (p OperationPlan) WithDefaults() OperationPlan {
 		newPlan.Output.Region = newPlan.Input.Region
 	}
 
+	if newPlan.Verify.ReportFile == "" {
+		newPlan.Verify.ReportFile = fmt.Sprintf("%s.verify.jsonl", newPlan.Output.TableName)
+	}
+
+	if newPlan.Verify.Strategy == "" {
+		newPlan.Verify.Strategy = VerifyStrategyFull
+	}
+
+	if newPlan.Verify.DigestRanges == 0 {
+		newPlan.Verify.DigestRanges = defaultVerifyDigestRanges
+	}
+
+	if newPlan.Verify.DigestKeyLimit == 0 {
+		newPlan.Verify.DigestKeyLimit = defaultVerifyDigestKeyLimit
+	}
+
+	if newPlan.Estimate.SampleSize == 0 {
+		newPlan.Estimate.SampleSize = defaultEstimateSampleSize
+	}
+
+	prices := &newPlan.Estimate.Prices
+	if prices.ReadRequestUnit == 0 {
+		prices.ReadRequestUnit = defaultReadRequestUnitPrice
+	}
+	if prices.WriteRequestUnit == 0 {
+		prices.WriteRequestUnit = defaultWriteRequestUnitPrice
+	}
+	if prices.ReadCapacityHour == 0 {
+		prices.ReadCapacityHour = defaultReadCapacityHourPrice
+	}
+	if prices.WriteCapacityHour == 0 {
+		prices.WriteCapacityHour = defaultWriteCapacityHourPrice
+	}
+
+	if newPlan.Stream.StartPosition == "" {
+		newPlan.Stream.StartPosition = StartPositionTrimHorizon
+	}
+
+	if newPlan.Stream.StartMargin == nil {
+		margin := defaultStartMargin
+		newPlan.Stream.StartMargin = &margin
+	}
+
+	if newPlan.Stream.Writers == 0 {
+		newPlan.Stream.Writers = 1
+	}
+
+	if newPlan.Backfill.RetentionGuard == "" {
+		newPlan.Backfill.RetentionGuard = RetentionGuardWarn
+	}
+
+	if newPlan.Stream.MaxPollInterval == 0 {
+		newPlan.Stream.MaxPollInterval = defaultMaxPollInterval
+	}
+
+	if newPlan.Stream.ConsistencyCheckSamples == 0 {
+		newPlan.Stream.ConsistencyCheckSamples = defaultConsistencyCheckSamples
+	}
+
+	if newPlan.Stream.TrimmedDataPolicy == "" {
+		newPlan.Stream.TrimmedDataPolicy = TrimmedDataFail
+	}
+
 	return newPlan
 }
 
@@ -129,6 +479,85 @@ func (p OperationPlan) Validate() error {
 		return err
 	}
 
+	if !p.Backfill.Disabled && p.Backfill.Resume && p.StateFile == "" {
+		return ErrBackfillResumeRequiresStateFile
+	}
+
+	switch p.Backfill.RetentionGuard {
+	case RetentionGuardWarn, RetentionGuardAbort, RetentionGuardConcurrent:
+	default:
+		return ErrBackfillRetentionGuardConfiguration
+	}
+
+	// The indexes have to be back before any stream writes, and one process
+	// can't know when every segment's backfill has completed
+	if !p.Backfill.Disabled && p.Backfill.DeferIndexes {
+		streamAlongside := !p.Stream.Disabled && (p.Stream.Concurrent || p.Backfill.RetentionGuard == RetentionGuardConcurrent)
+		if streamAlongside || len(p.Backfill.Segments) > 0 {
+			return ErrBackfillDeferIndexesConfiguration
+		}
+		// The removed indexes are recorded so they can be created again after an interruption
+		if p.StateFile == "" {
+			return ErrBackfillDeferIndexesRequiresStateFile
+		}
+	}
+
+	// Each process would restore the capacity as its own segments finish
+	capacity := p.Output.BackfillCapacity
+	if capacity.WriteCapacity < 0 || (capacity.OnDemand && capacity.WriteCapacity > 0) || (capacity.Enabled() && len(p.Backfill.Segments) > 0) {
+		return ErrOutputBackfillCapacityConfiguration
+	}
+	if !p.Backfill.Disabled && capacity.Enabled() && p.StateFile == "" {
+		return ErrOutputBackfillCapacityRequiresStateFile
+	}
+
+	if p.Backfill.TargetUtilization < 0 || p.Backfill.TargetUtilization > 100 {
+		return ErrBackfillTargetUtilizationConfiguration
+	}
+
+	hasAttributes := len(p.Backfill.ExpressionAttributeNames) > 0 || len(p.Backfill.ExpressionAttributeValues) > 0
+	if hasAttributes && !p.Backfill.Partial() {
+		return ErrBackfillExpressionAttributesConfiguration
+	}
+	if !p.Backfill.Disabled && p.Backfill.Partial() && !p.Stream.Disabled {
+		return ErrBackfillExpressionsWithStream
+	}
+
+	err = p.validateStream()
+	if err != nil {
+		return err
+	}
+
+	for _, limit := range []float64{p.ReadCapacityLimit, p.WriteCapacityLimit, p.Backfill.ReadCapacityLimit, p.Backfill.WriteCapacityLimit, p.Stream.ReadCapacityLimit, p.Stream.WriteCapacityLimit} {
+		if limit < 0 {
+			return ErrCapacityLimitConfiguration
+		}
+	}
+
+	switch p.Verify.Strategy {
+	case VerifyStrategyFull, VerifyStrategyDigest:
+	default:
+		return ErrVerifyStrategyConfiguration
+	}
+
+	if p.Verify.DigestRanges < 1 {
+		return ErrVerifyDigestRangesConfiguration
+	}
+
+	if p.Verify.DigestKeyLimit < 1 {
+		return ErrVerifyDigestKeyLimitConfiguration
+	}
+
+	estimate := p.Estimate
+	if estimate.SampleSize < 1 || estimate.ReadRate < 0 || estimate.WriteRate < 0 {
+		return ErrEstimateConfiguration
+	}
+	for _, price := range []float64{estimate.Prices.ReadRequestUnit, estimate.Prices.WriteRequestUnit, estimate.Prices.ReadCapacityHour, estimate.Prices.WriteCapacityHour} {
+		if price < 0 {
+			return ErrEstimateConfiguration
+		}
+	}
+
 	if p.Input.Region != p.Output.Region || p.Input.TableName != p.Output.TableName || p.Input.RoleARN != p.Output.RoleARN {
 		return nil
 	}
@@ -223,6 +652,56 @@ func (p OperationPlan) validateBackfillSegments() error {
 
 	return nil
 }
+
+func (p OperationPlan) validateStream() error {
+	if p.Stream.Disabled {
+		return nil
+	}
+
+	if p.Stream.Writers < 1 {
+		return ErrStreamWritersConfiguration
+	}
+
+	if p.Stream.CoalesceWindow < 0 {
+		return ErrStreamCoalesceConfiguration
+	}
+
+	if p.Stream.Concurrent && p.Backfill.Disabled {
+		return ErrStreamConcurrentRequiresBackfill
+	}
+
+	if p.Stream.MaxPollInterval < MinPollInterval {
+		return ErrStreamPollConfiguration
+	}
+
+	if p.Stream.ConsistencyCheckInterval < 0 || p.Stream.ConsistencyCheckSamples < 1 {
+		return ErrStreamConsistencyConfiguration
+	}
+
+	if p.Stream.AutoEnable && p.StateFile == "" {
+		return ErrStreamAutoEnableRequiresStateFile
+	}
+
+	switch p.Stream.TrimmedDataPolicy {
+	case TrimmedDataFail, TrimmedDataSkip, TrimmedDataBackfill:
+	default:
+		return ErrStreamTrimmedDataConfiguration
+	}
+
+	switch p.Stream.StartPosition {
+	case StartPositionTrimHorizon, StartPositionLatest, StartPositionAuto:
+	default:
+		if _, ok := p.Stream.StartTimestamp(); !ok {
+			return ErrStreamStartPositionConfiguration
+		}
+	}
+
+	if p.Stream.StartMargin != nil && *p.Stream.StartMargin < 0 {
+		return ErrStreamStartMarginConfiguration
+	}
+	return nil
+}
+
 func segmentBounds(vals []int) (int, int) {
 	// Generate some bounds
 	min := 0
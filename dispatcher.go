@@ -43,11 +43,13 @@ type Dispatcher struct {
 	cancel context.CancelFunc
 }
 
-func NewDispatcher(plans []config.OperationPlan) (*Dispatcher, error) {
+func NewDispatcher(command Command, plans []config.OperationPlan) (*Dispatcher, error) {
 	var operators []*operations.Operator
 	ctx, cancel := context.WithCancel(context.Background())
 
 	var finalErr error
+	stateFiles := make(map[string]bool)
+	reportFiles := make(map[string]bool)
 	for _, plan := range plans {
 		plan = plan.WithDefaults()
 		err := plan.Validate()
@@ -57,7 +59,26 @@ func NewDispatcher(plans []config.OperationPlan) (*Dispatcher, error) {
 			continue
 		}
 
-		operator, err := operations.NewOperator(ctx, plan, cancel)
+		if plan.StateFile != "" {
+			if stateFiles[plan.StateFile] {
+				fmt.Printf("[ERROR] %s: %v\n", plan.Description(), config.ErrStateFileShared)
+				finalErr = config.ErrStateFileShared
+				continue
+			}
+			stateFiles[plan.StateFile] = true
+		}
+
+		// An inline repair writes a verify report as it compares
+		if command == VerifyCommand || (command == RepairCommand && plan.Repair.ReportFile == "") {
+			if reportFiles[plan.Verify.ReportFile] {
+				fmt.Printf("[ERROR] %s: %v\n", plan.Description(), config.ErrReportFileShared)
+				finalErr = config.ErrReportFileShared
+				continue
+			}
+			reportFiles[plan.Verify.ReportFile] = true
+		}
+
+		operator, err := newOperator(ctx, command, plan, cancel)
 		if err != nil {
 			fmt.Printf("[ERROR] %v\n", err)
 			finalErr = err
@@ -73,6 +94,22 @@ func NewDispatcher(plans []config.OperationPlan) (*Dispatcher, error) {
 	}, finalErr
 }
 
+func newOperator(ctx context.Context, command Command, plan config.OperationPlan, cancel context.CancelFunc) (*operations.Operator, error) {
+	switch command {
+	case VerifyCommand:
+		return operations.NewVerifyOperator(ctx, plan, cancel)
+	case RepairCommand:
+		return operations.NewRepairOperator(ctx, plan, cancel)
+	case SettingsCommand:
+		return operations.NewSettingsOperator(ctx, plan, cancel)
+	case CleanupCommand:
+		return operations.NewCleanupOperator(ctx, plan, cancel)
+	case EstimateCommand:
+		return operations.NewEstimateOperator(ctx, plan, cancel)
+	}
+	return operations.NewOperator(ctx, plan, cancel)
+}
+
 func (d *Dispatcher) Preflights() error {
 	err := quickCheckForActiveCredentials(d.ctx)
 	if err != nil {
@@ -125,6 +162,15 @@ func (d *Dispatcher) Statuses() *status.Set {
 	return status.NewSet(statuses)
 }
 
+// Differences returns the number of differences the verify command found across all operators
+func (d *Dispatcher) Differences() int64 {
+	var differences int64
+	for _, operator := range d.Operators {
+		differences += operator.Differences()
+	}
+	return differences
+}
+
 func (d *Dispatcher) Cancel() {
 	d.cancel()
 }
@@ -44,7 +44,7 @@ var StopSignals = []os.Signal{
 }
 
 func main() {
-	plan, err := ParseArgs(os.Args[1:])
+	command, plan, err := ParseArgs(os.Args[1:])
 	if err != nil {
 		if err != ErrExit {
 			fmt.Printf("[ERROR] %v\n", err)
@@ -53,7 +53,7 @@ func main() {
 		return
 	}
 
-	dispatcher, err := NewDispatcher(plan)
+	dispatcher, err := NewDispatcher(command, plan)
 	if err != nil {
 		os.Exit(2)
 		return
@@ -83,6 +83,11 @@ func main() {
 
 	switch err {
 	case nil:
+		if differences := dispatcher.Differences(); differences > 0 {
+			log.Printf("[DIFFERENCES FOUND] %d\n", differences)
+			fmt.Fprintf(os.Stderr, "[DIFFERENCES FOUND] %d\n", differences)
+			os.Exit(3)
+		}
 	case context.Canceled:
 		log.Print("[USER CANCELED]\n")
 		fmt.Fprintf(os.Stderr, "[USER CANCELED]\n")
@@ -100,7 +105,7 @@ func main() {
 
 func StartSignalHandler(dispatcher *Dispatcher) {
 	go func() {
-		sigs := make(chan os.Signal)
+		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, StopSignals...)
 
 		<-sigs
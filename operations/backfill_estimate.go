@@ -0,0 +1,356 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"math"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	readUnitBytes  = 4096
+	writeUnitBytes = 1024
+)
+
+// backfillEstimate projects the capacity a full backfill consumes from the
+// input table's item count and a sample of its items
+type backfillEstimate struct {
+	// the items written, and the items the scan reads to find them
+	ItemCount    int64
+	ScannedCount int64
+	Sampled      int
+
+	// the average size of a written item, and the average RCUs scanning an item consumes
+	AverageItemSize float64
+	ScanReadUnits   float64
+
+	// the average WCUs writing an item consumes on the output table and on its indexes
+	TableWriteUnits float64
+	IndexWriteUnits float64
+
+	// the share of IndexWriteUnits consumed by the local indexes, from the
+	// table's capacity, and by each global index, from its own
+	LocalIndexWriteUnits  float64
+	GlobalIndexWriteUnits map[string]float64
+}
+
+// newBackfillEstimate measures the sampled items as they'd be written to the output table
+func newBackfillEstimate(itemCount int64, sample []map[string]*dynamodb.AttributeValue, output *dynamodb.TableDescription) backfillEstimate {
+	estimate := backfillEstimate{
+		ItemCount:    itemCount,
+		ScannedCount: itemCount,
+		Sampled:      len(sample),
+
+		GlobalIndexWriteUnits: make(map[string]float64),
+	}
+	if len(sample) == 0 {
+		return estimate
+	}
+
+	var size, tableUnits, indexUnits, localUnits int64
+	globalUnits := make(map[string]int64)
+	for _, item := range sample {
+		size += itemSize(item)
+		tableUnits += writeUnits(itemSize(item))
+		indexUnits += indexWriteUnits(item, output)
+		for _, index := range output.LocalSecondaryIndexes {
+			localUnits += indexEntryUnits(item, output.KeySchema, index.KeySchema, index.Projection)
+		}
+		for _, index := range output.GlobalSecondaryIndexes {
+			globalUnits[aws.StringValue(index.IndexName)] += indexEntryUnits(item, output.KeySchema, index.KeySchema, index.Projection)
+		}
+	}
+
+	count := float64(len(sample))
+	estimate.AverageItemSize = float64(size) / count
+	estimate.ScanReadUnits = estimate.AverageItemSize / readUnitBytes / 2
+	estimate.TableWriteUnits = float64(tableUnits) / count
+	estimate.IndexWriteUnits = float64(indexUnits) / count
+	estimate.LocalIndexWriteUnits = float64(localUnits) / count
+	for name, units := range globalUnits {
+		estimate.GlobalIndexWriteUnits[name] = float64(units) / count
+	}
+	return estimate
+}
+
+// filtered scales the estimate for a partial backfill, whose sample is the
+// items matching its filter out of the scanned items, projected.  Filtered
+// items are still read in full, so the scan is measured by the RCUs sampling
+// consumed rather than by the projected items' size.
+func (e backfillEstimate) filtered(scanned int64, readUnits float64) backfillEstimate {
+	if scanned == 0 {
+		return e
+	}
+	e.ItemCount = int64(math.Round(float64(e.ScannedCount) * float64(e.Sampled) / float64(scanned)))
+	e.ScanReadUnits = readUnits / float64(scanned)
+	return e
+}
+
+// ReadUnits returns the RCUs an eventually consistent scan of the table consumes
+func (e backfillEstimate) ReadUnits() float64 {
+	return float64(e.ScannedCount) * e.ScanReadUnits
+}
+
+// WriteUnits returns the WCUs writing every item consumes, including its indexes
+func (e backfillEstimate) WriteUnits() float64 {
+	return float64(e.ItemCount) * (e.TableWriteUnits + e.IndexWriteUnits)
+}
+
+// WriteAmplification returns how many times more WCUs an item's writes consume
+// because of the output table's indexes
+func (e backfillEstimate) WriteAmplification() float64 {
+	if e.TableWriteUnits == 0 {
+		return 1
+	}
+	return (e.TableWriteUnits + e.IndexWriteUnits) / e.TableWriteUnits
+}
+
+// capacityCost is one side of the backfill: the capacity units it consumes,
+// and the rate it consumes them at, zero when unknown
+type capacityCost struct {
+	Units    float64
+	Rate     float64
+	OnDemand bool
+
+	// set when parts of the units are consumed from capacities of their own,
+	// the table's and each global index's, with Rate their total
+	Components []capacityCost
+}
+
+// Duration returns how long consuming the units takes, false when the rate is
+// unknown.  The slowest component bounds the whole.
+func (c capacityCost) Duration() (time.Duration, bool) {
+	if c.Rate <= 0 {
+		return 0, false
+	}
+
+	duration := time.Duration(c.Units / c.Rate * float64(time.Second))
+	for _, component := range c.Components {
+		componentDuration, ok := component.Duration()
+		if !ok {
+			return 0, false
+		}
+		if componentDuration > duration {
+			duration = componentDuration
+		}
+	}
+	return duration, true
+}
+
+// Cost returns the price of the units on demand, or of provisioning the rate
+// for the backfill's duration.  It's false when the cost depends on an unknown duration.
+func (c capacityCost) Cost(requestUnitPrice, capacityHourPrice float64, duration time.Duration, durationKnown bool) (float64, bool) {
+	if c.OnDemand {
+		return c.Units * requestUnitPrice, true
+	}
+	if !durationKnown {
+		return 0, false
+	}
+	return c.Rate * duration.Hours() * capacityHourPrice, true
+}
+
+// readCost returns the scan's side of the backfill.  It runs at the estimate's
+// read rate, else the lower of the backfill's and the plan's read capacity
+// limits, else the input table's provisioned capacity.
+func readCost(plan config.OperationPlan, input *dynamodb.TableDescription, units float64) capacityCost {
+	cost := capacityCost{
+		Units:    units,
+		Rate:     plan.Estimate.ReadRate,
+		OnDemand: billingMode(input) == dynamodb.BillingModePayPerRequest,
+	}
+	if cost.Rate == 0 {
+		cost.Rate = lowestLimit(plan.Backfill.ReadCapacityLimit, plan.ReadCapacityLimit)
+	}
+	if cost.Rate == 0 && !cost.OnDemand {
+		read, _ := throughputUnits(input.ProvisionedThroughput)
+		cost.Rate = float64(read)
+	}
+	return cost
+}
+
+// writeCost returns the writes' side of the backfill.  It runs at the
+// estimate's write rate, else the lower of the backfill's and the plan's write
+// capacity limits, else the output table's and its global indexes'
+// provisioned capacity while the backfill runs.  Each global index throttles
+// on its own capacity, so one with too little slows the whole backfill.
+func writeCost(plan config.OperationPlan, output *dynamodb.TableDescription, estimate backfillEstimate) capacityCost {
+	backfillCapacity := plan.Output.BackfillCapacity
+	cost := capacityCost{
+		Units:    estimate.WriteUnits(),
+		Rate:     plan.Estimate.WriteRate,
+		OnDemand: billingMode(output) == dynamodb.BillingModePayPerRequest || backfillCapacity.OnDemand,
+	}
+	if cost.Rate == 0 {
+		cost.Rate = lowestLimit(plan.Backfill.WriteCapacityLimit, plan.WriteCapacityLimit)
+	}
+	if cost.Rate == 0 && !cost.OnDemand {
+		items := float64(estimate.ItemCount)
+
+		// Local indexes consume the table's capacity
+		_, write := throughputUnits(output.ProvisionedThroughput)
+		table := capacityCost{
+			Units: items * (estimate.TableWriteUnits + estimate.LocalIndexWriteUnits),
+			Rate:  float64(maxInt64(write, backfillCapacity.WriteCapacity)),
+		}
+		cost.Components = append(cost.Components, table)
+		cost.Rate = table.Rate
+
+		for _, index := range output.GlobalSecondaryIndexes {
+			_, write := throughputUnits(index.ProvisionedThroughput)
+			component := capacityCost{
+				Units: items * estimate.GlobalIndexWriteUnits[aws.StringValue(index.IndexName)],
+				Rate:  float64(maxInt64(write, backfillCapacity.WriteCapacity)),
+			}
+			cost.Components = append(cost.Components, component)
+			cost.Rate += component.Rate
+		}
+	}
+	return cost
+}
+
+// lowestLimit returns the lowest of the capacity limits, zero when none is set
+func lowestLimit(limits ...float64) float64 {
+	var lowest float64
+	for _, limit := range limits {
+		if limit > 0 && (lowest == 0 || limit < lowest) {
+			lowest = limit
+		}
+	}
+	return lowest
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// itemSize approximates an item's size as DynamoDB measures it: the length of
+// each attribute's name plus the size of its value
+func itemSize(item map[string]*dynamodb.AttributeValue) int64 {
+	var size int64
+	for name, value := range item {
+		size += int64(len(name)) + attributeSize(value)
+	}
+	return size
+}
+
+func attributeSize(value *dynamodb.AttributeValue) int64 {
+	var size int64
+	switch {
+	case value.S != nil:
+		size = int64(len(*value.S))
+	case value.N != nil:
+		size = numberSize(*value.N)
+	case value.B != nil:
+		size = int64(len(value.B))
+	case value.BOOL != nil, value.NULL != nil:
+		size = 1
+	case value.SS != nil:
+		for _, s := range value.SS {
+			size += int64(len(*s))
+		}
+	case value.NS != nil:
+		for _, n := range value.NS {
+			size += numberSize(*n)
+		}
+	case value.BS != nil:
+		for _, b := range value.BS {
+			size += int64(len(b))
+		}
+	case value.L != nil:
+		size = 3
+		for _, element := range value.L {
+			size += 1 + attributeSize(element)
+		}
+	case value.M != nil:
+		size = 3
+		for name, element := range value.M {
+			size += int64(len(name)) + 1 + attributeSize(element)
+		}
+	}
+	return size
+}
+
+// numberSize is about a byte for every two significant digits, plus one
+func numberSize(number string) int64 {
+	var digits int64
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	return (digits+1)/2 + 1
+}
+
+// writeUnits returns the WCUs writing an item of the given size consumes
+func writeUnits(size int64) int64 {
+	units := int64(math.Ceil(float64(size) / writeUnitBytes))
+	if units < 1 {
+		return 1
+	}
+	return units
+}
+
+// indexWriteUnits returns the WCUs writing an item consumes on the indexes it appears in
+func indexWriteUnits(item map[string]*dynamodb.AttributeValue, table *dynamodb.TableDescription) int64 {
+	var units int64
+	for _, index := range table.GlobalSecondaryIndexes {
+		units += indexEntryUnits(item, table.KeySchema, index.KeySchema, index.Projection)
+	}
+	for _, index := range table.LocalSecondaryIndexes {
+		units += indexEntryUnits(item, table.KeySchema, index.KeySchema, index.Projection)
+	}
+	return units
+}
+
+// indexEntryUnits returns the WCUs of an item's projection into an index, zero
+// when the item lacks the index's keys and doesn't appear in it
+func indexEntryUnits(item map[string]*dynamodb.AttributeValue, tableKeys, indexKeys []*dynamodb.KeySchemaElement, projection *dynamodb.Projection) int64 {
+	projected := make(map[string]*dynamodb.AttributeValue)
+	for _, keys := range [][]*dynamodb.KeySchemaElement{indexKeys, tableKeys} {
+		for _, key := range keys {
+			name := aws.StringValue(key.AttributeName)
+			value, ok := item[name]
+			if !ok {
+				return 0
+			}
+			projected[name] = value
+		}
+	}
+
+	switch {
+	case projection == nil:
+	case aws.StringValue(projection.ProjectionType) == dynamodb.ProjectionTypeAll:
+		projected = item
+	case aws.StringValue(projection.ProjectionType) == dynamodb.ProjectionTypeInclude:
+		for _, name := range aws.StringValueSlice(projection.NonKeyAttributes) {
+			if value, ok := item[name]; ok {
+				projected[name] = value
+			}
+		}
+	}
+	return writeUnits(itemSize(projected))
+}
@@ -0,0 +1,206 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestItemSize(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String("abc")},
+		"score": {N: aws.String("-123.45")},
+		"ok":    {BOOL: aws.Bool(true)},
+		"tags":  {L: []*dynamodb.AttributeValue{{S: aws.String("a")}, {S: aws.String("bc")}}},
+	}
+
+	// id 2+3, score 5+4, ok 2+1, tags 4+3+(1+1)+(1+2)
+	if size := itemSize(item); size != 29 {
+		t.Errorf("Expected an item size of 29 bytes, got %d", size)
+	}
+}
+
+func TestIndexWriteUnits(t *testing.T) {
+	table := &dynamodb.TableDescription{
+		KeySchema: []*dynamodb.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{
+			{
+				KeySchema:  []*dynamodb.KeySchemaElement{{AttributeName: aws.String("email"), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+			},
+			{
+				KeySchema:  []*dynamodb.KeySchemaElement{{AttributeName: aws.String("name"), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			},
+		},
+	}
+
+	item := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String("1")},
+		"email": {S: aws.String("someone@example.com")},
+		"body":  {S: aws.String(strings.Repeat("x", 2000))},
+	}
+	if units := indexWriteUnits(item, table); units != 1 {
+		t.Errorf("Expected only the keys only index to be written, got %d WCUs", units)
+	}
+
+	item["name"] = &dynamodb.AttributeValue{S: aws.String("Someone")}
+	if units := indexWriteUnits(item, table); units != 3 {
+		t.Errorf("Expected 1 WCU for the keys only index and 2 for the whole item, got %d", units)
+	}
+}
+
+func TestBackfillEstimate(t *testing.T) {
+	table := &dynamodb.TableDescription{
+		KeySchema: []*dynamodb.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{{
+			IndexName:  aws.String("by-id"),
+			KeySchema:  []*dynamodb.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+		}},
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"id":   {S: aws.String("1")},
+		"body": {S: aws.String(strings.Repeat("x", 4089))},
+	}
+
+	estimate := newBackfillEstimate(1000, []map[string]*dynamodb.AttributeValue{item, item}, table)
+	if estimate.AverageItemSize != 4096 {
+		t.Errorf("Expected an average item size of 4096 bytes, got %v", estimate.AverageItemSize)
+	}
+	if reads := estimate.ReadUnits(); reads != 500 {
+		t.Errorf("Expected 500 RCUs to scan 1000 4KB items, got %v", reads)
+	}
+	if writes := estimate.WriteUnits(); writes != 8000 {
+		t.Errorf("Expected 8000 WCUs to write 1000 4KB items and their index entries, got %v", writes)
+	}
+	if amplification := estimate.WriteAmplification(); amplification != 2 {
+		t.Errorf("Expected a write amplification of 2, got %v", amplification)
+	}
+	if units := estimate.GlobalIndexWriteUnits["by-id"]; units != 4 {
+		t.Errorf("Expected the index's share of 4 WCUs an item, got %v", units)
+	}
+
+	if empty := newBackfillEstimate(1000, nil, table); empty.ReadUnits() != 0 || empty.WriteAmplification() != 1 {
+		t.Errorf("Expected an empty sample to estimate nothing, got %+v", empty)
+	}
+}
+
+func TestFilteredBackfillEstimate(t *testing.T) {
+	table := provisioned(testTable(), testThroughput(10, 10))
+	item := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}}
+
+	// 2 of the 8 items scanned matched, and scanning them consumed 4 RCUs
+	estimate := newBackfillEstimate(1000, []map[string]*dynamodb.AttributeValue{item, item}, table).filtered(8, 4)
+	if estimate.ItemCount != 250 || estimate.ScannedCount != 1000 {
+		t.Errorf("Expected 250 of the 1000 items to be written, got %+v", estimate)
+	}
+	if reads := estimate.ReadUnits(); reads != 500 {
+		t.Errorf("Expected the whole table's 500 RCUs to be scanned, got %v", reads)
+	}
+	if writes := estimate.WriteUnits(); writes != 250 {
+		t.Errorf("Expected 250 WCUs to write the matching items, got %v", writes)
+	}
+}
+
+func TestWriteCostRate(t *testing.T) {
+	table := provisioned(testTable("by-email"), testThroughput(10, 50), testThroughput(5, 25))
+	estimate := backfillEstimate{ItemCount: 7500, TableWriteUnits: 1}
+
+	plan := config.OperationPlan{}
+	if cost := writeCost(plan, table, estimate); cost.Rate != 75 || cost.OnDemand {
+		t.Errorf("Expected the table's and index's 75 WCUs, got %+v", cost)
+	}
+
+	plan.Output.BackfillCapacity.WriteCapacity = 200
+	if cost := writeCost(plan, table, estimate); cost.Rate != 400 {
+		t.Errorf("Expected the raised 400 WCUs, got %+v", cost)
+	}
+
+	plan.Backfill.WriteCapacityLimit = 100
+	if cost := writeCost(plan, table, estimate); cost.Rate != 100 {
+		t.Errorf("Expected the backfill's 100 WCU limit, got %+v", cost)
+	}
+
+	plan.WriteCapacityLimit = 80
+	if cost := writeCost(plan, table, estimate); cost.Rate != 80 {
+		t.Errorf("Expected the plan's lower 80 WCU limit, got %+v", cost)
+	}
+
+	plan.Estimate.WriteRate = 150
+	if cost := writeCost(plan, table, estimate); cost.Rate != 150 {
+		t.Errorf("Expected the estimate's 150 WCU rate, got %+v", cost)
+	}
+
+	cost := writeCost(plan, table, estimate)
+	duration, known := cost.Duration()
+	if !known || duration != 50*time.Second {
+		t.Errorf("Expected 7500 WCUs to take 50s, got %v", duration)
+	}
+	price, known := cost.Cost(1, 3600, duration, known)
+	if !known || math.Abs(price-7500) > 0.001 {
+		t.Errorf("Expected 150 WCUs for 50s to cost $7500, got %v", price)
+	}
+}
+
+func TestWriteCostSlowestIndex(t *testing.T) {
+	table := provisioned(testTable("by-email"), testThroughput(10, 1000), testThroughput(5, 10))
+	estimate := backfillEstimate{
+		ItemCount:             10000,
+		TableWriteUnits:       1,
+		IndexWriteUnits:       1,
+		GlobalIndexWriteUnits: map[string]float64{"by-email": 1},
+	}
+
+	cost := writeCost(config.OperationPlan{}, table, estimate)
+	if cost.Rate != 1010 || cost.Units != 20000 {
+		t.Errorf("Expected 20000 WCUs provisioned at 1010 WCUs in all, got %+v", cost)
+	}
+
+	// The index writes its 10000 WCUs at 10 WCUs a second, not the table's 10s
+	duration, known := cost.Duration()
+	if !known || duration != 1000*time.Second {
+		t.Errorf("Expected the index's capacity to bound the writes to 1000s, got %v", duration)
+	}
+	price, known := cost.Cost(1, 3600, duration, known)
+	if !known || math.Abs(price-1010000) > 0.001 {
+		t.Errorf("Expected 1010 WCUs for 1000s to cost $1010000, got %v", price)
+	}
+}
+
+func TestOnDemandCost(t *testing.T) {
+	table := provisioned(testTable(), testThroughput(0, 0))
+	table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+
+	cost := readCost(config.OperationPlan{}, table, 2000000)
+	if _, known := cost.Duration(); known || !cost.OnDemand {
+		t.Errorf("Expected an on demand table's rate to be unknown, got %+v", cost)
+	}
+	if price, known := cost.Cost(0.125/1000000, 0, 0, false); !known || price != 0.25 {
+		t.Errorf("Expected 2m read request units to cost $0.25, got %v", price)
+	}
+}
@@ -24,10 +24,12 @@ import (
 	"math"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/instructure/ddb-sync/config"
 	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/state"
 	"github.com/instructure/ddb-sync/status"
 	"github.com/instructure/ddb-sync/utils"
 
@@ -35,6 +37,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+// How long a finished backfill waits for the output table's capacity to be
+// restored before leaving it to the cleanup command
+const restoreCapacityTimeout = 10 * time.Minute
+
 type BackfillRecord map[string]*dynamodb.AttributeValue
 
 func (r *BackfillRecord) request() *dynamodb.WriteRequest {
@@ -45,17 +51,49 @@ func (r *BackfillRecord) request() *dynamodb.WriteRequest {
 	}
 }
 
+// backfillRecord is a scanned item along with the progress entry of its page
+type backfillRecord struct {
+	BackfillRecord
+
+	progress *ProgressEntry
+}
+
 type BackfillOperation struct {
 	OperationPlan     config.OperationPlan
 	context           context.Context
 	contextCancelFunc context.CancelFunc
 
 	backfillBeginOnce sync.Once
-	c                 chan BackfillRecord
+	c                 chan backfillRecord
+
+	state *state.Store
 
 	inputClient  *dynamodb.DynamoDB
 	outputClient *dynamodb.DynamoDB
 
+	sender *batchSender
+
+	// limit the capacity the scan reads and the writers write
+	readLimit  capacityLimit
+	writeLimit capacityLimit
+
+	// set when the backfill targets a utilization of the tables' capacity
+	controller *throughputController
+
+	// set when the output table's capacity is raised while backfilling
+	scaler *capacityScaler
+
+	// set when streaming runs alongside the backfill, items the stream has
+	// already written are skipped
+	fence               *KeyFence
+	supersededItemCount int64
+
+	// the items the scan evaluated, more than it read when filtering
+	scannedItemCount int64
+
+	// the items earlier runs of a resumed backfill wrote
+	resumedItemCount int64
+
 	scanning Phase
 	writing  Phase
 
@@ -65,7 +103,7 @@ type BackfillOperation struct {
 	writtenItemRateTracker *RateTracker
 }
 
-func NewBackfillOperation(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*BackfillOperation, error) {
+func NewBackfillOperation(ctx context.Context, plan config.OperationPlan, store *state.Store, cancelFunc context.CancelFunc) (*BackfillOperation, error) {
 	inputSession, outputSession, err := plan.GetSessions()
 	if err != nil {
 		return nil, err
@@ -75,12 +113,14 @@ func NewBackfillOperation(ctx context.Context, plan config.OperationPlan, cancel
 	outputClient := dynamodb.New(outputSession)
 
 	// Create operation w/instantiated clients
-	return &BackfillOperation{
+	o := &BackfillOperation{
 		OperationPlan:     plan,
 		context:           ctx,
 		contextCancelFunc: cancelFunc,
 
-		c: make(chan BackfillRecord, recordChanBuffer),
+		c: make(chan backfillRecord, recordChanBuffer),
+
+		state: store,
 
 		inputClient:  inputClient,
 		outputClient: outputClient,
@@ -89,10 +129,46 @@ func NewBackfillOperation(ctx context.Context, plan config.OperationPlan, cancel
 		rcuRateTracker:         NewRateTracker("RCUs", 9*time.Second),
 		wcuRateTracker:         NewRateTracker("WCUs", 9*time.Second),
 		writtenItemRateTracker: NewRateTracker("Written Items", 9*time.Second),
-	}, nil
+
+		readLimit:  readLimit(plan, plan.Backfill.ReadCapacityLimit),
+		writeLimit: writeLimit(plan, plan.Backfill.WriteCapacityLimit),
+	}
+
+	o.sender = &batchSender{
+		context:   ctx,
+		client:    outputClient,
+		tableName: plan.Output.TableName,
+		onWrite: func(items int, capacities []*dynamodb.ConsumedCapacity) {
+			o.writtenItemRateTracker.Increment(int64(items))
+			o.UpdateConsumedCapacity(capacities)
+		},
+		limit: o.writeLimit,
+	}
+
+	if plan.Output.BackfillCapacity.Enabled() {
+		o.scaler = &capacityScaler{
+			OperationPlan: plan,
+			client:        outputClient,
+			state:         store,
+		}
+	}
+
+	if plan.Backfill.TargetUtilization > 0 {
+		o.controller = newThroughputController(ctx, plan, inputClient, outputClient, o.rcuRateTracker, o.wcuRateTracker)
+		o.sender.onThrottle = o.controller.Throttled
+	}
+
+	return o, nil
 }
 
-func (o *BackfillOperation) Preflights(_ *dynamodb.DescribeTableOutput, _ *dynamodb.DescribeTableOutput) error {
+func (o *BackfillOperation) Preflights(in *dynamodb.DescribeTableOutput, _ *dynamodb.DescribeTableOutput) error {
+	backfill := o.OperationPlan.Backfill
+	if backfill.ProjectionExpression != "" {
+		err := checkProjection(backfill.ProjectionExpression, backfill.ExpressionAttributeNames, in.Table.KeySchema)
+		if err != nil {
+			return fmt.Errorf("[%s] Fails pre-flight check: %v", *in.Table.TableName, err)
+		}
+	}
 	return nil
 }
 
@@ -107,6 +183,21 @@ func (o *BackfillOperation) Run() error {
 	defer o.wcuRateTracker.Stop()
 	defer o.writtenItemRateTracker.Stop()
 
+	if o.scaler != nil {
+		err := o.scaler.Raise(o.context)
+		if err != nil {
+			o.scanning.Error()
+			return err
+		}
+		defer o.restoreCapacity()
+	}
+
+	if o.controller != nil {
+		controllerDone := make(chan struct{})
+		defer close(controllerDone)
+		go o.controller.Run(controllerDone)
+	}
+
 	collator := ErrorCollator{
 		Cancel: o.contextCancelFunc,
 	}
@@ -116,18 +207,54 @@ func (o *BackfillOperation) Run() error {
 	return collator.Run()
 }
 
+// restoreCapacity restores the output table's capacity however the backfill
+// ended, even when it was canceled.  The restore isn't bound to the backfill's
+// context, so it's given a timeout of its own rather than holding up the exit.
+func (o *BackfillOperation) restoreCapacity() {
+	ctx, cancel := context.WithTimeout(context.Background(), restoreCapacityTimeout)
+	defer cancel()
+
+	_, err := o.scaler.Restore(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("[ERROR] %s: Backfill capacity: the output table's capacity wasn't restored within %s, it's still saved in the state file, run the cleanup command to restore it", o.OperationPlan.Description(), restoreCapacityTimeout)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %v, run the cleanup command to restore it", err)
+	}
+}
+
 func (o *BackfillOperation) Status() string {
 	if o.writing.Complete() {
 		return completeMsg
 	} else if o.errored() {
 		return erroredMsg
 	}
+	if o.OperationPlan.Backfill.FilterExpression != "" {
+		return fmt.Sprintf("%d written (%s)", o.writtenItemRateTracker.Count(), o.matchedItems())
+	}
 	return fmt.Sprintf("%d written", o.writtenItemRateTracker.Count())
 }
 
+// writtenItemCount returns the items written, including those earlier runs of
+// a resumed backfill wrote
+func (o *BackfillOperation) writtenItemCount() int64 {
+	return atomic.LoadInt64(&o.resumedItemCount) + o.writtenItemRateTracker.Count()
+}
+
+// matchedItems describes how many of the items scanned matched the filter
+func (o *BackfillOperation) matchedItems() string {
+	return fmt.Sprintf("%d of %d scanned matched", o.readItemRateTracker.Count(), atomic.LoadInt64(&o.scannedItemCount))
+}
+
 func (o *BackfillOperation) Rate() string {
 	if o.writing.Running() {
-		return fmt.Sprintf("%s %s %s", o.rcuRateTracker.RatePerSecond(), status.BufferStatus(o.bufferFill(), o.bufferCapacity()), o.wcuRateTracker.RatePerSecond())
+		read, write := o.rcuRateTracker.RatePerSecond(), o.wcuRateTracker.RatePerSecond()
+		if o.controller != nil {
+			read += o.controller.ReadTarget()
+			write += o.controller.WriteTarget()
+		}
+		return fmt.Sprintf("%s %s %s", read, status.BufferStatus(o.bufferFill(), o.bufferCapacity()), write)
 	}
 	return ""
 }
@@ -135,7 +262,14 @@ func (o *BackfillOperation) Rate() string {
 // Checkpoint prints a logging statement summarizing the current state.  Meant for periodic update requests.
 func (o *BackfillOperation) Checkpoint() string {
 	if o.writing.Running() {
-		return fmt.Sprintf("%s: Backfill in progress: %d items written over %s", o.OperationPlan.Description(), o.writtenItemRateTracker.Count(), o.writtenItemRateTracker.Duration().String())
+		checkpoint := fmt.Sprintf("%s: Backfill in progress: %d items written over %s", o.OperationPlan.Description(), o.writtenItemRateTracker.Count(), o.writtenItemRateTracker.Duration().String())
+		if superseded := atomic.LoadInt64(&o.supersededItemCount); superseded > 0 {
+			checkpoint += fmt.Sprintf(" (%d skipped, already written by the stream)", superseded)
+		}
+		if o.OperationPlan.Backfill.FilterExpression != "" {
+			checkpoint += fmt.Sprintf(" (%s)", o.matchedItems())
+		}
+		return checkpoint
 	}
 	return ""
 }
@@ -148,43 +282,47 @@ func (o *BackfillOperation) scan() error {
 		Cancel: o.contextCancelFunc,
 	}
 
-	done := o.context.Done()
-
-	scanHandler := func(output *dynamodb.ScanOutput, lastPage bool) bool {
-		o.rcuRateTracker.Increment(int64(math.Ceil(*output.ConsumedCapacity.CapacityUnits)))
+	totalSegments := o.OperationPlan.Backfill.TotalSegments
+	if totalSegments < 1 {
+		totalSegments = 1
+	}
 
-		for _, item := range output.Items {
-			o.readItemRateTracker.Increment(1)
+	err := o.prepareState(totalSegments)
+	if err != nil {
+		o.scanning.Error()
+		return err
+	}
 
-			select {
-			case o.c <- BackfillRecord(item):
-			case <-done:
-				return false
-			}
-		}
-		return true
+	scanner := &SegmentedScanner{
+		Context:       o.context,
+		Client:        o.inputClient,
+		TableName:     o.OperationPlan.Input.TableName,
+		TotalSegments: o.OperationPlan.Backfill.TotalSegments,
+		Segments:      o.OperationPlan.Backfill.Segments,
+		PageHandler:   o.pageHandler,
+
+		FilterExpression:          o.OperationPlan.Backfill.FilterExpression,
+		ProjectionExpression:      o.OperationPlan.Backfill.ProjectionExpression,
+		ExpressionAttributeNames:  aws.StringMap(o.OperationPlan.Backfill.ExpressionAttributeNames),
+		ExpressionAttributeValues: o.OperationPlan.Backfill.ExpressionAttributeValues,
+	}
+	if o.OperationPlan.Backfill.Resume {
+		scanner.StartKey = o.savedStartKey
+	}
+	if o.controller != nil {
+		scanner.PageSize = o.controller.PageSize
 	}
 
-	if o.OperationPlan.Backfill.TotalSegments > 0 {
-		if len(o.OperationPlan.Backfill.Segments) > 0 {
-			// If segment indexes are provided, run those segments
-			for _, segmentIndex := range o.OperationPlan.Backfill.Segments {
-				collator.Register(o.scanner(segmentIndex, o.OperationPlan.Backfill.TotalSegments, scanHandler, done))
-			}
-		} else {
-			// If not segment indexes are provided, run all segment indices
-			for i := 0; i < o.OperationPlan.Backfill.TotalSegments; i++ {
-				collator.Register(o.scanner(i, o.OperationPlan.Backfill.TotalSegments, scanHandler, done))
-			}
-		}
-	} else {
-		// If unspecified, run a single segment
-		collator.Register(o.scanner(0, 1, scanHandler, done))
+	for _, segmentScanner := range scanner.Scanners() {
+		collator.Register(segmentScanner)
 	}
 
-	err := collator.Run()
+	err = collator.Run()
 	if err == nil {
 		log.Printf("%s: Backfill: scan complete %d items read over %s", o.OperationPlan.Description(), o.readItemRateTracker.Count(), utils.FormatDuration(o.readItemRateTracker.Duration()))
+		if o.OperationPlan.Backfill.FilterExpression != "" {
+			log.Printf("%s: Backfill: %s the filter", o.OperationPlan.Description(), o.matchedItems())
+		}
 
 		o.scanning.Finish()
 		return nil
@@ -198,31 +336,65 @@ func (o *BackfillOperation) scan() error {
 	return err
 }
 
-func (o *BackfillOperation) scanner(segIndex, segCount int, scanHandler func(*dynamodb.ScanOutput, bool) bool, done <-chan struct{}) func() error {
-	return func() error {
-		var input *dynamodb.ScanInput
-		if segCount > 1 {
-			input = &dynamodb.ScanInput{
-				ReturnConsumedCapacity: aws.String("TOTAL"),
-				Segment:                aws.Int64(int64(segIndex)),
-				TotalSegments:          aws.Int64(int64(segCount)),
-				TableName:              &o.OperationPlan.Input.TableName,
-			}
-		} else {
-			input = &dynamodb.ScanInput{
-				ReturnConsumedCapacity: aws.String("TOTAL"),
-				TableName:              &o.OperationPlan.Input.TableName,
-			}
-		}
+// prepareState keeps the recorded segment progress when resuming and discards it otherwise
+func (o *BackfillOperation) prepareState(totalSegments int) error {
+	if !o.OperationPlan.Backfill.Resume {
+		o.state.ResetBackfill(totalSegments)
+		return nil
+	}
 
-		err := o.inputClient.ScanPagesWithContext(o.context, input, scanHandler)
+	switch o.state.BackfillTotalSegments() {
+	case 0:
+		log.Printf("%s: Backfill: no saved progress to resume, starting from the beginning", o.OperationPlan.Description())
+		o.state.ResetBackfill(totalSegments)
+	case totalSegments:
+		log.Printf("%s: Backfill: resuming from saved progress", o.OperationPlan.Description())
+		atomic.StoreInt64(&o.resumedItemCount, o.state.BackfillWrittenCount())
+	default:
+		return fmt.Errorf("%s: Backfill cannot resume: saved progress used %d total segments, configured with %d", o.OperationPlan.Description(), o.state.BackfillTotalSegments(), totalSegments)
+	}
+	return nil
+}
 
-		select {
-		case <-done:
-			return o.context.Err()
-		default:
-			return err
+// savedStartKey resumes a segment from the progress recorded in the state file
+func (o *BackfillOperation) savedStartKey(segment int) (map[string]*dynamodb.AttributeValue, bool) {
+	saved := o.state.BackfillSegment(segment)
+	if saved.Complete {
+		log.Printf("%s: Backfill: segment %d already complete", o.OperationPlan.Description(), segment)
+		return nil, true
+	}
+	return saved.LastEvaluatedKey, false
+}
+
+func (o *BackfillOperation) pageHandler(segment int) func(output *dynamodb.ScanOutput) bool {
+	// A page's LastEvaluatedKey is only recorded once its items, and every
+	// page before it, have been written
+	progress := &ProgressQueue{}
+	done := o.context.Done()
+
+	return func(output *dynamodb.ScanOutput) bool {
+		o.rcuRateTracker.Increment(int64(math.Ceil(*output.ConsumedCapacity.CapacityUnits)))
+		o.readLimit.Take(output.ConsumedCapacity)
+		atomic.AddInt64(&o.scannedItemCount, aws.Int64Value(output.ScannedCount))
+
+		lastEvaluatedKey := output.LastEvaluatedKey
+		written := int64(len(output.Items))
+		entry := progress.Add(len(output.Items), func() {
+			o.state.SetBackfillSegment(segment, lastEvaluatedKey, written)
+		})
+
+		for _, item := range output.Items {
+			o.readItemRateTracker.Increment(1)
+
+			select {
+			case o.c <- backfillRecord{BackfillRecord: BackfillRecord(item), progress: entry}:
+			case <-done:
+				return false
+			}
 		}
+
+		// Holding the handler delays reading the segment's next page
+		return o.readLimit.Wait(o.context) == nil
 	}
 }
 
@@ -231,7 +403,11 @@ func (o *BackfillOperation) batchWrite() error {
 		Cancel: o.contextCancelFunc,
 	}
 
+	// The controller limits how many writers flush at once
 	fanOutWidth := runtime.NumCPU() * 1
+	if o.controller != nil {
+		fanOutWidth = o.controller.maxWriters
+	}
 	for i := 0; i < fanOutWidth; i++ {
 		collator.Register(o.batchWriter)
 	}
@@ -258,7 +434,8 @@ func (o *BackfillOperation) signalBackfillStart() {
 }
 
 func (o *BackfillOperation) batchWriter() error {
-	batch := make([]*dynamodb.WriteRequest, 0, 25)
+	batch := make([]*dynamodb.WriteRequest, 0, batchWriteMaxItems)
+	progress := make([]*ProgressEntry, 0, batchWriteMaxItems)
 
 	done := o.context.Done()
 
@@ -273,13 +450,14 @@ channel:
 			o.backfillBeginOnce.Do(o.signalBackfillStart)
 
 			batch = append(batch, record.request())
-			if len(batch) == 25 {
-				requestItems := map[string][]*dynamodb.WriteRequest{o.OperationPlan.Output.TableName: batch}
-				batch = batch[:0]
-				err := o.sendBatch(requestItems)
+			progress = append(progress, record.progress)
+			if len(batch) == batchWriteMaxItems {
+				err := o.flushBatch(batch, progress)
 				if err != nil {
 					return err
 				}
+				batch = batch[:0]
+				progress = progress[:0]
 			}
 
 		case <-done:
@@ -288,9 +466,7 @@ channel:
 	}
 
 	if len(batch) > 0 {
-		requestItems := map[string][]*dynamodb.WriteRequest{o.OperationPlan.Output.TableName: batch}
-
-		err := o.sendBatch(requestItems)
+		err := o.flushBatch(batch, progress)
 		if err != nil {
 			return err
 		}
@@ -298,33 +474,50 @@ channel:
 	return nil
 }
 
-func (o *BackfillOperation) sendBatch(batch map[string][]*dynamodb.WriteRequest) error {
-	input := &dynamodb.BatchWriteItemInput{
-		RequestItems:           batch,
-		ReturnConsumedCapacity: aws.String("TOTAL"),
+// flushBatch writes a batch and acknowledges its records once every item has been written
+func (o *BackfillOperation) flushBatch(batch []*dynamodb.WriteRequest, progress []*ProgressEntry) error {
+	items := make([]map[string]*dynamodb.AttributeValue, len(batch))
+	for i, request := range batch {
+		items[i] = request.PutRequest.Item
 	}
-	batchLength := len(batch[o.OperationPlan.Output.TableName])
 
-	err := input.Validate()
+	reserved := o.fence.Reserve(items)
+	requests := make([]*dynamodb.WriteRequest, 0, len(batch))
+	for i, request := range batch {
+		if reserved[i] {
+			requests = append(requests, request)
+		}
+	}
+	atomic.AddInt64(&o.supersededItemCount, int64(len(batch)-len(requests)))
+
+	var err error
+	if len(requests) > 0 {
+		err = o.send(requests)
+	}
+	o.fence.Release(items, reserved)
 	if err != nil {
 		return err
 	}
-	result, err := o.outputClient.BatchWriteItemWithContext(o.context, input)
-	if err != nil {
+
+	for _, entry := range progress {
+		entry.Ack()
 	}
+	return nil
+}
 
-	// self-reinvoking
-	if len(result.UnprocessedItems) > 0 && len(result.UnprocessedItems[o.OperationPlan.Output.TableName]) > 0 {
-		writeCount := batchLength - len(result.UnprocessedItems[o.OperationPlan.Output.TableName])
-		o.writtenItemRateTracker.Increment(int64(writeCount))
-		o.UpdateConsumedCapacity(result.ConsumedCapacity)
-		return o.sendBatch(result.UnprocessedItems)
+// send writes requests, waiting for the controller to allow another writer when set
+func (o *BackfillOperation) send(requests []*dynamodb.WriteRequest) error {
+	if o.controller == nil {
+		return o.sender.send(requests)
 	}
 
-	o.UpdateConsumedCapacity(result.ConsumedCapacity)
-	o.writtenItemRateTracker.Increment(int64(batchLength))
+	err := o.controller.writers.Acquire(o.context)
+	if err != nil {
+		return err
+	}
+	defer o.controller.writers.Release()
 
-	return nil
+	return o.sender.send(requests)
 }
 
 func (o *BackfillOperation) UpdateConsumedCapacity(capacities []*dynamodb.ConsumedCapacity) {
@@ -334,6 +527,7 @@ func (o *BackfillOperation) UpdateConsumedCapacity(capacities []*dynamodb.Consum
 	}
 
 	o.wcuRateTracker.Increment(int64(math.Ceil(agg)))
+	o.writeLimit.Take(capacities...)
 }
 
 func (o *BackfillOperation) bufferFill() int {
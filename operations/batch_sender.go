@@ -0,0 +1,103 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	batchWriteMaxItems = 25
+
+	unprocessedBackoffBase = 50 * time.Millisecond
+	unprocessedBackoffMax  = 5 * time.Second
+)
+
+// batchSender writes requests to a table with BatchWriteItem, resending any
+// unprocessed items until every item has been written
+type batchSender struct {
+	context   context.Context
+	client    *dynamodb.DynamoDB
+	tableName string
+
+	// called after each request with the number of items written and the capacity consumed
+	onWrite func(items int, capacities []*dynamodb.ConsumedCapacity)
+
+	// waited on before each request, the capacity is taken from it by onWrite
+	limit capacityLimit
+
+	// called when a request leaves items unprocessed, usually from throttling
+	onThrottle func()
+}
+
+// send writes up to batchWriteMaxItems requests
+func (s *batchSender) send(requests []*dynamodb.WriteRequest) error {
+	batch := map[string][]*dynamodb.WriteRequest{s.tableName: requests}
+	backoff := unprocessedBackoffBase
+
+	for {
+		input := &dynamodb.BatchWriteItemInput{
+			RequestItems:           batch,
+			ReturnConsumedCapacity: aws.String("TOTAL"),
+		}
+		batchLength := len(batch[s.tableName])
+
+		err := input.Validate()
+		if err != nil {
+			return err
+		}
+		err = s.limit.Wait(s.context)
+		if err != nil {
+			return err
+		}
+		result, err := s.client.BatchWriteItemWithContext(s.context, input)
+		if err != nil {
+			return err
+		}
+
+		unprocessed := result.UnprocessedItems[s.tableName]
+		if s.onWrite != nil {
+			s.onWrite(batchLength-len(unprocessed), result.ConsumedCapacity)
+		}
+
+		if len(unprocessed) == 0 {
+			return nil
+		}
+		if s.onThrottle != nil {
+			s.onThrottle()
+		}
+
+		// Unprocessed items are usually the result of throttling, so back off
+		// before resending them
+		select {
+		case <-time.After(backoff):
+		case <-s.context.Done():
+			return s.context.Err()
+		}
+		if backoff *= 2; backoff > unprocessedBackoffMax {
+			backoff = unprocessedBackoffMax
+		}
+
+		batch = result.UnprocessedItems
+	}
+}
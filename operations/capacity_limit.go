@@ -0,0 +1,136 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// tableBuckets holds the plan-wide capacity limits, shared by every operation
+// plan that reads from or writes to the same table
+var tableBuckets = &bucketRegistry{buckets: make(map[string]*TokenBucket)}
+
+type bucketRegistry struct {
+	m       sync.Mutex
+	buckets map[string]*TokenBucket
+}
+
+// bucket returns the shared bucket for a table, nil when rate is zero.  Tables
+// are told apart by the role they're reached with, since tables of the same
+// name and region in different accounts don't share capacity.  Plans
+// configuring different limits for the same table share the lowest.
+func (r *bucketRegistry) bucket(kind, roleARN, region, tableName string, rate float64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	key := fmt.Sprintf("%s %s %s/%s", kind, roleARN, region, tableName)
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(rate)
+		r.buckets[key] = bucket
+		return bucket
+	}
+
+	if current := bucket.Rate(); current != rate {
+		log.Printf("[WARNING] [%s] Plans configure different %s capacity limits, sharing the lowest", tableName, kind)
+		if rate < current {
+			bucket.SetRate(rate)
+		}
+	}
+	return bucket
+}
+
+// capacityLimit is the buckets a request is limited by, an operation's own
+// limit and the plan-wide limit of the table.  An empty limit never waits.
+type capacityLimit []*TokenBucket
+
+func newCapacityLimit(buckets ...*TokenBucket) capacityLimit {
+	var limit capacityLimit
+	for _, bucket := range buckets {
+		if bucket != nil {
+			limit = append(limit, bucket)
+		}
+	}
+	return limit
+}
+
+// readLimit returns the limit on an operation's reads from the input table
+func readLimit(plan config.OperationPlan, operationRate float64) capacityLimit {
+	return newCapacityLimit(
+		newBucket(operationRate),
+		tableBuckets.bucket("read", plan.Input.RoleARN, plan.Input.Region, plan.Input.TableName, plan.ReadCapacityLimit),
+	)
+}
+
+// writeLimit returns the limit on an operation's writes to the output table
+func writeLimit(plan config.OperationPlan, operationRate float64) capacityLimit {
+	return newCapacityLimit(
+		newBucket(operationRate),
+		tableBuckets.bucket("write", plan.Output.RoleARN, plan.Output.Region, plan.Output.TableName, plan.WriteCapacityLimit),
+	)
+}
+
+func newBucket(rate float64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return NewTokenBucket(rate)
+}
+
+// Wait blocks until every bucket allows the next request
+func (l capacityLimit) Wait(ctx context.Context) error {
+	for _, bucket := range l {
+		err := bucket.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take removes the capacity a request consumed from every bucket
+func (l capacityLimit) Take(capacities ...*dynamodb.ConsumedCapacity) {
+	if len(l) == 0 {
+		return
+	}
+
+	var units float64
+	for _, capacity := range capacities {
+		if capacity != nil && capacity.CapacityUnits != nil {
+			units += *capacity.CapacityUnits
+		}
+	}
+
+	now := time.Now()
+	for _, bucket := range l {
+		bucket.Take(now, units)
+	}
+}
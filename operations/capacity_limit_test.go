@@ -0,0 +1,67 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+
+	"github.com/instructure/ddb-sync/config"
+)
+
+func TestWriteLimitSharedByOutputTable(t *testing.T) {
+	plan := config.OperationPlan{
+		Input:              config.Input{Region: "us-west-2", TableName: "limit-source-1"},
+		Output:             config.Output{Region: "us-east-2", TableName: "limit-dest"},
+		WriteCapacityLimit: 100,
+	}
+	other := plan
+	other.Input.TableName = "limit-source-2"
+	other.WriteCapacityLimit = 50
+
+	first := writeLimit(plan, 0)
+	second := writeLimit(other, 25)
+
+	if len(first) != 1 || len(second) != 2 {
+		t.Fatalf("Expected the table's bucket, plus the operation's own when set, got %d and %d", len(first), len(second))
+	}
+	if first[0] != second[1] {
+		t.Errorf("Expected plans writing to the same table to share a bucket")
+	}
+	if rate := first[0].Rate(); rate != 50 {
+		t.Errorf("Expected the lowest configured limit to be shared, got %v", rate)
+	}
+
+	if limit := readLimit(plan, 0); len(limit) != 0 {
+		t.Errorf("Expected no read limit, got %d buckets", len(limit))
+	}
+}
+
+func TestWriteLimitSeparateByRole(t *testing.T) {
+	plan := config.OperationPlan{
+		Input:              config.Input{Region: "us-west-2", TableName: "limit-source"},
+		Output:             config.Output{Region: "us-east-2", TableName: "limit-dest-role", RoleARN: "arn:aws:iam::111111111111:role/sync"},
+		WriteCapacityLimit: 100,
+	}
+	other := plan
+	other.Output.RoleARN = "arn:aws:iam::222222222222:role/sync"
+
+	if writeLimit(plan, 0)[0] == writeLimit(other, 0)[0] {
+		t.Errorf("Expected tables reached with different roles to have their own buckets")
+	}
+}
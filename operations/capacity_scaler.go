@@ -0,0 +1,240 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// capacityScaler raises the output table's capacity for the backfill and
+// restores it afterwards.  The capacity from before is kept in the state file
+// until it's restored, so the cleanup command can restore it after a crash.
+type capacityScaler struct {
+	OperationPlan config.OperationPlan
+
+	client dynamodbiface.DynamoDBAPI
+	state  *state.Store
+}
+
+// Raise saves the output table's capacity and raises it, waiting for the table to be active again
+func (s *capacityScaler) Raise(ctx context.Context) error {
+	table, err := s.describe(ctx)
+	if err != nil {
+		return err
+	}
+
+	saved := s.state.SavedCapacity()
+	if saved != nil {
+		log.Printf("%s: Backfill capacity: keeping the capacity saved by an earlier run", s.OperationPlan.Description())
+	} else if billingMode(table) == dynamodb.BillingModePayPerRequest {
+		log.Printf("%s: Backfill capacity: the output table already has on demand capacity", s.OperationPlan.Description())
+		return nil
+	} else {
+		saved = savedCapacity(table)
+		s.state.SetSavedCapacity(saved)
+		err = s.state.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	input := raiseInput(table, s.OperationPlan.Output.BackfillCapacity)
+	if input == nil {
+		log.Printf("%s: Backfill capacity: the output table already has the configured capacity", s.OperationPlan.Description())
+		return nil
+	}
+
+	log.Printf("%s: Backfill capacity: raising the output table's capacity…", s.OperationPlan.Description())
+	err = s.update(ctx, input)
+	if err != nil {
+		return fmt.Errorf("%s: Failed raising the output table's capacity: %v", s.OperationPlan.Description(), err)
+	}
+	log.Printf("%s: Backfill capacity: raised", s.OperationPlan.Description())
+	return nil
+}
+
+// Restore returns the output table to its saved capacity and forgets it,
+// waiting for the table to be active again so it's ready for the next update,
+// such as creating deferred indexes.  It reports whether there was a saved
+// capacity to restore.
+func (s *capacityScaler) Restore(ctx context.Context) (bool, error) {
+	saved := s.state.SavedCapacity()
+	if saved == nil {
+		return false, nil
+	}
+
+	table, err := s.describe(ctx)
+	if err != nil {
+		return true, err
+	}
+
+	input := restoreInput(table, saved)
+	if input != nil {
+		err = s.update(ctx, input)
+		if err != nil {
+			return true, fmt.Errorf("%s: Failed restoring the output table's capacity: %v", s.OperationPlan.Description(), err)
+		}
+	}
+
+	s.state.ClearSavedCapacity()
+	log.Printf("%s: Backfill capacity: the output table's capacity is restored", s.OperationPlan.Description())
+	return true, nil
+}
+
+func (s *capacityScaler) describe(ctx context.Context) (*dynamodb.TableDescription, error) {
+	output, err := s.client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.OperationPlan.Output.TableName)})
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Describe table operation failed with %v", s.OperationPlan.Output.TableName, err)
+	}
+	return output.Table, nil
+}
+
+func (s *capacityScaler) update(ctx context.Context, input *dynamodb.UpdateTableInput) error {
+	_, err := s.client.UpdateTableWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	return s.client.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName})
+}
+
+func billingMode(table *dynamodb.TableDescription) string {
+	if table.BillingModeSummary != nil && table.BillingModeSummary.BillingMode != nil {
+		return *table.BillingModeSummary.BillingMode
+	}
+	return dynamodb.BillingModeProvisioned
+}
+
+// savedCapacity returns a provisioned table's capacity
+func savedCapacity(table *dynamodb.TableDescription) *state.CapacityState {
+	read, write := throughputUnits(table.ProvisionedThroughput)
+	saved := &state.CapacityState{
+		BillingMode:   billingMode(table),
+		ReadCapacity:  read,
+		WriteCapacity: write,
+		Indexes:       make(map[string]state.IndexCapacity),
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		read, write := throughputUnits(index.ProvisionedThroughput)
+		saved.Indexes[aws.StringValue(index.IndexName)] = state.IndexCapacity{ReadCapacity: read, WriteCapacity: write}
+	}
+	return saved
+}
+
+func throughputUnits(throughput *dynamodb.ProvisionedThroughputDescription) (int64, int64) {
+	if throughput == nil {
+		return 0, 0
+	}
+	return aws.Int64Value(throughput.ReadCapacityUnits), aws.Int64Value(throughput.WriteCapacityUnits)
+}
+
+// raiseInput returns the update raising a provisioned table's capacity, or nil
+// when the table already has at least the configured capacity
+func raiseInput(table *dynamodb.TableDescription, capacity config.BackfillCapacity) *dynamodb.UpdateTableInput {
+	if billingMode(table) == dynamodb.BillingModePayPerRequest {
+		return nil
+	}
+
+	if capacity.OnDemand {
+		return &dynamodb.UpdateTableInput{
+			TableName:   table.TableName,
+			BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		}
+	}
+
+	input := &dynamodb.UpdateTableInput{TableName: table.TableName}
+	read, write := throughputUnits(table.ProvisionedThroughput)
+	if write < capacity.WriteCapacity {
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(read),
+			WriteCapacityUnits: aws.Int64(capacity.WriteCapacity),
+		}
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		read, write := throughputUnits(index.ProvisionedThroughput)
+		if write < capacity.WriteCapacity {
+			input.GlobalSecondaryIndexUpdates = append(input.GlobalSecondaryIndexUpdates, indexThroughputUpdate(index.IndexName, read, capacity.WriteCapacity))
+		}
+	}
+
+	if input.ProvisionedThroughput == nil && len(input.GlobalSecondaryIndexUpdates) == 0 {
+		return nil
+	}
+	return input
+}
+
+// restoreInput returns the update returning a table to its saved capacity, or
+// nil when it already has it.  Indexes created since it was saved keep the
+// table's saved capacity when switching back from on demand, and are
+// otherwise left alone.
+func restoreInput(table *dynamodb.TableDescription, saved *state.CapacityState) *dynamodb.UpdateTableInput {
+	input := &dynamodb.UpdateTableInput{TableName: table.TableName}
+	onDemand := billingMode(table) == dynamodb.BillingModePayPerRequest
+	if onDemand {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+	}
+
+	read, write := throughputUnits(table.ProvisionedThroughput)
+	if onDemand || read != saved.ReadCapacity || write != saved.WriteCapacity {
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(saved.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(saved.WriteCapacity),
+		}
+	}
+
+	for _, index := range table.GlobalSecondaryIndexes {
+		savedIndex, ok := saved.Indexes[aws.StringValue(index.IndexName)]
+		if !ok && !onDemand {
+			continue
+		}
+		if !ok {
+			savedIndex = state.IndexCapacity{ReadCapacity: saved.ReadCapacity, WriteCapacity: saved.WriteCapacity}
+		}
+
+		read, write := throughputUnits(index.ProvisionedThroughput)
+		if onDemand || read != savedIndex.ReadCapacity || write != savedIndex.WriteCapacity {
+			input.GlobalSecondaryIndexUpdates = append(input.GlobalSecondaryIndexUpdates, indexThroughputUpdate(index.IndexName, savedIndex.ReadCapacity, savedIndex.WriteCapacity))
+		}
+	}
+
+	if input.BillingMode == nil && input.ProvisionedThroughput == nil && len(input.GlobalSecondaryIndexUpdates) == 0 {
+		return nil
+	}
+	return input
+}
+
+func indexThroughputUpdate(indexName *string, read, write int64) *dynamodb.GlobalSecondaryIndexUpdate {
+	return &dynamodb.GlobalSecondaryIndexUpdate{
+		Update: &dynamodb.UpdateGlobalSecondaryIndexAction{
+			IndexName: indexName,
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(read),
+				WriteCapacityUnits: aws.Int64(write),
+			},
+		},
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestRaiseInputOnlyRaises(t *testing.T) {
+	table := provisioned(testTable("by-email"), testThroughput(10, 50), testThroughput(5, 500))
+
+	input := raiseInput(table, config.BackfillCapacity{WriteCapacity: 200})
+	if input == nil || input.ProvisionedThroughput == nil {
+		t.Fatalf("Expected the table's capacity to be raised, got %v", input)
+	}
+	if *input.ProvisionedThroughput.ReadCapacityUnits != 10 || *input.ProvisionedThroughput.WriteCapacityUnits != 200 {
+		t.Errorf("Expected 10 RCUs and 200 WCUs, got %v", input.ProvisionedThroughput)
+	}
+	if len(input.GlobalSecondaryIndexUpdates) != 0 {
+		t.Errorf("Expected an index with more capacity to be left alone, got %v", input.GlobalSecondaryIndexUpdates)
+	}
+
+	if input := raiseInput(table, config.BackfillCapacity{WriteCapacity: 50}); input != nil {
+		t.Errorf("Expected no update when the capacity is already high enough, got %v", input)
+	}
+
+	if input := raiseInput(table, config.BackfillCapacity{OnDemand: true}); input == nil || aws.StringValue(input.BillingMode) != dynamodb.BillingModePayPerRequest {
+		t.Errorf("Expected a switch to on demand, got %v", input)
+	}
+}
+
+func TestRestoreInputFromOnDemand(t *testing.T) {
+	saved := savedCapacity(provisioned(testTable("by-email"), testThroughput(10, 50), testThroughput(5, 25)))
+
+	table := provisioned(testTable("by-email", "by-name"), testThroughput(0, 0), testThroughput(0, 0), testThroughput(0, 0))
+	table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+
+	input := restoreInput(table, saved)
+	if input == nil || aws.StringValue(input.BillingMode) != dynamodb.BillingModeProvisioned {
+		t.Fatalf("Expected a switch back to provisioned capacity, got %v", input)
+	}
+	if *input.ProvisionedThroughput.WriteCapacityUnits != 50 {
+		t.Errorf("Expected the saved 50 WCUs, got %v", input.ProvisionedThroughput)
+	}
+
+	restored := make(map[string]int64)
+	for _, update := range input.GlobalSecondaryIndexUpdates {
+		restored[*update.Update.IndexName] = *update.Update.ProvisionedThroughput.WriteCapacityUnits
+	}
+	if restored["by-email"] != 25 || restored["by-name"] != 50 {
+		t.Errorf("Expected saved index capacity, or the table's for a new index, got %v", restored)
+	}
+}
+
+func TestRestoreInputUnchanged(t *testing.T) {
+	table := provisioned(testTable("by-email"), testThroughput(10, 50), testThroughput(5, 25))
+	if input := restoreInput(table, savedCapacity(table)); input != nil {
+		t.Errorf("Expected no update for a table with its saved capacity, got %v", input)
+	}
+
+	saved := &state.CapacityState{BillingMode: dynamodb.BillingModeProvisioned, ReadCapacity: 10, WriteCapacity: 50}
+	if input := restoreInput(table, saved); input != nil {
+		t.Errorf("Expected an index created since the capacity was saved to be left alone, got %v", input)
+	}
+}
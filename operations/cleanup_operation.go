@@ -0,0 +1,228 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CleanupOperation undoes the changes ddb-sync recorded in the state file: it
+// disables the input table's stream when ddb-sync enabled it, restores the
+// output table's capacity when an interrupted backfill left it raised, and
+// creates the output table's indexes a backfill removed.  A stream that has
+// since been replaced is left alone.
+type CleanupOperation struct {
+	OperationPlan     config.OperationPlan
+	context           context.Context
+	contextCancelFunc context.CancelFunc
+
+	inputClient *dynamodb.DynamoDB
+
+	state   *state.Store
+	scaler  *capacityScaler
+	indexes *indexDeferral
+
+	// the input table's description, set by the preflights
+	input *dynamodb.TableDescription
+
+	cleaning Phase
+
+	mResult sync.Mutex
+	result  string
+}
+
+func NewCleanupOperation(ctx context.Context, plan config.OperationPlan, store *state.Store, cancelFunc context.CancelFunc) (*CleanupOperation, error) {
+	inputSession, outputSession, err := plan.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, err := newIndexDeferral(ctx, plan, store)
+	if err != nil {
+		return nil, err
+	}
+	// Only the indexes recorded as removed are created again
+	indexes.deferring = false
+
+	return &CleanupOperation{
+		OperationPlan:     plan,
+		context:           ctx,
+		contextCancelFunc: cancelFunc,
+
+		inputClient: dynamodb.New(inputSession),
+
+		state: store,
+		scaler: &capacityScaler{
+			OperationPlan: plan,
+			client:        dynamodb.New(outputSession),
+			state:         store,
+		},
+		indexes: indexes,
+	}, nil
+}
+
+func (o *CleanupOperation) Preflights(in *dynamodb.DescribeTableOutput, out *dynamodb.DescribeTableOutput) error {
+	o.input = in.Table
+	o.indexes.Preflights(in, out)
+	return nil
+}
+
+func (o *CleanupOperation) Run() error {
+	o.cleaning.Start()
+
+	var results []string
+	for _, step := range []func() (string, error){o.disableStream, o.restoreCapacity, o.restoreIndexes} {
+		result, err := step()
+		if err != nil {
+			return o.failed(err)
+		}
+		if result != "" {
+			results = append(results, result)
+		}
+	}
+
+	if len(results) == 0 {
+		log.Printf("%s: Cleanup: ddb-sync didn't change the tables, nothing to clean up", o.OperationPlan.Description())
+		o.finish("nothing to clean up")
+		return nil
+	}
+
+	log.Printf("%s: Cleanup complete", o.OperationPlan.Description())
+	o.finish(strings.Join(results, ", "))
+	return nil
+}
+
+// disableStream disables the stream ddb-sync enabled, returning "" when it didn't enable one
+func (o *CleanupOperation) disableStream() (string, error) {
+	streamARN := o.state.AutoEnabledStream()
+	if streamARN == "" {
+		return "", nil
+	}
+
+	stream := o.input.StreamSpecification
+	if stream == nil || !aws.BoolValue(stream.StreamEnabled) {
+		log.Printf("%s: Cleanup: the stream ddb-sync enabled is already disabled", o.OperationPlan.Description())
+		o.state.ClearAutoEnabledStream()
+		return "stream already disabled", nil
+	}
+	if aws.StringValue(o.input.LatestStreamArn) != streamARN {
+		log.Printf("[WARNING] %s: Cleanup: the input table's stream was replaced since ddb-sync enabled it, leaving it enabled", o.OperationPlan.Description())
+		o.state.ClearAutoEnabledStream()
+		return "stream replaced, left enabled", nil
+	}
+
+	log.Printf("%s: Cleanup: disabling the stream ddb-sync enabled on the input table…", o.OperationPlan.Description())
+	_, err := o.inputClient.UpdateTableWithContext(o.context, &dynamodb.UpdateTableInput{
+		TableName: o.input.TableName,
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled: aws.Bool(false),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = o.inputClient.WaitUntilTableExistsWithContext(o.context, &dynamodb.DescribeTableInput{TableName: o.input.TableName})
+	if err != nil {
+		return "", err
+	}
+
+	o.state.ClearAutoEnabledStream()
+	log.Printf("%s: Cleanup: the input table's stream is disabled", o.OperationPlan.Description())
+	return "stream disabled", nil
+}
+
+// restoreCapacity restores the output table's capacity when an interrupted
+// backfill left it raised, returning "" when it isn't
+func (o *CleanupOperation) restoreCapacity() (string, error) {
+	restored, err := o.scaler.Restore(o.context)
+	if err != nil || !restored {
+		return "", err
+	}
+	return "capacity restored", nil
+}
+
+// restoreIndexes creates the output table's indexes a backfill removed,
+// returning "" when none are missing
+func (o *CleanupOperation) restoreIndexes() (string, error) {
+	if !o.indexes.Pending() {
+		return "", nil
+	}
+
+	log.Printf("%s: Cleanup: creating the output table's indexes a backfill removed…", o.OperationPlan.Description())
+	err := o.indexes.Restore()
+	if err != nil {
+		return "", err
+	}
+	return "indexes restored", nil
+}
+
+func (o *CleanupOperation) finish(result string) {
+	o.mResult.Lock()
+	o.result = result
+	o.mResult.Unlock()
+
+	o.cleaning.Finish()
+}
+
+func (o *CleanupOperation) failed(err error) error {
+	err = RequestCanceledCheck(err)
+	if err == context.Canceled {
+		return err
+	}
+	o.cleaning.Error()
+	return fmt.Errorf("%s: Cleanup failed: %v", o.OperationPlan.Description(), err)
+}
+
+func (o *CleanupOperation) Status() string {
+	if o.cleaning.Errored() {
+		return erroredMsg
+	}
+	if o.cleaning.Complete() {
+		o.mResult.Lock()
+		defer o.mResult.Unlock()
+
+		return o.result
+	}
+	if o.cleaning.Running() {
+		return "cleaning up"
+	}
+	return pendingMsg
+}
+
+func (o *CleanupOperation) Rate() string {
+	return ""
+}
+
+func (o *CleanupOperation) Checkpoint() string {
+	if o.cleaning.Running() {
+		return fmt.Sprintf("%s: Cleanup in progress: %s", o.OperationPlan.Description(), o.Status())
+	}
+	return ""
+}
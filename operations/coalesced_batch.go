@@ -0,0 +1,92 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The most distinct keys a stream writer holds before flushing early
+const coalesceMaxKeys = 1000
+
+// coalescedBatch collects stream records, keeping only the last record for each key
+type coalescedBatch struct {
+	latest map[string]streamRecord
+	keys   []string
+
+	progress []*ProgressEntry
+	newest   time.Time
+}
+
+func newCoalescedBatch() *coalescedBatch {
+	return &coalescedBatch{
+		latest: make(map[string]streamRecord),
+	}
+}
+
+func (b *coalescedBatch) add(record streamRecord) {
+	key := ItemKey(record.Dynamodb.Keys)
+	if _, exists := b.latest[key]; !exists {
+		b.keys = append(b.keys, key)
+	}
+	b.latest[key] = record
+
+	b.progress = append(b.progress, record.progress)
+	if created := *record.Dynamodb.ApproximateCreationDateTime; created.After(b.newest) {
+		b.newest = created
+	}
+}
+
+// recordCount returns the number of records added to the batch
+func (b *coalescedBatch) recordCount() int {
+	return len(b.progress)
+}
+
+// keyCount returns the number of distinct keys in the batch
+func (b *coalescedBatch) keyCount() int {
+	return len(b.keys)
+}
+
+// latestRecords returns the last record added for each key
+func (b *coalescedBatch) latestRecords() []streamRecord {
+	records := make([]streamRecord, 0, len(b.keys))
+	for _, key := range b.keys {
+		records = append(records, b.latest[key])
+	}
+	return records
+}
+
+// requests returns a write request for the last record of each key
+func (b *coalescedBatch) requests() []*dynamodb.WriteRequest {
+	requests := make([]*dynamodb.WriteRequest, 0, len(b.keys))
+	for _, record := range b.latestRecords() {
+		if *record.EventName == "REMOVE" {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: record.Dynamodb.Keys},
+			})
+		} else {
+			requests = append(requests, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{Item: record.Dynamodb.NewImage},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,66 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import "testing"
+
+func TestCoalescedBatchKeepsLastRecordPerKey(t *testing.T) {
+	batch := newCoalescedBatch()
+	batch.add(testRecord("INSERT", "a", "1"))
+	batch.add(testRecord("INSERT", "b", "1"))
+	batch.add(testRecord("MODIFY", "a", "2"))
+	batch.add(testRecord("REMOVE", "b", ""))
+
+	if batch.recordCount() != 4 {
+		t.Errorf("Expected 4 records, got %d", batch.recordCount())
+	}
+	if batch.keyCount() != 2 {
+		t.Errorf("Expected 2 keys, got %d", batch.keyCount())
+	}
+
+	requests := batch.requests()
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+
+	if requests[0].PutRequest == nil || *requests[0].PutRequest.Item["value"].S != "2" {
+		t.Errorf("Expected the last put for key a, got %v", requests[0])
+	}
+	if requests[1].DeleteRequest == nil {
+		t.Errorf("Expected a delete for key b, got %v", requests[1])
+	}
+}
+
+func TestCoalescedBatchLatestRecordsKeepsKeyOrder(t *testing.T) {
+	batch := newCoalescedBatch()
+	batch.add(testRecord("INSERT", "a", "1"))
+	batch.add(testRecord("INSERT", "b", "1"))
+	batch.add(testRecord("MODIFY", "a", "2"))
+
+	records := batch.latestRecords()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if *records[0].Dynamodb.Keys["id"].S != "a" || *records[0].Dynamodb.NewImage["value"].S != "2" {
+		t.Errorf("Expected the last record for key a first, got %v", records[0])
+	}
+	if *records[1].Dynamodb.Keys["id"].S != "b" {
+		t.Errorf("Expected key b second, got %v", records[1])
+	}
+}
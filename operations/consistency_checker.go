@@ -0,0 +1,270 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// How long past the replication latency to wait before comparing a sample, and
+// before comparing a differing item again
+var consistencyCheckMargin = time.Second
+
+// consistencyChecker compares a random sample of the items a stream has
+// recently written between the source and destination tables.  Writers offer
+// each key they write, and a sample of them is kept until the next check.
+// A nil checker does nothing.
+type consistencyChecker struct {
+	OperationPlan config.OperationPlan
+
+	context context.Context
+	latency *LatencyLock
+
+	source      *itemFetcher
+	destination *itemFetcher
+
+	mu      sync.Mutex
+	random  *rand.Rand
+	sample  []map[string]*dynamodb.AttributeValue
+	offered int
+
+	checkedCount    int64
+	mismatchedCount int64
+}
+
+func newConsistencyChecker(ctx context.Context, plan config.OperationPlan, latency *LatencyLock, source, destination *dynamodb.DynamoDB) *consistencyChecker {
+	// The source reads share the input table's plan-wide limit
+	sourceLimit := readLimit(plan, 0)
+
+	return &consistencyChecker{
+		OperationPlan: plan,
+
+		context: ctx,
+		latency: latency,
+
+		source: &itemFetcher{
+			context:   ctx,
+			client:    source,
+			tableName: plan.Input.TableName,
+			limit:     sourceLimit,
+			onRead: func(capacities []*dynamodb.ConsumedCapacity) {
+				sourceLimit.Take(capacities...)
+			},
+		},
+		destination: &itemFetcher{context: ctx, client: destination, tableName: plan.Output.TableName},
+
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Written offers a written key to the sample, every key written since the last
+// check is equally likely to be kept
+func (c *consistencyChecker) Written(keys map[string]*dynamodb.AttributeValue) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offered++
+	if len(c.sample) < c.OperationPlan.Stream.ConsistencyCheckSamples {
+		c.sample = append(c.sample, keys)
+	} else if i := c.random.Intn(c.offered); i < len(c.sample) {
+		c.sample[i] = keys
+	}
+}
+
+// Run checks a sample every check interval until done is closed
+func (c *consistencyChecker) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(c.OperationPlan.Stream.ConsistencyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		sample := c.takeSample()
+		if len(sample) == 0 {
+			continue
+		}
+
+		// Give the stream time to write any change made to the sampled items
+		// before they were sampled
+		if !c.settle(done) {
+			return
+		}
+
+		if !c.checkSample(sample, done) {
+			return
+		}
+	}
+}
+
+// settle waits out the replication latency, returning false if done is closed first
+func (c *consistencyChecker) settle(done <-chan struct{}) bool {
+	var latency time.Duration
+	if c.latency != nil {
+		latency, _ = c.latency.Latency()
+	}
+
+	select {
+	case <-time.After(latency + consistencyCheckMargin):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (c *consistencyChecker) takeSample() []map[string]*dynamodb.AttributeValue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A key written more than once can be sampled more than once
+	seen := make(map[string]bool, len(c.sample))
+	var sample []map[string]*dynamodb.AttributeValue
+	for _, keys := range c.sample {
+		if key := ItemKey(keys); !seen[key] {
+			seen[key] = true
+			sample = append(sample, keys)
+		}
+	}
+
+	c.sample = nil
+	c.offered = 0
+	return sample
+}
+
+// checkSample compares each sampled item between the tables, returning false
+// once the stream has stopped.  The sampled items were just written, so one
+// that differs may only have changed between the reads, or have a change the
+// stream hasn't written yet; it's compared again once the stream has caught up
+// and only counted if it still differs.
+func (c *consistencyChecker) checkSample(sample []map[string]*dynamodb.AttributeValue, done <-chan struct{}) bool {
+	var differing []map[string]*dynamodb.AttributeValue
+	for _, keys := range sample {
+		equal, err := c.compare(keys)
+		if err != nil {
+			if !c.readFailed(keys, err) {
+				return false
+			}
+			continue
+		}
+		if equal {
+			atomic.AddInt64(&c.checkedCount, 1)
+		} else {
+			differing = append(differing, keys)
+		}
+	}
+	if len(differing) == 0 {
+		return true
+	}
+
+	if !c.settle(done) {
+		return false
+	}
+	for _, keys := range differing {
+		equal, err := c.compare(keys)
+		if err != nil {
+			if !c.readFailed(keys, err) {
+				return false
+			}
+			continue
+		}
+		atomic.AddInt64(&c.checkedCount, 1)
+		if !equal {
+			atomic.AddInt64(&c.mismatchedCount, 1)
+			log.Printf("[WARNING] %s: Consistency check: item %s differs between the tables", c.OperationPlan.Description(), describeKey(keys))
+		}
+	}
+	return true
+}
+
+// compare reads an item from both tables and reports whether they're equal
+func (c *consistencyChecker) compare(keys map[string]*dynamodb.AttributeValue) (bool, error) {
+	source, err := c.source.get(keys)
+	if err != nil {
+		return false, err
+	}
+	destination, err := c.destination.get(keys)
+	if err != nil {
+		return false, err
+	}
+	return utils.ItemsEqual(source, destination), nil
+}
+
+// readFailed logs a failed comparison, returning false once the stream has stopped
+func (c *consistencyChecker) readFailed(keys map[string]*dynamodb.AttributeValue, err error) bool {
+	if RequestCanceledCheck(err) == context.Canceled {
+		return false
+	}
+	// A failed check is only a missing sample, the stream carries on
+	log.Printf("[WARNING] %s: Consistency check: reading item %s failed: %v", c.OperationPlan.Description(), describeKey(keys), err)
+	return true
+}
+
+func describeKey(keys map[string]*dynamodb.AttributeValue) string {
+	description, err := json.Marshal(utils.Item(keys))
+	if err != nil {
+		return ItemKey(keys)
+	}
+	return string(description)
+}
+
+// counts returns the number of mismatched and checked items, and whether any have been checked
+func (c *consistencyChecker) counts() (int64, int64, bool) {
+	if c == nil {
+		return 0, 0, false
+	}
+
+	checked := atomic.LoadInt64(&c.checkedCount)
+	return atomic.LoadInt64(&c.mismatchedCount), checked, checked > 0
+}
+
+// Status returns the running mismatch rate, or "--" before any item is checked
+func (c *consistencyChecker) Status() string {
+	mismatched, checked, ok := c.counts()
+	if !ok {
+		return "--"
+	}
+	return fmt.Sprintf("%d of %d differ (%.1f%%)", mismatched, checked, 100*float64(mismatched)/float64(checked))
+}
+
+func (c *consistencyChecker) Checkpoint() string {
+	mismatched, checked, ok := c.counts()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("consistency: %d of %d sampled items differed (%.1f%%)", mismatched, checked, 100*float64(mismatched)/float64(checked))
+}
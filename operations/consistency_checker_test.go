@@ -0,0 +1,118 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// changingTable returns each item's versions in turn, one per read, repeating
+// the last
+type changingTable struct {
+	dynamodbiface.DynamoDBAPI
+
+	versions map[string][]string
+	reads    map[string]int
+}
+
+func (f *changingTable) GetItemWithContext(_ aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	id := aws.StringValue(input.Key["id"].N)
+	versions := f.versions[id]
+	read := f.reads[id]
+	if read >= len(versions) {
+		read = len(versions) - 1
+	}
+	f.reads[id]++
+
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"id":      input.Key["id"],
+		"version": {S: aws.String(versions[read])},
+	}}, nil
+}
+
+func TestConsistencyCheckerSample(t *testing.T) {
+	var plan config.OperationPlan
+	plan.Stream.ConsistencyCheckSamples = 5
+	checker := &consistencyChecker{OperationPlan: plan, random: rand.New(rand.NewSource(1))}
+
+	for i := 0; i < 100; i++ {
+		checker.Written(map[string]*dynamodb.AttributeValue{"id": {N: aws.String(strconv.Itoa(i))}})
+	}
+	if sample := checker.takeSample(); len(sample) != 5 {
+		t.Errorf("Expected a sample of 5 keys, got %d", len(sample))
+	}
+	if sample := checker.takeSample(); len(sample) != 0 {
+		t.Errorf("Expected the sample to be cleared once taken, got %d keys", len(sample))
+	}
+
+	for i := 0; i < 3; i++ {
+		checker.Written(map[string]*dynamodb.AttributeValue{"id": {N: aws.String("1")}})
+	}
+	if sample := checker.takeSample(); len(sample) != 1 {
+		t.Errorf("Expected a key written repeatedly to be sampled once, got %d keys", len(sample))
+	}
+}
+
+func TestNilConsistencyChecker(t *testing.T) {
+	var checker *consistencyChecker
+	checker.Written(map[string]*dynamodb.AttributeValue{"id": {N: aws.String("1")}})
+	if checkpoint := checker.Checkpoint(); checkpoint != "" {
+		t.Errorf("Expected no checkpoint, got %q", checkpoint)
+	}
+}
+
+func TestConsistencyCheckerRechecksDifferingItems(t *testing.T) {
+	defer func(margin time.Duration) { consistencyCheckMargin = margin }(consistencyCheckMargin)
+	consistencyCheckMargin = time.Millisecond
+
+	source := &changingTable{versions: map[string][]string{"1": {"b"}, "2": {"b"}, "3": {"a"}}, reads: make(map[string]int)}
+	// Item 1 is written by the stream between the checks, item 2 never is
+	destination := &changingTable{versions: map[string][]string{"1": {"a", "b"}, "2": {"a"}, "3": {"a"}}, reads: make(map[string]int)}
+	checker := &consistencyChecker{
+		source:      &itemFetcher{context: context.Background(), client: source, tableName: "source"},
+		destination: &itemFetcher{context: context.Background(), client: destination, tableName: "dest"},
+	}
+
+	var sample []map[string]*dynamodb.AttributeValue
+	for _, id := range []string{"1", "2", "3"} {
+		sample = append(sample, map[string]*dynamodb.AttributeValue{"id": {N: aws.String(id)}})
+	}
+	if !checker.checkSample(sample, make(chan struct{})) {
+		t.Fatalf("Expected the check to complete")
+	}
+
+	mismatched, checked, _ := checker.counts()
+	if mismatched != 1 || checked != 3 {
+		t.Errorf("Expected only the item still differing once rechecked to count, got %d of %d", mismatched, checked)
+	}
+	if destination.reads["3"] != 1 {
+		t.Errorf("Expected a matching item to be read once, got %d reads", destination.reads["3"])
+	}
+}
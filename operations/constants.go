@@ -18,10 +18,18 @@
 
 package operations
 
+import "time"
+
 const (
 	erroredMsg  = "-ERRORED-"
 	completeMsg = "-COMPLETE-"
 	pendingMsg  = "-PENDING-"
 )
 
+// How long DynamoDB Streams retains records
+const streamRetention = 24 * time.Hour
+
 const recordChanBuffer = 4000
+
+// Each stream writer has a small buffer of its own, behind the shared record buffer
+const laneChanBuffer = 100
@@ -100,6 +100,11 @@ func (o *DescribeOperation) describe() {
 	atomic.StoreInt64(&o.approximateTableSizeBytes, *output.Table.TableSizeBytes)
 }
 
+// ItemCount returns the item count DynamoDB last reported for the table, it is updated about every six hours
+func (o *DescribeOperation) ItemCount() int64 {
+	return atomic.LoadInt64(&o.approximateItemCount)
+}
+
 func (o *DescribeOperation) ApproximateItemCount() string {
 	return log.Approximate(int(atomic.LoadInt64(&o.approximateItemCount)))
 }
@@ -26,6 +26,13 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
+// isolatedError fails the function that returns it without canceling the
+// others registered with the collator.  The dispatcher collates every plan,
+// and a plan that aborts on its own mustn't stop the others mid-sync.
+type isolatedError struct {
+	error
+}
+
 type ErrorCollator struct {
 	Funcs  []func() error
 	Cancel func()
@@ -58,7 +65,7 @@ func (c *ErrorCollator) Run() error {
 				finalError = context.Canceled
 			}
 		default:
-			if c.Cancel != nil {
+			if _, isolated := err.(isolatedError); !isolated && c.Cancel != nil {
 				c.Cancel()
 			}
 
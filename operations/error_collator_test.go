@@ -0,0 +1,49 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorCollatorIsolatedError(t *testing.T) {
+	var canceled bool
+	collator := ErrorCollator{
+		Cancel: func() { canceled = true },
+	}
+	collator.Register(func() error { return isolatedError{errors.New("plan aborted")} })
+	collator.Register(func() error { return nil })
+
+	if err := collator.Run(); err != ErrOperationFailed {
+		t.Errorf("Expected the isolated error to fail the run, got %v", err)
+	}
+	if canceled {
+		t.Errorf("Expected an isolated error to leave the other functions running")
+	}
+
+	collator = ErrorCollator{
+		Cancel: func() { canceled = true },
+	}
+	collator.Register(func() error { return errors.New("write failed") })
+	collator.Run()
+	if !canceled {
+		t.Errorf("Expected an error to cancel the other functions")
+	}
+}
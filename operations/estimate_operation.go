@@ -0,0 +1,261 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/tears-of-noobs/bytefmt"
+)
+
+// The sample is read from at most this many segments, so a filter few items
+// match can't scan much of the table
+const maxSampleSegments = 32
+
+// EstimateOperation projects the capacity, duration, and cost of a full
+// backfill from the tables' descriptions and a sample of the input table's
+// items, without writing anything.  The sample is read from a random scan
+// segment, so it costs a few RCUs.  A partial backfill's estimate samples the
+// items matching its filter, projected.
+type EstimateOperation struct {
+	OperationPlan     config.OperationPlan
+	context           context.Context
+	contextCancelFunc context.CancelFunc
+
+	inputClient *dynamodb.DynamoDB
+
+	// the table descriptions, set by the preflights.  The output is the
+	// input's when the output table doesn't exist yet.
+	input  *dynamodb.TableDescription
+	output *dynamodb.TableDescription
+
+	estimating Phase
+
+	mResult sync.Mutex
+	result  string
+}
+
+func NewEstimateOperation(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*EstimateOperation, error) {
+	inputSession, _, err := plan.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EstimateOperation{
+		OperationPlan:     plan,
+		context:           ctx,
+		contextCancelFunc: cancelFunc,
+
+		inputClient: dynamodb.New(inputSession),
+	}, nil
+}
+
+func (o *EstimateOperation) Preflights(in *dynamodb.DescribeTableOutput, out *dynamodb.DescribeTableOutput) error {
+	o.input = in.Table
+	o.output = out.Table
+	return nil
+}
+
+func (o *EstimateOperation) Run() error {
+	o.estimating.Start()
+
+	sample, scanned, readUnits, err := o.sample()
+	if err != nil {
+		return o.failed(err)
+	}
+
+	estimate := newBackfillEstimate(aws.Int64Value(o.input.ItemCount), sample, o.output)
+	if o.OperationPlan.Backfill.Partial() {
+		estimate = estimate.filtered(scanned, readUnits)
+	}
+	reads := readCost(o.OperationPlan, o.input, estimate.ReadUnits())
+	writes := writeCost(o.OperationPlan, o.output, estimate)
+
+	readDuration, readKnown := reads.Duration()
+	writeDuration, writeKnown := writes.Duration()
+	duration, durationKnown := readDuration, readKnown && writeKnown
+	if writeDuration > duration {
+		duration = writeDuration
+	}
+
+	prices := o.OperationPlan.Estimate.Prices
+	readPrice, readPriceKnown := reads.Cost(prices.ReadRequestUnit, prices.ReadCapacityHour, duration, durationKnown)
+	writePrice, writePriceKnown := writes.Cost(prices.WriteRequestUnit, prices.WriteCapacityHour, duration, durationKnown)
+
+	description := o.OperationPlan.Description()
+	if estimate.ItemCount == 0 {
+		log.Printf("[WARNING] %s: Estimate: the input table reports no items, DynamoDB updates its item count about every six hours", description)
+	}
+	if sampleSize := o.OperationPlan.Estimate.SampleSize; estimate.Sampled < sampleSize && scanned < estimate.ScannedCount {
+		log.Printf("[WARNING] %s: Estimate: sampled only %d of %d items after scanning %d, the estimate is less reliable", description, estimate.Sampled, sampleSize, scanned)
+	}
+	log.Printf("%s: Estimate: %s items, %s on average (sampled %d), %.1fx write amplification from indexes", description,
+		log.Approximate(int(estimate.ItemCount)), bytefmt.FormatBytes(estimate.AverageItemSize, 1, true), estimate.Sampled, estimate.WriteAmplification())
+	log.Printf("%s: Estimate: scanning consumes %s RCUs %s", description, log.Approximate(int(reads.Units)), formatCapacityRate(reads, "RCUs", readDuration, readKnown))
+	log.Printf("%s: Estimate: writing consumes %s WCUs %s", description, log.Approximate(int(writes.Units)), formatCapacityRate(writes, "WCUs", writeDuration, writeKnown))
+
+	total, price := formatEstimatedDuration(duration, durationKnown), formatEstimatedPrice(readPrice+writePrice, readPriceKnown && writePriceKnown)
+	log.Printf("%s: Estimate: a full backfill takes %s and costs %s", description, total, price)
+
+	o.finish(fmt.Sprintf("%s RCUs, %s WCUs, %s, %s", log.Approximate(int(reads.Units)), log.Approximate(int(writes.Units)), total, price))
+	return nil
+}
+
+// sample reads up to the sample size of items from a random scan segment,
+// continuing into the following segments when it comes up short.  Items are
+// filtered and projected as the backfill writes them.  It returns the items
+// scanned to find the sample, and the RCUs scanning them consumed.
+func (o *EstimateOperation) sample() ([]map[string]*dynamodb.AttributeValue, int64, float64, error) {
+	sampleSize := o.OperationPlan.Estimate.SampleSize
+	backfill := o.OperationPlan.Backfill
+
+	totalSegments := aws.Int64Value(o.input.ItemCount) / int64(sampleSize)
+	if totalSegments > maxSampleSegments {
+		totalSegments = maxSampleSegments
+	}
+	if totalSegments < 1 {
+		totalSegments = 1
+	}
+
+	var sample []map[string]*dynamodb.AttributeValue
+	var scanned int64
+	var readUnits float64
+	start := rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(totalSegments)
+	for i := int64(0); i < totalSegments && len(sample) < sampleSize; i++ {
+		input := &dynamodb.ScanInput{
+			TableName:              o.input.TableName,
+			Limit:                  aws.Int64(int64(sampleSize - len(sample))),
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		}
+		if backfill.FilterExpression != "" {
+			input.FilterExpression = aws.String(backfill.FilterExpression)
+		}
+		if backfill.ProjectionExpression != "" {
+			input.ProjectionExpression = aws.String(backfill.ProjectionExpression)
+		}
+		if len(backfill.ExpressionAttributeNames) > 0 {
+			input.ExpressionAttributeNames = aws.StringMap(backfill.ExpressionAttributeNames)
+		}
+		if len(backfill.ExpressionAttributeValues) > 0 {
+			input.ExpressionAttributeValues = backfill.ExpressionAttributeValues
+		}
+		if totalSegments > 1 {
+			input.Segment = aws.Int64((start + i) % totalSegments)
+			input.TotalSegments = aws.Int64(totalSegments)
+		}
+
+		err := o.inputClient.ScanPagesWithContext(o.context, input, func(page *dynamodb.ScanOutput, _ bool) bool {
+			sample = append(sample, page.Items...)
+			scanned += aws.Int64Value(page.ScannedCount)
+			if page.ConsumedCapacity != nil {
+				readUnits += aws.Float64Value(page.ConsumedCapacity.CapacityUnits)
+			}
+			return len(sample) < sampleSize
+		})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	return sample, scanned, readUnits, nil
+}
+
+func formatCapacityRate(cost capacityCost, units string, duration time.Duration, known bool) string {
+	switch {
+	case known:
+		return fmt.Sprintf("at %.f %s/s over %s", cost.Rate, units, formatEstimatedDuration(duration, known))
+	case cost.OnDemand:
+		return "on demand, at an unknown rate"
+	}
+	return "at an unknown rate"
+}
+
+func formatEstimatedDuration(duration time.Duration, known bool) string {
+	if !known {
+		return "?"
+	}
+	if duration < time.Second {
+		return "<1s"
+	}
+	return "~" + utils.FormatDuration(duration)
+}
+
+func formatEstimatedPrice(price float64, known bool) string {
+	if !known {
+		return "$?"
+	}
+	return fmt.Sprintf("~$%.2f", price)
+}
+
+func (o *EstimateOperation) finish(result string) {
+	o.mResult.Lock()
+	o.result = result
+	o.mResult.Unlock()
+
+	o.estimating.Finish()
+}
+
+func (o *EstimateOperation) failed(err error) error {
+	err = RequestCanceledCheck(err)
+	if err == context.Canceled {
+		return err
+	}
+	o.estimating.Error()
+	return fmt.Errorf("%s: Estimate failed: %v", o.OperationPlan.Description(), err)
+}
+
+func (o *EstimateOperation) Status() string {
+	if o.estimating.Errored() {
+		return erroredMsg
+	}
+	if o.estimating.Complete() {
+		o.mResult.Lock()
+		defer o.mResult.Unlock()
+
+		return o.result
+	}
+	if o.estimating.Running() {
+		return "sampling items"
+	}
+	return pendingMsg
+}
+
+func (o *EstimateOperation) Rate() string {
+	return ""
+}
+
+func (o *EstimateOperation) Checkpoint() string {
+	if o.estimating.Running() {
+		return fmt.Sprintf("%s: Estimate in progress: %s", o.OperationPlan.Description(), o.Status())
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// testKeySchema keys the test tables on "id"
+var testKeySchema = []*dynamodb.KeySchemaElement{
+	{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+}
+
+// testKey returns the key of a test item
+func testKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}}
+}
+
+// testItem returns a test item with a value, and a set of tags when any are given
+func testItem(id, value string, tags ...string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String(id)},
+		"value": {S: aws.String(value)},
+	}
+	if len(tags) > 0 {
+		item["tags"] = &dynamodb.AttributeValue{SS: aws.StringSlice(tags)}
+	}
+	return item
+}
+
+// testRecord returns a stream record of a change to a test item, carrying its
+// new image unless the value is empty
+func testRecord(eventName, id, value string) streamRecord {
+	record := streamRecord{
+		Record: dynamodbstreams.Record{
+			EventName: aws.String(eventName),
+			Dynamodb: &dynamodbstreams.StreamRecord{
+				ApproximateCreationDateTime: aws.Time(time.Now()),
+				Keys:                        testKey(id),
+			},
+		},
+		progress: (&ProgressQueue{}).Add(1, nil),
+	}
+	if value != "" {
+		record.Dynamodb.NewImage = testItem(id, value)
+	}
+	return record
+}
+
+// testTable returns a test table, with a global index on "email" under each name given
+func testTable(indexes ...string) *dynamodb.TableDescription {
+	table := &dynamodb.TableDescription{
+		TableName: aws.String("dest"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("email"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: testKeySchema,
+	}
+	for _, index := range indexes {
+		table.GlobalSecondaryIndexes = append(table.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:  aws.String(index),
+			KeySchema:  []*dynamodb.KeySchemaElement{{AttributeName: aws.String("email"), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+		})
+	}
+	return table
+}
+
+// testThroughput returns a table's or index's provisioned capacity
+func testThroughput(read, write int64) *dynamodb.ProvisionedThroughputDescription {
+	return &dynamodb.ProvisionedThroughputDescription{
+		ReadCapacityUnits:  aws.Int64(read),
+		WriteCapacityUnits: aws.Int64(write),
+	}
+}
+
+// provisioned sets the capacity of a test table, and of its global indexes in order
+func provisioned(table *dynamodb.TableDescription, throughput *dynamodb.ProvisionedThroughputDescription, indexes ...*dynamodb.ProvisionedThroughputDescription) *dynamodb.TableDescription {
+	table.ProvisionedThroughput = throughput
+	for i, index := range indexes {
+		table.GlobalSecondaryIndexes[i].ProvisionedThroughput = index
+	}
+	return table
+}
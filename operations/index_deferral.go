@@ -0,0 +1,400 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/state"
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// How often the output table is described while its indexes change
+var indexPollInterval = 20 * time.Second
+
+// indexDeferral takes the input table's global secondary indexes off the
+// output table while it's backfilled, so each write isn't multiplied by every
+// index, and creates them again once the backfill completes.  Indexes only on
+// the output table are left alone.  The removed indexes are recorded in the
+// state file, so a later run, or cleanup, creates them again even when it
+// doesn't defer indexes itself.
+type indexDeferral struct {
+	OperationPlan config.OperationPlan
+
+	context context.Context
+	client  dynamodbiface.DynamoDBAPI
+	state   *state.Store
+
+	// whether this run defers the indexes, rather than only creating the ones
+	// an earlier run removed
+	deferring bool
+
+	// the table descriptions, set by the preflights
+	input  *dynamodb.TableDescription
+	output *dynamodb.TableDescription
+
+	// the output table as it was last described, once its capacity may have changed
+	current *dynamodb.TableDescription
+
+	mu       sync.Mutex
+	progress map[string]string
+	changing map[string]time.Time
+}
+
+func newIndexDeferral(ctx context.Context, plan config.OperationPlan, store *state.Store) (*indexDeferral, error) {
+	_, outputSession, err := plan.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &indexDeferral{
+		OperationPlan: plan,
+
+		context:   ctx,
+		client:    dynamodb.New(outputSession),
+		state:     store,
+		deferring: !plan.Backfill.Disabled && plan.Backfill.DeferIndexes,
+
+		progress: make(map[string]string),
+		changing: make(map[string]time.Time),
+	}, nil
+}
+
+func (d *indexDeferral) Preflights(in *dynamodb.DescribeTableOutput, out *dynamodb.DescribeTableOutput) {
+	d.input = in.Table
+	d.output = out.Table
+}
+
+// Remove deletes the input table's indexes from the output table, one at a
+// time since DynamoDB only changes one index per update
+func (d *indexDeferral) Remove() error {
+	for _, index := range d.input.GlobalSecondaryIndexes {
+		name := aws.StringValue(index.IndexName)
+
+		current, err := d.waitForTable(name)
+		if err != nil {
+			return d.failed("removing", name, err)
+		}
+
+		// Recorded before removing it, or when the output table was created
+		// without it, so it's created again even if this run is interrupted
+		d.state.AddDeferredIndex(name)
+		err = d.state.Save()
+		if err != nil {
+			return err
+		}
+
+		if current == nil {
+			d.setProgress(name, "removed", false)
+			continue
+		}
+
+		log.Printf("%s: Removing index %q from the output table until the backfill completes…", d.OperationPlan.Description(), name)
+		d.setProgress(name, "removing", true)
+		_, err = d.client.UpdateTableWithContext(d.context, &dynamodb.UpdateTableInput{
+			TableName: d.output.TableName,
+			GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{{
+				Delete: &dynamodb.DeleteGlobalSecondaryIndexAction{IndexName: index.IndexName},
+			}},
+		})
+		if err != nil {
+			return d.failed("removing", name, err)
+		}
+
+		err = d.waitFor(name, func(index *dynamodb.GlobalSecondaryIndexDescription) bool { return index == nil })
+		if err != nil {
+			return d.failed("removing", name, err)
+		}
+		d.setProgress(name, "removed", false)
+	}
+	return nil
+}
+
+// Pending reports whether an earlier run removed indexes it didn't create again
+func (d *indexDeferral) Pending() bool {
+	return len(d.state.DeferredIndexes()) > 0
+}
+
+// Restore creates the input table's indexes on the output table and waits
+// for each to finish backfilling.  Unless this run defers the indexes, only
+// the ones recorded as removed are created.
+func (d *indexDeferral) Restore() error {
+	for _, index := range d.restoring() {
+		name := aws.StringValue(index.IndexName)
+
+		// The table may still be updating, after its capacity is restored say
+		current, err := d.waitForTable(name)
+		if err != nil {
+			return d.failed("creating", name, err)
+		}
+		if current == nil {
+			log.Printf("%s: Creating index %q on the output table…", d.OperationPlan.Description(), name)
+			d.setProgress(name, "creating", true)
+			_, err = d.client.UpdateTableWithContext(d.context, d.createIndexInput(index))
+			if err != nil {
+				return d.failed("creating", name, err)
+			}
+		} else {
+			d.setProgress(name, "creating", true)
+		}
+
+		err = d.waitFor(name, func(index *dynamodb.GlobalSecondaryIndexDescription) bool {
+			return index != nil && aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive
+		})
+		if err != nil {
+			return d.failed("creating", name, err)
+		}
+		d.state.ClearDeferredIndex(name)
+		log.Printf("%s: Index %q is active", d.OperationPlan.Description(), name)
+		d.setProgress(name, "active", false)
+	}
+	return nil
+}
+
+// restoring returns the input table indexes to create on the output table
+func (d *indexDeferral) restoring() []*dynamodb.GlobalSecondaryIndexDescription {
+	if d.deferring {
+		return d.input.GlobalSecondaryIndexes
+	}
+
+	var indexes []*dynamodb.GlobalSecondaryIndexDescription
+	for _, name := range d.state.DeferredIndexes() {
+		index := globalIndex(d.input, name)
+		if index == nil {
+			log.Printf("[WARNING] %s: Index %q removed from the output table is no longer on the input table, it isn't created again", d.OperationPlan.Description(), name)
+			d.state.ClearDeferredIndex(name)
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+// globalIndex returns a table's global secondary index, or nil if it has none by that name
+func globalIndex(table *dynamodb.TableDescription, name string) *dynamodb.GlobalSecondaryIndexDescription {
+	for _, index := range table.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == name {
+			return index
+		}
+	}
+	return nil
+}
+
+func (d *indexDeferral) createIndexInput(index *dynamodb.GlobalSecondaryIndexDescription) *dynamodb.UpdateTableInput {
+	action := &dynamodb.CreateGlobalSecondaryIndexAction{
+		IndexName:  index.IndexName,
+		KeySchema:  index.KeySchema,
+		Projection: index.Projection,
+	}
+	if billingMode(d.outputTable()) != dynamodb.BillingModePayPerRequest {
+		action.ProvisionedThroughput = d.indexThroughput(index)
+	}
+
+	return &dynamodb.UpdateTableInput{
+		TableName:                   d.output.TableName,
+		AttributeDefinitions:        keyAttributeDefinitions(d.input.AttributeDefinitions, index.KeySchema),
+		GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{{Create: action}},
+	}
+}
+
+// indexThroughput returns the capacity to create an index with on a
+// provisioned output table.  An on demand input table's indexes report no
+// capacity, so they're given the index's own capacity from before it was
+// removed, or else the output table's.
+func (d *indexDeferral) indexThroughput(index *dynamodb.GlobalSecondaryIndexDescription) *dynamodb.ProvisionedThroughput {
+	if hasThroughput(index.ProvisionedThroughput) {
+		return provisionedThroughput(index.ProvisionedThroughput)
+	}
+
+	name := aws.StringValue(index.IndexName)
+	if removed := globalIndex(d.output, name); removed != nil && hasThroughput(removed.ProvisionedThroughput) {
+		return provisionedThroughput(removed.ProvisionedThroughput)
+	}
+	if saved := d.state.SavedCapacity(); saved != nil {
+		if savedIndex, ok := saved.Indexes[name]; ok && savedIndex.ReadCapacity > 0 && savedIndex.WriteCapacity > 0 {
+			return provisionedUnits(savedIndex.ReadCapacity, savedIndex.WriteCapacity)
+		}
+		if saved.ReadCapacity > 0 && saved.WriteCapacity > 0 {
+			return provisionedUnits(saved.ReadCapacity, saved.WriteCapacity)
+		}
+	}
+	return provisionedThroughput(d.outputTable().ProvisionedThroughput)
+}
+
+func hasThroughput(description *dynamodb.ProvisionedThroughputDescription) bool {
+	read, write := throughputUnits(description)
+	return read > 0 && write > 0
+}
+
+func provisionedUnits(read, write int64) *dynamodb.ProvisionedThroughput {
+	return &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(read), WriteCapacityUnits: aws.Int64(write)}
+}
+
+// outputTable returns the output table as it was last described
+func (d *indexDeferral) outputTable() *dynamodb.TableDescription {
+	if d.current != nil {
+		return d.current
+	}
+	return d.output
+}
+
+// waitForTable waits for the output table to be ready for another update and
+// returns an index, or nil if it doesn't exist
+func (d *indexDeferral) waitForTable(name string) (*dynamodb.GlobalSecondaryIndexDescription, error) {
+	var current *dynamodb.GlobalSecondaryIndexDescription
+	err := d.waitFor(name, func(index *dynamodb.GlobalSecondaryIndexDescription) bool {
+		current = index
+		return true
+	})
+	return current, err
+}
+
+// describeIndex returns an output table index, or nil if it doesn't exist, and whether the table is active
+func (d *indexDeferral) describeIndex(name string) (*dynamodb.GlobalSecondaryIndexDescription, bool, error) {
+	output, err := d.client.DescribeTableWithContext(d.context, &dynamodb.DescribeTableInput{TableName: d.output.TableName})
+	if err != nil {
+		return nil, false, err
+	}
+
+	d.current = output.Table
+	active := aws.StringValue(output.Table.TableStatus) == dynamodb.TableStatusActive
+	return globalIndex(output.Table, name), active, nil
+}
+
+// waitFor describes the output table until an index, nil once it's gone, is
+// done changing and the table is ready for another update
+func (d *indexDeferral) waitFor(name string, done func(*dynamodb.GlobalSecondaryIndexDescription) bool) error {
+	for {
+		index, active, err := d.describeIndex(name)
+		if err != nil {
+			return err
+		}
+		if active && done(index) {
+			return nil
+		}
+
+		select {
+		case <-time.After(indexPollInterval):
+		case <-d.context.Done():
+			return d.context.Err()
+		}
+	}
+}
+
+func (d *indexDeferral) failed(action, name string, err error) error {
+	err = RequestCanceledCheck(err)
+	if err == context.Canceled {
+		return err
+	}
+	return fmt.Errorf("%s: Failed %s index %q on the output table: %v", d.OperationPlan.Description(), action, name, err)
+}
+
+func (d *indexDeferral) setProgress(name, progress string, changing bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.progress[name] = progress
+	if changing {
+		d.changing[name] = time.Now()
+	} else {
+		delete(d.changing, name)
+	}
+}
+
+// Status lists each deferred index's progress, with how long it's been
+// changing, or "" before the indexes are touched
+func (d *indexDeferral) Status() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.progress) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(d.progress))
+	for name := range d.progress {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	indexes := make([]string, len(names))
+	for i, name := range names {
+		indexes[i] = fmt.Sprintf("%s %s", name, d.progress[name])
+		if started, ok := d.changing[name]; ok {
+			if elapsed := utils.FormatDuration(time.Since(started)); elapsed != "" {
+				indexes[i] += " " + elapsed
+			}
+		}
+	}
+	return fmt.Sprintf("(indexes: %s)", strings.Join(indexes, ", "))
+}
+
+func (d *indexDeferral) Checkpoint() string {
+	if status := d.Status(); status != "" {
+		return fmt.Sprintf("%s: Deferred indexes %s", d.OperationPlan.Description(), strings.Trim(status, "()"))
+	}
+	return ""
+}
+
+// withGlobalIndexes returns a copy of a table with only the global secondary
+// indexes named, dropping the attribute definitions only the others use
+func withGlobalIndexes(table *dynamodb.TableDescription, names map[string]bool) *dynamodb.TableDescription {
+	copied := *table
+	copied.GlobalSecondaryIndexes = nil
+
+	keySchema := append([]*dynamodb.KeySchemaElement(nil), table.KeySchema...)
+	for _, index := range table.LocalSecondaryIndexes {
+		keySchema = append(keySchema, index.KeySchema...)
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if names[aws.StringValue(index.IndexName)] {
+			copied.GlobalSecondaryIndexes = append(copied.GlobalSecondaryIndexes, index)
+			keySchema = append(keySchema, index.KeySchema...)
+		}
+	}
+	copied.AttributeDefinitions = keyAttributeDefinitions(table.AttributeDefinitions, keySchema)
+	return &copied
+}
+
+// keyAttributeDefinitions returns the definitions of the attributes in a key schema
+func keyAttributeDefinitions(definitions []*dynamodb.AttributeDefinition, keySchema []*dynamodb.KeySchemaElement) []*dynamodb.AttributeDefinition {
+	used := make(map[string]bool)
+	for _, element := range keySchema {
+		used[aws.StringValue(element.AttributeName)] = true
+	}
+
+	var keyDefinitions []*dynamodb.AttributeDefinition
+	for _, definition := range definitions {
+		if used[aws.StringValue(definition.AttributeName)] {
+			keyDefinitions = append(keyDefinitions, definition)
+		}
+	}
+	return keyDefinitions
+}
@@ -0,0 +1,310 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// updatingTable is an output table that, like DynamoDB, rejects updates while
+// it's updating.  It stays UPDATING for a few describes after each update, or
+// until it's waited for.
+type updatingTable struct {
+	dynamodbiface.DynamoDBAPI
+
+	table    *dynamodb.TableDescription
+	updating int
+}
+
+func (f *updatingTable) DescribeTableWithContext(aws.Context, *dynamodb.DescribeTableInput, ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	table := *f.table
+	table.TableStatus = aws.String(dynamodb.TableStatusActive)
+	if f.updating > 0 {
+		f.updating--
+		table.TableStatus = aws.String(dynamodb.TableStatusUpdating)
+	}
+	return &dynamodb.DescribeTableOutput{Table: &table}, nil
+}
+
+func (f *updatingTable) WaitUntilTableExistsWithContext(aws.Context, *dynamodb.DescribeTableInput, ...request.WaiterOption) error {
+	f.updating = 0
+	return nil
+}
+
+func (f *updatingTable) UpdateTableWithContext(_ aws.Context, input *dynamodb.UpdateTableInput, _ ...request.Option) (*dynamodb.UpdateTableOutput, error) {
+	if f.updating > 0 {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, "Table is being updated", nil)
+	}
+	if err := input.Validate(); err != nil {
+		return nil, awserr.New("ValidationException", err.Error(), nil)
+	}
+
+	if throughput := input.ProvisionedThroughput; throughput != nil {
+		f.table.ProvisionedThroughput = testThroughput(aws.Int64Value(throughput.ReadCapacityUnits), aws.Int64Value(throughput.WriteCapacityUnits))
+	}
+	for _, update := range input.GlobalSecondaryIndexUpdates {
+		if create := update.Create; create != nil {
+			index := &dynamodb.GlobalSecondaryIndexDescription{
+				IndexName:   create.IndexName,
+				IndexStatus: aws.String(dynamodb.IndexStatusActive),
+			}
+			if throughput := create.ProvisionedThroughput; throughput != nil {
+				index.ProvisionedThroughput = testThroughput(aws.Int64Value(throughput.ReadCapacityUnits), aws.Int64Value(throughput.WriteCapacityUnits))
+			}
+			f.table.GlobalSecondaryIndexes = append(f.table.GlobalSecondaryIndexes, index)
+		}
+	}
+	f.updating = 3
+	return &dynamodb.UpdateTableOutput{TableDescription: f.table}, nil
+}
+
+func TestWithGlobalIndexes(t *testing.T) {
+	table := testTable("by-email")
+
+	without := withGlobalIndexes(table, nil)
+	if len(without.GlobalSecondaryIndexes) != 0 || len(without.AttributeDefinitions) != 1 {
+		t.Errorf("Expected the index and its attribute definition to be dropped, got %v", without)
+	}
+	if len(table.GlobalSecondaryIndexes) != 1 {
+		t.Errorf("Expected the original table to be unchanged")
+	}
+
+	with := withGlobalIndexes(table, map[string]bool{"by-email": true})
+	if len(with.GlobalSecondaryIndexes) != 1 || len(with.AttributeDefinitions) != 2 {
+		t.Errorf("Expected the named index to be kept, got %v", with)
+	}
+
+	if err := createTableInput("destination", without).Validate(); err != nil {
+		t.Errorf("Expected a valid table without indexes, got %v", err)
+	}
+}
+
+func TestCreateIndexInput(t *testing.T) {
+	input := testTable("by-email")
+	input.GlobalSecondaryIndexes[0].ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(5)}
+	output := withGlobalIndexes(input, nil)
+	output.TableName = aws.String("destination")
+
+	deferral := &indexDeferral{input: input, output: output}
+	update := deferral.createIndexInput(input.GlobalSecondaryIndexes[0])
+	if err := update.Validate(); err != nil {
+		t.Fatalf("Expected a valid update, got %v", err)
+	}
+	if len(update.AttributeDefinitions) != 1 || *update.AttributeDefinitions[0].AttributeName != "email" {
+		t.Errorf("Expected only the index key's definition, got %v", update.AttributeDefinitions)
+	}
+	if update.GlobalSecondaryIndexUpdates[0].Create.ProvisionedThroughput == nil {
+		t.Errorf("Expected provisioned capacity for a provisioned table")
+	}
+
+	output.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	if update := deferral.createIndexInput(input.GlobalSecondaryIndexes[0]); update.GlobalSecondaryIndexUpdates[0].Create.ProvisionedThroughput != nil {
+		t.Errorf("Expected no provisioned capacity for an on demand table")
+	}
+}
+
+func TestCreateIndexInputFromOnDemandInput(t *testing.T) {
+	// An on demand table's indexes are described with no capacity
+	input := testTable("by-email")
+	input.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	input.GlobalSecondaryIndexes[0].ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(0), WriteCapacityUnits: aws.Int64(0)}
+	index := input.GlobalSecondaryIndexes[0]
+
+	output := provisioned(testTable("by-email"), testThroughput(10, 50), testThroughput(5, 25))
+	store, _ := state.Open("", config.OperationPlan{})
+	deferral := &indexDeferral{input: input, output: output, state: store}
+
+	cases := []struct {
+		name  string
+		setup func()
+		read  int64
+		write int64
+	}{
+		{"the index's own capacity before it was removed", func() {}, 5, 25},
+		{"the saved index capacity", func() {
+			deferral.output = provisioned(testTable(), testThroughput(10, 50))
+			store.SetSavedCapacity(&state.CapacityState{ReadCapacity: 8, WriteCapacity: 40, Indexes: map[string]state.IndexCapacity{"by-email": {ReadCapacity: 4, WriteCapacity: 20}}})
+		}, 4, 20},
+		{"the saved table capacity", func() {
+			store.SetSavedCapacity(&state.CapacityState{ReadCapacity: 8, WriteCapacity: 40})
+		}, 8, 40},
+		{"the output table's current capacity", func() {
+			store.ClearSavedCapacity()
+			deferral.current = provisioned(testTable(), testThroughput(12, 60))
+		}, 12, 60},
+	}
+	for _, c := range cases {
+		c.setup()
+		update := deferral.createIndexInput(index)
+		if err := update.Validate(); err != nil {
+			t.Fatalf("Expected a valid update with %s, got %v", c.name, err)
+		}
+		throughput := update.GlobalSecondaryIndexUpdates[0].Create.ProvisionedThroughput
+		if *throughput.ReadCapacityUnits != c.read || *throughput.WriteCapacityUnits != c.write {
+			t.Errorf("Expected %s, %d/%d, got %v", c.name, c.read, c.write, throughput)
+		}
+	}
+}
+
+func TestRestoreIndexesFromOnDemandInput(t *testing.T) {
+	defer func(interval time.Duration) { indexPollInterval = interval }(indexPollInterval)
+	indexPollInterval = time.Millisecond
+
+	plan := config.OperationPlan{Output: config.Output{TableName: "dest"}}
+	plan.Backfill.DeferIndexes = true
+	store, _ := state.Open("", plan)
+	store.AddDeferredIndex("by-email")
+
+	input := testTable("by-email")
+	input.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	input.GlobalSecondaryIndexes[0].ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(0), WriteCapacityUnits: aws.Int64(0)}
+
+	// Created without the index, so it has no capacity of its own to go back to
+	table := provisioned(testTable(), testThroughput(10, 50))
+	deferral := &indexDeferral{
+		OperationPlan: plan,
+		context:       context.Background(),
+		client:        &updatingTable{table: table},
+		state:         store,
+		deferring:     true,
+		input:         input,
+		output:        table,
+		progress:      make(map[string]string),
+		changing:      make(map[string]time.Time),
+	}
+	err := deferral.Restore()
+	if err != nil {
+		t.Fatalf("Expected the index to be created, got %v", err)
+	}
+	if len(table.GlobalSecondaryIndexes) != 1 {
+		t.Fatalf("Expected the index to be created, got %v", table.GlobalSecondaryIndexes)
+	}
+	if read, write := throughputUnits(table.GlobalSecondaryIndexes[0].ProvisionedThroughput); read != 10 || write != 50 {
+		t.Errorf("Expected the index to get the output table's capacity, got %d/%d", read, write)
+	}
+}
+
+func TestRestoringRecordedIndexes(t *testing.T) {
+	store, _ := state.Open("", config.OperationPlan{})
+	store.AddDeferredIndex("by-email")
+	store.AddDeferredIndex("dropped")
+
+	deferral := &indexDeferral{input: testTable("by-email", "by-name"), state: store}
+	indexes := deferral.restoring()
+	if len(indexes) != 1 || *indexes[0].IndexName != "by-email" {
+		t.Errorf("Expected only the recorded index still on the input table, got %v", indexes)
+	}
+	if deferred := store.DeferredIndexes(); len(deferred) != 1 || deferred[0] != "by-email" {
+		t.Errorf("Expected the index gone from the input table to be forgotten, got %v", deferred)
+	}
+
+	deferral.deferring = true
+	if indexes := deferral.restoring(); len(indexes) != 2 {
+		t.Errorf("Expected every input table index when deferring, got %v", indexes)
+	}
+}
+
+func TestRestoreCapacityThenIndexes(t *testing.T) {
+	defer func(interval time.Duration) { indexPollInterval = interval }(indexPollInterval)
+	indexPollInterval = time.Millisecond
+
+	plan := config.OperationPlan{Output: config.Output{TableName: "dest"}}
+	plan.Backfill.DeferIndexes = true
+	store, _ := state.Open("", plan)
+	store.SetSavedCapacity(&state.CapacityState{BillingMode: dynamodb.BillingModeProvisioned, ReadCapacity: 10, WriteCapacity: 50})
+	store.AddDeferredIndex("by-email")
+
+	table := provisioned(testTable(), testThroughput(10, 500))
+	client := &updatingTable{table: table}
+	scaler := &capacityScaler{OperationPlan: plan, client: client, state: store}
+
+	restored, err := scaler.Restore(context.Background())
+	if err != nil || !restored {
+		t.Fatalf("Expected the capacity to be restored, got %v, %v", restored, err)
+	}
+	if client.updating != 0 {
+		t.Errorf("Expected the restore to wait for the table to be active")
+	}
+
+	// Another update still in progress is waited out before each index is created
+	client.updating = 2
+	deferral := &indexDeferral{
+		OperationPlan: plan,
+		context:       context.Background(),
+		client:        client,
+		state:         store,
+		deferring:     true,
+		input:         testTable("by-email"),
+		output:        table,
+		progress:      make(map[string]string),
+		changing:      make(map[string]time.Time),
+	}
+	err = deferral.Restore()
+	if err != nil {
+		t.Fatalf("Expected the index to be created once the table is active, got %v", err)
+	}
+	if len(table.GlobalSecondaryIndexes) != 1 || len(store.DeferredIndexes()) != 0 {
+		t.Errorf("Expected the index to be created and forgotten, got %v and %v", table.GlobalSecondaryIndexes, store.DeferredIndexes())
+	}
+}
+
+func TestRemoveRecordsIndexesMissingFromTheOutputTable(t *testing.T) {
+	plan := config.OperationPlan{Output: config.Output{TableName: "dest"}}
+	plan.Backfill.DeferIndexes = true
+	store, _ := state.Open("", plan)
+
+	// Created without the input table's indexes by create_if_missing
+	table := withGlobalIndexes(testTable("by-email"), nil)
+	table.TableName = aws.String("dest")
+	deferral := &indexDeferral{
+		OperationPlan: plan,
+		context:       context.Background(),
+		client:        &updatingTable{table: table},
+		state:         store,
+		deferring:     true,
+		input:         testTable("by-email"),
+		output:        table,
+		progress:      make(map[string]string),
+		changing:      make(map[string]time.Time),
+	}
+	err := deferral.Remove()
+	if err != nil {
+		t.Fatalf("Unexpected error removing the indexes: %v", err)
+	}
+	if deferred := store.DeferredIndexes(); len(deferred) != 1 || deferred[0] != "by-email" {
+		t.Errorf("Expected the index missing from the output table to be recorded, got %v", deferred)
+	}
+
+	// An interrupted run is cleaned up from the record alone
+	deferral.deferring = false
+	if indexes := deferral.restoring(); len(indexes) != 1 || *indexes[0].IndexName != "by-email" {
+		t.Errorf("Expected the recorded index to be created again, got %v", indexes)
+	}
+}
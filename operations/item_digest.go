@@ -0,0 +1,172 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"bytes"
+	"hash"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ItemHash returns a stable hash of every attribute of an item.  Attribute
+// order and the order of set members don't change the hash.
+func ItemHash(item map[string]*dynamodb.AttributeValue) uint64 {
+	h := fnv.New64a()
+	hashMap(h, item)
+	return h.Sum64()
+}
+
+func hashMap(h hash.Hash64, attributes map[string]*dynamodb.AttributeValue) {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hashString(h, name)
+		hashAttributeValue(h, attributes[name])
+	}
+}
+
+func hashAttributeValue(h hash.Hash64, av *dynamodb.AttributeValue) {
+	switch {
+	case av == nil || av.NULL != nil:
+		h.Write([]byte("NULL"))
+	case av.S != nil:
+		h.Write([]byte("S"))
+		hashString(h, *av.S)
+	case av.N != nil:
+		h.Write([]byte("N"))
+		hashString(h, *av.N)
+	case av.B != nil:
+		h.Write([]byte("B"))
+		hashBytes(h, av.B)
+	case av.BOOL != nil:
+		h.Write([]byte("BOOL"))
+		hashString(h, strconv.FormatBool(*av.BOOL))
+	case av.SS != nil, av.NS != nil:
+		members := av.SS
+		h.Write([]byte("SS"))
+		if av.NS != nil {
+			members = av.NS
+			h.Write([]byte("NS"))
+		}
+
+		sorted := make([]string, len(members))
+		for i, member := range members {
+			sorted[i] = *member
+		}
+		sort.Strings(sorted)
+		for _, member := range sorted {
+			hashString(h, member)
+		}
+	case av.BS != nil:
+		h.Write([]byte("BS"))
+		sorted := append([][]byte(nil), av.BS...)
+		sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+		for _, member := range sorted {
+			hashBytes(h, member)
+		}
+	case av.L != nil:
+		h.Write([]byte("L"))
+		hashString(h, strconv.Itoa(len(av.L)))
+		for _, member := range av.L {
+			hashAttributeValue(h, member)
+		}
+	case av.M != nil:
+		h.Write([]byte("M"))
+		hashString(h, strconv.Itoa(len(av.M)))
+		hashMap(h, av.M)
+	}
+}
+
+// hashString writes a length prefixed string so adjacent values can't run together
+func hashString(h hash.Hash64, s string) {
+	hashBytes(h, []byte(s))
+}
+
+func hashBytes(h hash.Hash64, b []byte) {
+	h.Write([]byte(strconv.Itoa(len(b))))
+	h.Write([]byte{0})
+	h.Write(b)
+}
+
+// RangeDigest summarizes the items whose key hashes fall in one range.  Item
+// hashes are summed, so the digest doesn't depend on the order items are read.
+type RangeDigest struct {
+	Count uint64
+	Sum   uint64
+}
+
+// TableDigest is the digest of each range of key hashes in a table, ordered
+// by key hash
+type TableDigest []RangeDigest
+
+func NewTableDigest(ranges int) TableDigest {
+	return make(TableDigest, ranges)
+}
+
+// Range returns the range a key hash falls in
+func (d TableDigest) Range(keyHash uint32) int {
+	return keyHashRange(keyHash, len(d))
+}
+
+func keyHashRange(keyHash uint32, ranges int) int {
+	return int(uint64(keyHash) * uint64(ranges) >> 32)
+}
+
+// Add adds an item to the digest of its key's range, returning the range and the item's hash
+func (d TableDigest) Add(keys, item map[string]*dynamodb.AttributeValue) (int, uint64) {
+	r, hash := d.Range(ItemKeyHash(keys)), ItemHash(item)
+	d[r].Count++
+	d[r].Sum += hash
+	return r, hash
+}
+
+// Merge adds the digests of another table digest with the same number of ranges
+func (d TableDigest) Merge(other TableDigest) {
+	for i := range other {
+		d[i].Count += other[i].Count
+		d[i].Sum += other[i].Sum
+	}
+}
+
+// Mismatches returns the ranges whose digests differ
+func (d TableDigest) Mismatches(other TableDigest) []int {
+	var mismatches []int
+	for i := range d {
+		if d[i] != other[i] {
+			mismatches = append(mismatches, i)
+		}
+	}
+	return mismatches
+}
+
+// KeyHashBounds returns the first and last key hash in a range
+func (d TableDigest) KeyHashBounds(r int) (uint32, uint32) {
+	ranges := uint64(len(d))
+	first := (uint64(r)<<32 + ranges - 1) / ranges
+	last := (uint64(r+1)<<32+ranges-1)/ranges - 1
+	return uint32(first), uint32(last)
+}
@@ -0,0 +1,78 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import "testing"
+
+func TestItemHashIgnoresSetOrder(t *testing.T) {
+	a := testItem("1", "x", "a", "b")
+	b := testItem("1", "x", "b", "a")
+	if ItemHash(a) != ItemHash(b) {
+		t.Errorf("Expected set order not to change the hash")
+	}
+
+	c := testItem("1", "y", "a", "b")
+	if ItemHash(a) == ItemHash(c) {
+		t.Errorf("Expected different values to change the hash")
+	}
+}
+
+func TestTableDigestFindsMismatchedRanges(t *testing.T) {
+	source := NewTableDigest(16)
+	destination := NewTableDigest(16)
+
+	ids := []string{"a", "b", "c", "d", "e", "f"}
+	for _, id := range ids {
+		source.Add(testKey(id), testItem(id, "v"))
+	}
+
+	// The destination reads the same items in another order, with one changed
+	for i := len(ids) - 1; i >= 0; i-- {
+		value := "v"
+		if ids[i] == "c" {
+			value = "stale"
+		}
+		destination.Add(testKey(ids[i]), testItem(ids[i], value))
+	}
+
+	mismatches := source.Mismatches(destination)
+	expected := source.Range(ItemKeyHash(testKey("c")))
+	if len(mismatches) != 1 || mismatches[0] != expected {
+		t.Errorf("Expected only range %d to mismatch, got %v", expected, mismatches)
+	}
+}
+
+func TestTableDigestRangesCoverTheKeySpace(t *testing.T) {
+	digest := NewTableDigest(3)
+
+	var next uint64
+	for r := range digest {
+		first, last := digest.KeyHashBounds(r)
+		if uint64(first) != next {
+			t.Errorf("Range %d: expected to start at %d, got %d", r, next, first)
+		}
+		if digest.Range(first) != r || digest.Range(last) != r {
+			t.Errorf("Range %d: expected its bounds %d-%d to fall inside it", r, first, last)
+		}
+		next = uint64(last) + 1
+	}
+	if next != 1<<32 {
+		t.Errorf("Expected the ranges to end at the top of the key space, got %d", next)
+	}
+}
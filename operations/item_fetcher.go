@@ -0,0 +1,201 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const batchGetMaxKeys = 100
+
+// itemFetcher reads the current version of items from a table with strongly
+// consistent reads.  Streams whose records don't carry a new image read from
+// the source table, verification reads from both.
+type itemFetcher struct {
+	context   context.Context
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+
+	// called with the capacity consumed by each request when set
+	onRead func(capacities []*dynamodb.ConsumedCapacity)
+
+	// waited on before each request, the capacity is taken from it by onRead
+	limit capacityLimit
+
+	// the only attributes read when set, rather than whole items
+	attributes []string
+}
+
+// get returns the current item for a key, or nil if it no longer exists
+func (f *itemFetcher) get(keys map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      aws.String(f.tableName),
+		Key:            keys,
+		ConsistentRead: aws.Bool(true),
+	}
+	if f.onRead != nil {
+		input.ReturnConsumedCapacity = aws.String("TOTAL")
+	}
+
+	err := f.limit.Wait(f.context)
+	if err != nil {
+		return nil, err
+	}
+	output, err := f.client.GetItemWithContext(f.context, input)
+	if err != nil {
+		return nil, err
+	}
+	if f.onRead != nil {
+		f.onRead([]*dynamodb.ConsumedCapacity{output.ConsumedCapacity})
+	}
+	return output.Item, nil
+}
+
+// requests builds a write request for each record from the source table's
+// current items.  Removed items, and items that have been deleted since the
+// record was written, become deletes.
+func (f *itemFetcher) requests(records []streamRecord) ([]*dynamodb.WriteRequest, error) {
+	var keys []map[string]*dynamodb.AttributeValue
+	for _, record := range records {
+		if *record.EventName != "REMOVE" {
+			keys = append(keys, record.Dynamodb.Keys)
+		}
+	}
+
+	current, err := f.getAll(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]*dynamodb.WriteRequest, 0, len(records))
+	for _, record := range records {
+		item, exists := current[ItemKey(record.Dynamodb.Keys)]
+		if *record.EventName == "REMOVE" || !exists {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: record.Dynamodb.Keys},
+			})
+		} else {
+			requests = append(requests, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{Item: item},
+			})
+		}
+	}
+	return requests, nil
+}
+
+// getAll returns the current items for keys, keyed by ItemKey.  Keys of items
+// that don't exist are left out.
+func (f *itemFetcher) getAll(keys []map[string]*dynamodb.AttributeValue) (map[string]map[string]*dynamodb.AttributeValue, error) {
+	current := make(map[string]map[string]*dynamodb.AttributeValue, len(keys))
+	for start := 0; start < len(keys); start += batchGetMaxKeys {
+		end := start + batchGetMaxKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		err := f.batchGet(keys[start:end], current)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
+
+// batchGet reads up to batchGetMaxKeys items into current, keyed by ItemKey,
+// rereading any unprocessed keys until every key has been read
+func (f *itemFetcher) batchGet(keys []map[string]*dynamodb.AttributeValue, current map[string]map[string]*dynamodb.AttributeValue) error {
+	request := map[string]*dynamodb.KeysAndAttributes{
+		f.tableName: f.keysAndAttributes(keys),
+	}
+	backoff := unprocessedBackoffBase
+
+	for {
+		input := &dynamodb.BatchGetItemInput{RequestItems: request}
+		if f.onRead != nil {
+			input.ReturnConsumedCapacity = aws.String("TOTAL")
+		}
+
+		err := f.limit.Wait(f.context)
+		if err != nil {
+			return err
+		}
+		output, err := f.client.BatchGetItemWithContext(f.context, input)
+		if err != nil {
+			return err
+		}
+		if f.onRead != nil {
+			f.onRead(output.ConsumedCapacity)
+		}
+
+		for _, item := range output.Responses[f.tableName] {
+			current[ItemKey(projectKey(item, keys[0]))] = item
+		}
+
+		unprocessed, ok := output.UnprocessedKeys[f.tableName]
+		if !ok || len(unprocessed.Keys) == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-f.context.Done():
+			return f.context.Err()
+		}
+		if backoff *= 2; backoff > unprocessedBackoffMax {
+			backoff = unprocessedBackoffMax
+		}
+
+		request = output.UnprocessedKeys
+	}
+}
+
+// keysAndAttributes returns the request for keys, projected to the fetcher's
+// attributes when it has them
+func (f *itemFetcher) keysAndAttributes(keys []map[string]*dynamodb.AttributeValue) *dynamodb.KeysAndAttributes {
+	request := &dynamodb.KeysAndAttributes{Keys: keys, ConsistentRead: aws.Bool(true)}
+	if len(f.attributes) == 0 {
+		return request
+	}
+
+	// Attribute names are substituted in case they're reserved words
+	placeholders := make([]string, len(f.attributes))
+	request.ExpressionAttributeNames = make(map[string]*string, len(f.attributes))
+	for i, name := range f.attributes {
+		placeholders[i] = fmt.Sprintf("#a%d", i)
+		request.ExpressionAttributeNames[placeholders[i]] = aws.String(name)
+	}
+	request.ProjectionExpression = aws.String(strings.Join(placeholders, ", "))
+	return request
+}
+
+// projectKey returns the attributes of item that make up a key shaped like example
+func projectKey(item, example map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := make(map[string]*dynamodb.AttributeValue, len(example))
+	for name := range example {
+		key[name] = item[name]
+	}
+	return key
+}
@@ -0,0 +1,140 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// currentItems holds the current items of a table, keyed by id
+type currentItems struct {
+	dynamodbiface.DynamoDBAPI
+
+	items    map[string]map[string]*dynamodb.AttributeValue
+	reads    int
+	requests int
+
+	// the last batch request's keys and attributes
+	last *dynamodb.KeysAndAttributes
+}
+
+func (f *currentItems) BatchGetItemWithContext(_ aws.Context, input *dynamodb.BatchGetItemInput, _ ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	f.requests++
+	output := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]*dynamodb.AttributeValue)}
+	for tableName, keys := range input.RequestItems {
+		f.last = keys
+		for _, key := range keys.Keys {
+			f.reads++
+			if item, ok := f.items[aws.StringValue(key["id"].S)]; ok {
+				output.Responses[tableName] = append(output.Responses[tableName], item)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (f *currentItems) GetItemWithContext(_ aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.reads++
+	f.requests++
+	return &dynamodb.GetItemOutput{Item: f.items[aws.StringValue(input.Key["id"].S)]}, nil
+}
+
+func TestItemFetcherRequests(t *testing.T) {
+	current := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("present")}, "version": {N: aws.String("3")}}
+	source := &currentItems{items: map[string]map[string]*dynamodb.AttributeValue{"present": current, "removed": current}}
+	fetcher := &itemFetcher{context: context.Background(), client: source, tableName: "source"}
+
+	tests := []struct {
+		name   string
+		record streamRecord
+		put    bool
+	}{
+		{"a removed item is deleted", testRecord("REMOVE", "removed", ""), false},
+		{"an item deleted since the record is deleted", testRecord("MODIFY", "deleted", ""), false},
+		{"an inserted item deleted since the record is deleted", testRecord("INSERT", "deleted", ""), false},
+		{"a present item is put as it is now", testRecord("MODIFY", "present", ""), true},
+	}
+
+	for _, test := range tests {
+		requests, err := fetcher.requests([]streamRecord{test.record})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if len(requests) != 1 {
+			t.Fatalf("%s: expected 1 request, got %d", test.name, len(requests))
+		}
+
+		request := requests[0]
+		switch {
+		case test.put && (request.PutRequest == nil || aws.StringValue(request.PutRequest.Item["version"].N) != "3"):
+			t.Errorf("%s: expected a put of the current item, got %v", test.name, request)
+		case !test.put && (request.DeleteRequest == nil || aws.StringValue(request.DeleteRequest.Key["id"].S) != aws.StringValue(test.record.Dynamodb.Keys["id"].S)):
+			t.Errorf("%s: expected a delete of the record's key, got %v", test.name, request)
+		}
+	}
+}
+
+func TestItemFetcherRequestsSkipsReadingRemovedItems(t *testing.T) {
+	source := &currentItems{}
+	fetcher := &itemFetcher{context: context.Background(), client: source, tableName: "source"}
+
+	requests, err := fetcher.requests([]streamRecord{testRecord("REMOVE", "a", ""), testRecord("REMOVE", "b", "")})
+	if err != nil || len(requests) != 2 {
+		t.Fatalf("Expected 2 deletes, got %v, %v", requests, err)
+	}
+	if source.reads != 0 {
+		t.Errorf("Expected removed items not to be read, got %d reads", source.reads)
+	}
+}
+
+func TestItemFetcherGet(t *testing.T) {
+	current := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("present")}}
+	fetcher := &itemFetcher{
+		context:   context.Background(),
+		client:    &currentItems{items: map[string]map[string]*dynamodb.AttributeValue{"present": current}},
+		tableName: "source",
+	}
+
+	if item, err := fetcher.get(current); err != nil || item == nil {
+		t.Errorf("Expected the present item, got %v, %v", item, err)
+	}
+	if item, err := fetcher.get(map[string]*dynamodb.AttributeValue{"id": {S: aws.String("deleted")}}); err != nil || item != nil {
+		t.Errorf("Expected no item once it's deleted, got %v, %v", item, err)
+	}
+}
+
+func TestItemFetcherReadsOnlyItsAttributes(t *testing.T) {
+	current := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("present")}}
+	source := &currentItems{items: map[string]map[string]*dynamodb.AttributeValue{"present": current}}
+	fetcher := &itemFetcher{context: context.Background(), client: source, tableName: "source", attributes: []string{"id"}}
+
+	items, err := fetcher.getAll([]map[string]*dynamodb.AttributeValue{current, {"id": {S: aws.String("deleted")}}})
+	if err != nil || len(items) != 1 {
+		t.Fatalf("Expected only the present item, got %v, %v", items, err)
+	}
+	if aws.StringValue(source.last.ProjectionExpression) != "#a0" || aws.StringValue(source.last.ExpressionAttributeNames["#a0"]) != "id" {
+		t.Errorf("Expected only the key to be read, got %v", source.last)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"encoding/base64"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ItemKey returns a canonical string for an item's primary key.  Keys are
+// made up of string, number, and binary attributes only, other attribute
+// types are ignored.
+func ItemKey(keys map[string]*dynamodb.AttributeValue) string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		av := keys[name]
+		b.WriteString(name)
+		switch {
+		case av.S != nil:
+			b.WriteString("\x00S\x00")
+			b.WriteString(*av.S)
+		case av.N != nil:
+			b.WriteString("\x00N\x00")
+			b.WriteString(*av.N)
+		case av.B != nil:
+			b.WriteString("\x00B\x00")
+			b.WriteString(base64.StdEncoding.EncodeToString(av.B))
+		}
+		b.WriteString("\x00")
+	}
+	return b.String()
+}
+
+// ItemKeyHash returns a stable hash of an item's primary key
+func ItemKeyHash(keys map[string]*dynamodb.AttributeValue) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(ItemKey(keys)))
+	return h.Sum32()
+}
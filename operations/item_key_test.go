@@ -0,0 +1,65 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations_test
+
+import (
+	"testing"
+
+	"github.com/instructure/ddb-sync/operations"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestItemKeyIsIndependentOfAttributeOrder(t *testing.T) {
+	key := map[string]*dynamodb.AttributeValue{
+		"Artist":    {S: aws.String("No One You Know")},
+		"SongTitle": {S: aws.String("Call Me Today")},
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"SongTitle": {S: aws.String("Call Me Today")},
+		"Artist":    {S: aws.String("No One You Know")},
+	}
+
+	if operations.ItemKey(key) != operations.ItemKey(item) {
+		t.Errorf("Expected equal keys to produce the same item key")
+	}
+	if operations.ItemKeyHash(key) != operations.ItemKeyHash(item) {
+		t.Errorf("Expected equal keys to produce the same hash")
+	}
+}
+
+func TestItemKeyDistinguishesTypesAndValues(t *testing.T) {
+	keys := []map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("1")}},
+		{"id": {N: aws.String("1")}},
+		{"id": {S: aws.String("2")}},
+		{"id": {S: aws.String("1")}, "sort": {S: aws.String("")}},
+		{"id2": {S: aws.String("1")}},
+	}
+
+	seen := make(map[string]int)
+	for i, key := range keys {
+		itemKey := operations.ItemKey(key)
+		if j, exists := seen[itemKey]; exists {
+			t.Errorf("Keys %d and %d produced the same item key %q", j, i, itemKey)
+		}
+		seen[itemKey] = i
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// KeyFence keeps a backfill from overwriting stream writes while both run at
+// once.  The stream claims each key before writing it, waiting for any backfill
+// write of that key already in flight, and the backfill skips claimed keys.  A
+// nil KeyFence lets every write through.
+type KeyFence struct {
+	m       sync.Mutex
+	written *sync.Cond
+
+	keyNames []string
+	claimed  map[string]bool
+	inFlight map[string]int
+	closed   bool
+}
+
+func NewKeyFence(keySchema []*dynamodb.KeySchemaElement) *KeyFence {
+	f := &KeyFence{
+		claimed:  make(map[string]bool),
+		inFlight: make(map[string]int),
+	}
+	f.written = sync.NewCond(&f.m)
+
+	for _, element := range keySchema {
+		f.keyNames = append(f.keyNames, *element.AttributeName)
+	}
+	return f
+}
+
+// Claim marks a key as written by the stream, returning once no backfill write
+// of the key is in flight
+func (f *KeyFence) Claim(keys map[string]*dynamodb.AttributeValue) {
+	if f == nil {
+		return
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.closed {
+		return
+	}
+
+	key := ItemKey(keys)
+	f.claimed[key] = true
+	for f.inFlight[key] > 0 {
+		f.written.Wait()
+	}
+}
+
+// Reserve reports which items the backfill may write, marking them in flight
+// until they are released
+func (f *KeyFence) Reserve(items []map[string]*dynamodb.AttributeValue) []bool {
+	reserved := make([]bool, len(items))
+	if f == nil {
+		for i := range reserved {
+			reserved[i] = true
+		}
+		return reserved
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for i, item := range items {
+		key := f.itemKey(item)
+		if !f.claimed[key] {
+			f.inFlight[key]++
+			reserved[i] = true
+		}
+	}
+	return reserved
+}
+
+// Release ends the backfill writes of items reserved by Reserve
+func (f *KeyFence) Release(items []map[string]*dynamodb.AttributeValue, reserved []bool) {
+	if f == nil {
+		return
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for i, item := range items {
+		if !reserved[i] {
+			continue
+		}
+
+		key := f.itemKey(item)
+		if f.inFlight[key]--; f.inFlight[key] <= 0 {
+			delete(f.inFlight, key)
+		}
+	}
+	f.written.Broadcast()
+}
+
+// Close discards the claimed keys once the backfill has finished, later claims return immediately
+func (f *KeyFence) Close() {
+	if f == nil {
+		return
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.closed = true
+	f.claimed = nil
+	f.written.Broadcast()
+}
+
+func (f *KeyFence) itemKey(item map[string]*dynamodb.AttributeValue) string {
+	keys := make(map[string]*dynamodb.AttributeValue, len(f.keyNames))
+	for _, name := range f.keyNames {
+		keys[name] = item[name]
+	}
+	return ItemKey(keys)
+}
@@ -0,0 +1,78 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestKeyFenceSkipsClaimedKeys(t *testing.T) {
+	fence := NewKeyFence(testKeySchema)
+	fence.Claim(testKey("a"))
+
+	items := []map[string]*dynamodb.AttributeValue{testItem("a", "backfilled"), testItem("b", "backfilled")}
+	reserved := fence.Reserve(items)
+	if reserved[0] || !reserved[1] {
+		t.Errorf("Expected only the unclaimed key to be reserved, got %v", reserved)
+	}
+	fence.Release(items, reserved)
+}
+
+func TestKeyFenceClaimWaitsForInFlightWrites(t *testing.T) {
+	fence := NewKeyFence(testKeySchema)
+
+	items := []map[string]*dynamodb.AttributeValue{testItem("a", "backfilled")}
+	reserved := fence.Reserve(items)
+
+	claimed := make(chan struct{})
+	go func() {
+		fence.Claim(testKey("a"))
+		close(claimed)
+	}()
+
+	select {
+	case <-claimed:
+		t.Fatalf("Expected the claim to wait for the backfill write")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fence.Release(items, reserved)
+	select {
+	case <-claimed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the claim to finish once the backfill write was released")
+	}
+
+	if reserved := fence.Reserve(items); reserved[0] {
+		t.Errorf("Expected the claimed key to be skipped by the backfill")
+	}
+}
+
+func TestNilKeyFenceAllowsEverything(t *testing.T) {
+	var fence *KeyFence
+	fence.Claim(testKey("a"))
+
+	items := []map[string]*dynamodb.AttributeValue{testItem("a", "backfilled")}
+	if reserved := fence.Reserve(items); !reserved[0] {
+		t.Errorf("Expected a nil fence to reserve every item")
+	}
+}
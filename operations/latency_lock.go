@@ -26,28 +26,72 @@ import (
 	"github.com/instructure/ddb-sync/utils"
 )
 
+// LatencyLock tracks replication latency across one or more writer lanes.
+// Latency is measured from the oldest record a busy lane has written; when
+// every lane is idle it is measured from the newest record written.
 type LatencyLock struct {
-	timestamp   time.Time
-	mux         sync.RWMutex
-	initialized bool
+	mux   sync.RWMutex
+	lanes map[int]*latencyLane
 }
 
-func (l *LatencyLock) Update(lastCheck time.Time) {
+type latencyLane struct {
+	timestamp time.Time
+	idle      bool
+}
+
+// Update records the creation time of the record a lane just wrote
+func (l *LatencyLock) Update(lane int, lastCheck time.Time) {
 	l.mux.Lock()
 	defer l.mux.Unlock()
 
-	l.initialized = true
-	l.timestamp = lastCheck
+	if l.lanes == nil {
+		l.lanes = make(map[int]*latencyLane)
+	}
+	l.lanes[lane] = &latencyLane{timestamp: lastCheck}
 }
 
-func (l *LatencyLock) Status() string {
+// Idle marks a lane as having no records waiting to be written
+func (l *LatencyLock) Idle(lane int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if laneStatus, ok := l.lanes[lane]; ok {
+		laneStatus.idle = true
+	}
+}
+
+// Latency returns the current replication latency and whether any record has been written
+func (l *LatencyLock) Latency() (time.Duration, bool) {
 	l.mux.RLock()
 	defer l.mux.RUnlock()
-	if !l.initialized {
+
+	if len(l.lanes) == 0 {
+		return 0, false
+	}
+
+	var oldestBusy, newest time.Time
+	for _, laneStatus := range l.lanes {
+		if !laneStatus.idle && (oldestBusy.IsZero() || laneStatus.timestamp.Before(oldestBusy)) {
+			oldestBusy = laneStatus.timestamp
+		}
+		if laneStatus.timestamp.After(newest) {
+			newest = laneStatus.timestamp
+		}
+	}
+
+	if !oldestBusy.IsZero() {
+		return time.Since(oldestBusy), true
+	}
+	return time.Since(newest), true
+}
+
+func (l *LatencyLock) Status() string {
+	latency, initialized := l.Latency()
+	if !initialized {
 		return "--"
 	}
 
-	duration := utils.FormatDuration(time.Since(l.timestamp))
+	duration := utils.FormatDuration(latency)
 
 	return fmt.Sprintf("~%s", duration)
 }
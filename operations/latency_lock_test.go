@@ -0,0 +1,67 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/operations"
+)
+
+func TestLatencyLockUninitialized(t *testing.T) {
+	lock := operations.LatencyLock{}
+
+	if status := lock.Status(); status != "--" {
+		t.Errorf("Expected an uninitialized lock to display \"--\", got %q", status)
+	}
+}
+
+func TestLatencyLockReportsOldestBusyLane(t *testing.T) {
+	lock := operations.LatencyLock{}
+	now := time.Now()
+
+	lock.Update(0, now.Add(-10*time.Minute))
+	lock.Update(1, now.Add(-1*time.Minute))
+
+	latency, _ := lock.Latency()
+	if latency < 10*time.Minute || latency > 11*time.Minute {
+		t.Errorf("Expected latency of the slowest lane (~10m), got %s", latency)
+	}
+}
+
+func TestLatencyLockIgnoresIdleLanes(t *testing.T) {
+	lock := operations.LatencyLock{}
+	now := time.Now()
+
+	lock.Update(0, now.Add(-10*time.Minute))
+	lock.Idle(0)
+	lock.Update(1, now.Add(-1*time.Minute))
+
+	latency, _ := lock.Latency()
+	if latency < time.Minute || latency > 2*time.Minute {
+		t.Errorf("Expected latency of the busy lane (~1m), got %s", latency)
+	}
+
+	lock.Idle(1)
+	latency, _ = lock.Latency()
+	if latency < time.Minute || latency > 2*time.Minute {
+		t.Errorf("Expected latency of the newest record when all lanes are idle (~1m), got %s", latency)
+	}
+}
@@ -22,10 +22,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"reflect"
+	"strings"
 	"sync"
 
 	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/state"
 	"github.com/instructure/ddb-sync/status"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -40,9 +42,16 @@ type operatorPhase int
 const (
 	NotStartedPhase operatorPhase = iota
 	BackfillPhase
+	ConcurrentPhase
 	StreamPhase
 	NoopPhase
 	CompletedPhase
+	VerifyPhase
+	RepairPhase
+	SettingsPhase
+	IndexesPhase
+	CleanupPhase
+	EstimatePhase
 )
 
 type Operation interface {
@@ -64,33 +73,73 @@ type Operator struct {
 
 	describe *DescribeOperation
 
+	state *state.Store
+
+	// the source table's key schema, known once the preflights have run
+	keySchema []*dynamodb.KeySchemaElement
+
 	backfill Operation
 	stream   Operation
+
+	// set instead of backfill and stream by the verify, repair, cleanup, and estimate commands
+	verify   *VerifyOperation
+	repair   *RepairOperation
+	cleanup  *CleanupOperation
+	estimate *EstimateOperation
+
+	// copies the table settings before the backfill when set, and instead of
+	// it for the settings command
+	settings *SettingsOperation
+
+	// set while a backfill that a stream will follow is running
+	guard *retentionGuard
+
+	// set when the output table's indexes are deferred until after the backfill
+	indexes *indexDeferral
 }
 
 func NewOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
 	var err error
 
 	o := &Operator{
-		OperationPlan:     plan,
-		context:           ctx,
-		contextCancelFunc: cancelFunc,
+		OperationPlan: plan,
 	}
+	ctx, cancelFunc = o.withPlanContext(ctx)
 
 	o.describe, err = NewDescribeOperation(ctx, plan, cancelFunc)
 	if err != nil {
 		return nil, err
 	}
 
+	o.state, err = state.Open(plan.StateFile, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.OperationPlan.Settings.Sync {
+		o.settings, err = NewSettingsOperation(ctx, plan, cancelFunc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if !o.OperationPlan.Backfill.Disabled {
-		o.backfill, err = NewBackfillOperation(ctx, plan, cancelFunc)
+		o.backfill, err = NewBackfillOperation(ctx, plan, o.state, cancelFunc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Indexes an earlier run removed are created again even when this run doesn't defer them
+	if (!o.OperationPlan.Backfill.Disabled && o.OperationPlan.Backfill.DeferIndexes) || len(o.state.DeferredIndexes()) > 0 {
+		o.indexes, err = newIndexDeferral(ctx, plan, o.state)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if !o.OperationPlan.Stream.Disabled {
-		o.stream, err = NewStreamOperation(ctx, plan, cancelFunc)
+		o.stream, err = NewStreamOperation(ctx, plan, o.state, cancelFunc)
 		if err != nil {
 			return nil, err
 		}
@@ -99,6 +148,125 @@ func NewOperator(ctx context.Context, plan config.OperationPlan, cancelFunc cont
 	return o, nil
 }
 
+// NewVerifyOperator returns an operator that compares the plan's tables rather than syncing them
+func NewVerifyOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
+	o, err := newStatelessOperator(ctx, plan, cancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	o.verify, err = NewVerifyOperation(o.context, plan, o.contextCancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// NewRepairOperator returns an operator that rewrites the items that differ
+// between the plan's tables rather than syncing them
+func NewRepairOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
+	o, err := newStatelessOperator(ctx, plan, cancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	o.repair, err = NewRepairOperation(o.context, plan, o.contextCancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// NewSettingsOperator returns an operator that copies the input table's
+// settings to the output table rather than syncing items
+func NewSettingsOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
+	o, err := newStatelessOperator(ctx, plan, cancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	o.settings, err = NewSettingsOperation(o.context, plan, o.contextCancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// NewCleanupOperator returns an operator that undoes the table changes the
+// plan's sync recorded in its state file
+func NewCleanupOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
+	if plan.StateFile == "" {
+		return nil, fmt.Errorf("%s: %v", plan.Description(), config.ErrCleanupRequiresStateFile)
+	}
+
+	o, err := newBareOperator(ctx, plan, plan.StateFile, cancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	o.cleanup, err = NewCleanupOperation(o.context, plan, o.state, o.contextCancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// NewEstimateOperator returns an operator that projects the capacity,
+// duration, and cost of the plan's backfill rather than running it
+func NewEstimateOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
+	o, err := newStatelessOperator(ctx, plan, cancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	o.estimate, err = NewEstimateOperation(o.context, plan, o.contextCancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func newStatelessOperator(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*Operator, error) {
+	// Verification, repair, settings, and estimates have no progress to save
+	return newBareOperator(ctx, plan, "", cancelFunc)
+}
+
+func newBareOperator(ctx context.Context, plan config.OperationPlan, stateFile string, cancelFunc context.CancelFunc) (*Operator, error) {
+	var err error
+
+	o := &Operator{
+		OperationPlan: plan,
+	}
+	ctx, cancelFunc = o.withPlanContext(ctx)
+
+	o.describe, err = NewDescribeOperation(ctx, plan, cancelFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	o.state, err = state.Open(stateFile, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// withPlanContext gives the operator a context of its own.  Every plan is
+// started from the dispatcher's context, so canceling that would stop them
+// all; a plan aborted on its own, by the retention guard say, cancels only
+// this context and leaves the other plans syncing.  Its operations share the
+// returned context and cancel func.
+func (o *Operator) withPlanContext(parent context.Context) (context.Context, context.CancelFunc) {
+	o.context, o.contextCancelFunc = context.WithCancel(parent)
+	return o.context, o.contextCancelFunc
+}
+
 func (o *Operator) Preflights() error {
 	inputSession, outputSession, err := o.OperationPlan.GetSessions()
 	if err != nil {
@@ -114,12 +282,30 @@ func (o *Operator) Preflights() error {
 	}
 
 	outDescr, err := o.getTableDescription(outputClient, o.OperationPlan.Output.TableName)
+	if _, missing := err.(tableNotFoundError); missing && o.estimate != nil {
+		// Estimate as though the output table were created like the input
+		return o.estimate.Preflights(inDescr, inDescr)
+	}
+	if _, missing := err.(tableNotFoundError); missing && o.OperationPlan.Output.CreateIfMissing {
+		outDescr, err = o.createOutputTable(outputClient, inDescr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.estimate != nil {
+		// Nothing is written, so the schemas needn't match
+		return o.estimate.Preflights(inDescr, outDescr)
+	}
+
+	err = o.checkSchemas(inputClient, outputClient, inDescr, outDescr)
 	if err != nil {
 		return err
 	}
+	o.keySchema = inDescr.Table.KeySchema
 
-	if !reflect.DeepEqual(inDescr.Table.KeySchema, outDescr.Table.KeySchema) {
-		return fmt.Errorf("[ERROR] %s: table key schemas do not match", o.OperationPlan.Description())
+	if o.indexes != nil {
+		o.indexes.Preflights(inDescr, outDescr)
 	}
 
 	if o.backfill != nil {
@@ -135,6 +321,34 @@ func (o *Operator) Preflights() error {
 			return err
 		}
 	}
+
+	if o.verify != nil {
+		err := o.verify.Preflights(inDescr, outDescr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.repair != nil {
+		err := o.repair.Preflights(inDescr, outDescr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.settings != nil {
+		err := o.settings.Preflights(inDescr, outDescr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.cleanup != nil {
+		err := o.cleanup.Preflights(inDescr, outDescr)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -142,30 +356,103 @@ func (o *Operator) Run() error {
 	go o.describe.Start()
 	defer o.describe.Stop()
 
-	if o.backfill != nil {
-		o.mOperatorPhase.Lock()
-		o.operatorPhase = BackfillPhase
-		o.mOperatorPhase.Unlock()
+	o.state.Start()
+	defer o.stopState()
+
+	if o.verify != nil {
+		o.setPhase(VerifyPhase)
 
-		err := o.backfill.Run()
+		err := o.verify.Run()
 		if err != nil {
 			return err
 		}
+
+		o.setPhase(CompletedPhase)
+		return nil
 	}
 
-	if o.stream != nil {
-		o.mOperatorPhase.Lock()
-		o.operatorPhase = StreamPhase
-		o.mOperatorPhase.Unlock()
+	if o.repair != nil {
+		o.setPhase(RepairPhase)
+
+		err := o.repair.Run()
+		if err != nil {
+			return err
+		}
 
-		err := o.stream.Run()
+		o.setPhase(CompletedPhase)
+		return nil
+	}
+
+	if o.estimate != nil {
+		o.setPhase(EstimatePhase)
+
+		err := o.estimate.Run()
 		if err != nil {
 			return err
 		}
+
+		o.setPhase(CompletedPhase)
+		return nil
+	}
+
+	if o.cleanup != nil {
+		o.setPhase(CleanupPhase)
+
+		err := o.cleanup.Run()
+		if err != nil {
+			return err
+		}
+
+		o.setPhase(CompletedPhase)
+		return nil
+	}
+
+	if o.settings != nil {
+		o.setPhase(SettingsPhase)
+
+		err := o.settings.Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.indexes != nil && !o.indexes.deferring {
+		o.setPhase(IndexesPhase)
+
+		err := o.indexes.Restore()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		backfill, stream := o.operations()
+
+		var err error
+		switch {
+		case backfill == nil || stream == nil:
+			err = o.runSequentially(backfill, stream)
+		case o.OperationPlan.Stream.Concurrent:
+			err = o.runConcurrently(backfill, stream, nil)
+		default:
+			err = o.runGuarded(backfill, stream)
+		}
+
+		if err == errRebackfillRequired {
+			err = o.prepareRebackfill()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
 	}
 
 	o.mOperatorPhase.Lock()
-	if o.backfill == nil && o.stream == nil {
+	if o.backfill == nil && o.stream == nil && o.settings == nil {
 		o.operatorPhase = NoopPhase
 	} else {
 		o.operatorPhase = CompletedPhase
@@ -175,6 +462,193 @@ func (o *Operator) Run() error {
 	return nil
 }
 
+func (o *Operator) runSequentially(backfill, stream Operation) error {
+	if backfill != nil {
+		if o.indexes != nil && o.indexes.deferring {
+			o.setPhase(IndexesPhase)
+
+			err := o.indexes.Remove()
+			if err != nil {
+				return err
+			}
+		}
+
+		o.setPhase(BackfillPhase)
+
+		err := backfill.Run()
+		if err != nil {
+			return err
+		}
+
+		if o.indexes != nil && o.indexes.deferring {
+			o.setPhase(IndexesPhase)
+
+			err := o.indexes.Restore()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if stream != nil {
+		o.setPhase(StreamPhase)
+
+		err := stream.Run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runGuarded runs the backfill and then the stream, watching that the backfill
+// finishes within the stream's retention
+func (o *Operator) runGuarded(backfill, stream Operation) error {
+	guard := newRetentionGuard(o.OperationPlan, backfill.(*BackfillOperation), o.describe, o.state)
+	o.setGuard(guard)
+	defer o.setGuard(nil)
+
+	guardDone := make(chan struct{})
+	defer close(guardDone)
+	go guard.Run(guardDone)
+
+	switch o.OperationPlan.Backfill.RetentionGuard {
+	case config.RetentionGuardConcurrent:
+		return o.runConcurrently(backfill, stream, guard.triggered)
+
+	case config.RetentionGuardAbort:
+		go func() {
+			select {
+			case <-guard.triggered:
+				log.Printf("[ERROR] %s: Backfill aborted, it would outlast the stream's retention", o.OperationPlan.Description())
+				o.contextCancelFunc()
+			case <-guardDone:
+			}
+		}()
+
+		err := o.runSequentially(backfill, stream)
+		if guard.Triggered() {
+			// Only this plan is aborted, the others carry on
+			return isolatedError{fmt.Errorf("%s: Backfill aborted by the retention guard", o.OperationPlan.Description())}
+		}
+		return err
+	}
+
+	return o.runSequentially(backfill, stream)
+}
+
+// runConcurrently streams while the backfill runs, the stream's writes take
+// precedence over the backfill's for the same key.  When start is set the
+// stream waits for it to close, or for the backfill to finish.
+func (o *Operator) runConcurrently(backfill, stream Operation, start <-chan struct{}) error {
+	fence := NewKeyFence(o.keySchema)
+	backfill.(*BackfillOperation).fence = fence
+	stream.(*StreamOperation).fence = fence
+
+	backfillDone := make(chan error, 1)
+	go func() {
+		err := backfill.Run()
+		fence.Close()
+		if err == nil {
+			o.setPhase(StreamPhase)
+		}
+		backfillDone <- err
+	}()
+
+	if start != nil {
+		o.setPhase(BackfillPhase)
+
+		select {
+		case <-start:
+			log.Printf("[WARNING] %s: Starting the stream alongside the backfill so no changes are trimmed", o.OperationPlan.Description())
+		case err := <-backfillDone:
+			if err != nil {
+				return err
+			}
+			return stream.Run()
+		}
+	}
+	o.setPhase(ConcurrentPhase)
+
+	streamErr := stream.Run()
+	backfillErr := <-backfillDone
+
+	// A failed backfill cancels the stream, report why
+	if backfillErr != nil && (streamErr == nil || streamErr == context.Canceled) {
+		return backfillErr
+	}
+	return streamErr
+}
+
+// Differences returns the number of differences the verify command found
+func (o *Operator) Differences() int64 {
+	if o.verify == nil {
+		return 0
+	}
+	return o.verify.Differences()
+}
+
+func (o *Operator) setPhase(phase operatorPhase) {
+	o.mOperatorPhase.Lock()
+	defer o.mOperatorPhase.Unlock()
+
+	o.operatorPhase = phase
+}
+
+func (o *Operator) setGuard(guard *retentionGuard) {
+	o.mOperatorPhase.Lock()
+	defer o.mOperatorPhase.Unlock()
+
+	o.guard = guard
+}
+
+func (o *Operator) operations() (Operation, Operation) {
+	o.mOperatorPhase.Lock()
+	defer o.mOperatorPhase.Unlock()
+
+	return o.backfill, o.stream
+}
+
+// prepareRebackfill replaces the operations with a fresh backfill followed by a
+// stream that starts from when that backfill began
+func (o *Operator) prepareRebackfill() error {
+	plan := o.OperationPlan
+	plan.Backfill.Disabled = false
+	plan.Backfill.Resume = false
+	plan.Stream.StartPosition = config.StartPositionAuto
+
+	o.state.ClearStream()
+
+	backfill, err := NewBackfillOperation(o.context, plan, o.state, o.contextCancelFunc)
+	if err != nil {
+		return err
+	}
+
+	stream, err := NewStreamOperation(o.context, plan, o.state, o.contextCancelFunc)
+	if err != nil {
+		return err
+	}
+
+	o.mOperatorPhase.Lock()
+	defer o.mOperatorPhase.Unlock()
+
+	// The stream itself hasn't changed, only how far behind it the output is
+	if previous, ok := o.stream.(*StreamOperation); ok {
+		stream.streamARN = previous.streamARN
+	}
+
+	o.backfill = backfill
+	o.stream = stream
+	return nil
+}
+
+func (o *Operator) stopState() {
+	err := o.state.Stop()
+	if err != nil {
+		log.Printf("[ERROR] %s: %v", o.OperationPlan.Description(), err)
+	}
+}
+
 func (o *Operator) Checkpoint() string {
 	o.mOperatorPhase.Lock()
 	defer o.mOperatorPhase.Unlock()
@@ -182,10 +656,36 @@ func (o *Operator) Checkpoint() string {
 	switch o.operatorPhase {
 	case NotStartedPhase:
 		return fmt.Sprintf("%s Waiting", o.OperationPlan.Description())
-	case BackfillPhase:
-		return o.backfill.Checkpoint()
+	case BackfillPhase, ConcurrentPhase:
+		checkpoints := []string{o.backfill.Checkpoint()}
+		if o.operatorPhase == ConcurrentPhase {
+			checkpoints = append(checkpoints, o.stream.Checkpoint())
+		}
+		if o.guard != nil {
+			checkpoints = append(checkpoints, o.guard.Checkpoint())
+		}
+
+		var nonEmpty []string
+		for _, checkpoint := range checkpoints {
+			if checkpoint != "" {
+				nonEmpty = append(nonEmpty, checkpoint)
+			}
+		}
+		return strings.Join(nonEmpty, "\n")
 	case StreamPhase:
 		return o.stream.Checkpoint()
+	case VerifyPhase:
+		return o.verify.Checkpoint()
+	case RepairPhase:
+		return o.repair.Checkpoint()
+	case SettingsPhase:
+		return o.settings.Checkpoint()
+	case IndexesPhase:
+		return o.indexes.Checkpoint()
+	case CleanupPhase:
+		return o.cleanup.Checkpoint()
+	case EstimatePhase:
+		return o.estimate.Checkpoint()
 	case CompletedPhase:
 		return fmt.Sprintf("%s Completed", o.OperationPlan.Description())
 	}
@@ -197,24 +697,75 @@ func (o *Operator) Status() *status.Status {
 
 	status.Description = o.describe.Status()
 
+	o.mOperatorPhase.Lock()
+	defer o.mOperatorPhase.Unlock()
+
 	if o.backfill != nil {
 		status.Backfill = o.backfill.Status()
+		if o.guard != nil {
+			if warning := o.guard.Status(); warning != "" {
+				status.Backfill += " " + warning
+			}
+		}
+		if o.indexes != nil {
+			if indexes := o.indexes.Status(); indexes != "" {
+				status.Backfill += " " + indexes
+			}
+		}
 	}
 
 	if o.stream != nil {
 		status.Stream = o.stream.Status()
+		if stream, ok := o.stream.(*StreamOperation); ok {
+			status.Consistency = stream.ConsistencyStatus()
+		}
 	}
 
-	o.mOperatorPhase.Lock()
-	defer o.mOperatorPhase.Unlock()
+	if o.verify != nil {
+		status.Verify = o.verify.Status()
+	}
+
+	if o.repair != nil {
+		status.Repair = o.repair.Status()
+	}
+
+	if o.cleanup != nil {
+		status.Cleanup = o.cleanup.Status()
+	}
+
+	if o.estimate != nil {
+		status.Estimate = o.estimate.Status()
+	}
+
+	// Settings copied before a backfill or stream only show in the log
+	if o.settings != nil && o.backfill == nil && o.stream == nil {
+		status.Settings = o.settings.Status()
+	}
 
 	switch o.operatorPhase {
 	case NotStartedPhase:
 		status.SetWaiting()
 	case BackfillPhase:
 		status.Rate = o.backfill.Rate()
+	case ConcurrentPhase:
+		// The backfill may have just finished
+		status.Rate = o.backfill.Rate()
+		if status.Rate == "" {
+			status.Rate = o.stream.Rate()
+		}
 	case StreamPhase:
 		status.Rate = o.stream.Rate()
+	case VerifyPhase:
+		status.Rate = o.verify.Rate()
+	case RepairPhase:
+		status.Rate = o.repair.Rate()
+	case SettingsPhase:
+		status.Rate = o.settings.Rate()
+	case CleanupPhase:
+		status.Rate = o.cleanup.Rate()
+	case EstimatePhase:
+		status.Rate = o.estimate.Rate()
+	case IndexesPhase:
 	case NoopPhase:
 		status.SetNoop()
 	case CompletedPhase:
@@ -233,7 +784,7 @@ func (o *Operator) getTableDescription(client *dynamodb.DynamoDB, tableName stri
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			if awsErr.Code() == "ResourceNotFoundException" {
-				return nil, fmt.Errorf("[%s] Failed pre-flight check: table does not exist", tableName)
+				return nil, tableNotFoundError(tableName)
 			}
 			return nil, fmt.Errorf("[%s] Describe table operation failed with %v", tableName, err)
 		}
@@ -245,3 +796,91 @@ func (o *Operator) getTableDescription(client *dynamodb.DynamoDB, tableName stri
 	}
 	return description, nil
 }
+
+// checkSchemas logs how the output table's schema differs from the input
+// table's, failing on fatal differences, or on any difference when strict
+func (o *Operator) checkSchemas(inputClient, outputClient *dynamodb.DynamoDB, inDescr, outDescr *dynamodb.DescribeTableOutput) error {
+	inTTL := o.describeTimeToLive(inputClient, o.OperationPlan.Input.TableName)
+	outTTL := o.describeTimeToLive(outputClient, o.OperationPlan.Output.TableName)
+
+	// Deferred indexes are missing until the backfill completes, and the ones
+	// an earlier run removed until they're created again
+	in := inDescr.Table
+	deferring := o.indexes != nil && o.indexes.deferring
+	if removed := o.state.DeferredIndexes(); deferring || len(removed) > 0 {
+		compared := make(map[string]bool)
+		if !deferring {
+			for _, index := range in.GlobalSecondaryIndexes {
+				compared[aws.StringValue(index.IndexName)] = true
+			}
+			for _, name := range removed {
+				compared[name] = false
+			}
+		}
+		for _, index := range outDescr.Table.GlobalSecondaryIndexes {
+			compared[aws.StringValue(index.IndexName)] = true
+		}
+		in = withGlobalIndexes(in, compared)
+	}
+
+	differences := compareSchemas(in, outDescr.Table, inTTL, outTTL)
+	if len(differences) == 0 {
+		return nil
+	}
+
+	fatal := false
+	lines := []string{fmt.Sprintf("%s: Table schemas differ:", o.OperationPlan.Description())}
+	for _, difference := range differences {
+		fatal = fatal || difference.Fatal
+		lines = append(lines, "  "+difference.String())
+	}
+	log.Printf("%s", strings.Join(lines, "\n"))
+
+	if fatal {
+		return fmt.Errorf("[ERROR] %s: table schemas are not compatible", o.OperationPlan.Description())
+	}
+	if o.OperationPlan.StrictSchema {
+		return fmt.Errorf("[ERROR] %s: table schemas differ and strict schema checks are enabled", o.OperationPlan.Description())
+	}
+	return nil
+}
+
+// describeTimeToLive returns a table's time to live, or nil when it can't be described
+func (o *Operator) describeTimeToLive(client *dynamodb.DynamoDB, tableName string) *dynamodb.TimeToLiveDescription {
+	output, err := client.DescribeTimeToLiveWithContext(o.context, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		log.Printf("[WARNING] %s: Time to live isn't compared, describing it on [%s] failed: %v", o.OperationPlan.Description(), tableName, err)
+		return nil
+	}
+	return output.TimeToLiveDescription
+}
+
+type tableNotFoundError string
+
+func (e tableNotFoundError) Error() string {
+	return fmt.Sprintf("[%s] Failed pre-flight check: table does not exist", string(e))
+}
+
+// createOutputTable creates the output table like the input table and waits for it to become active
+func (o *Operator) createOutputTable(client *dynamodb.DynamoDB, inDescr *dynamodb.DescribeTableOutput) (*dynamodb.DescribeTableOutput, error) {
+	tableName := o.OperationPlan.Output.TableName
+	log.Printf("%s: Creating the output table like the input table…", o.OperationPlan.Description())
+
+	source := inDescr.Table
+	if o.indexes != nil && o.indexes.deferring {
+		source = withGlobalIndexes(source, nil)
+	}
+
+	_, err := client.CreateTableWithContext(o.context, createTableInput(tableName, source))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Create table operation failed with %v", tableName, err)
+	}
+
+	err = client.WaitUntilTableExistsWithContext(o.context, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Failed waiting for the created table to become active: %v", tableName, err)
+	}
+	log.Printf("%s: Output table created", o.OperationPlan.Description())
+
+	return o.getTableDescription(client, tableName)
+}
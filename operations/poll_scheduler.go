@@ -0,0 +1,74 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"time"
+)
+
+// PollScheduler paces GetRecords calls on a shard.  It polls again right away
+// while records are flowing, never more often than the minimum interval, and
+// doubles the wait after each empty read up to the maximum interval.
+type PollScheduler struct {
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	interval time.Duration
+	lastPoll time.Time
+}
+
+func NewPollScheduler(minInterval, maxInterval time.Duration) *PollScheduler {
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+
+	return &PollScheduler{
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		interval:    minInterval,
+	}
+}
+
+// Polled records a GetRecords call made at the given time and how many records it returned
+func (s *PollScheduler) Polled(at time.Time, records int) {
+	s.lastPoll = at
+
+	if records > 0 {
+		s.interval = s.minInterval
+		return
+	}
+
+	if s.interval *= 2; s.interval > s.maxInterval {
+		s.interval = s.maxInterval
+	}
+}
+
+// Delay returns how long to wait from the given time before polling again
+func (s *PollScheduler) Delay(now time.Time) time.Duration {
+	delay := s.lastPoll.Add(s.interval).Sub(now)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Interval returns the current time between polls
+func (s *PollScheduler) Interval() time.Duration {
+	return s.interval
+}
@@ -0,0 +1,64 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/operations"
+)
+
+func TestPollSchedulerBacksOffOnEmptyReads(t *testing.T) {
+	scheduler := operations.NewPollScheduler(250*time.Millisecond, time.Second)
+	now := time.Now()
+
+	expected := []time.Duration{500 * time.Millisecond, time.Second, time.Second}
+	for i, interval := range expected {
+		scheduler.Polled(now, 0)
+		if scheduler.Interval() != interval {
+			t.Errorf("Empty read %d: expected interval %s, got %s", i+1, interval, scheduler.Interval())
+		}
+	}
+
+	if delay := scheduler.Delay(now.Add(400 * time.Millisecond)); delay != 600*time.Millisecond {
+		t.Errorf("Expected a 600ms delay, got %s", delay)
+	}
+}
+
+func TestPollSchedulerResetsWhileRecordsFlow(t *testing.T) {
+	scheduler := operations.NewPollScheduler(250*time.Millisecond, 5*time.Second)
+	now := time.Now()
+
+	scheduler.Polled(now, 0)
+	scheduler.Polled(now, 0)
+	scheduler.Polled(now, 10)
+
+	if scheduler.Interval() != 250*time.Millisecond {
+		t.Errorf("Expected the interval to return to the minimum, got %s", scheduler.Interval())
+	}
+
+	// The minimum interval still applies, keeping a shard under 5 reads a second
+	if delay := scheduler.Delay(now.Add(100 * time.Millisecond)); delay != 150*time.Millisecond {
+		t.Errorf("Expected a 150ms delay, got %s", delay)
+	}
+	if delay := scheduler.Delay(now.Add(time.Second)); delay != 0 {
+		t.Errorf("Expected no delay once the interval has passed, got %s", delay)
+	}
+}
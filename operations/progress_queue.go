@@ -0,0 +1,90 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"sync"
+)
+
+// ProgressQueue tracks units of work that are read in order but may be
+// written out of order.  Each entry's commit function is called once the entry
+// and every entry added before it have been fully acknowledged, so a commit
+// never records progress past work that is still in flight.
+type ProgressQueue struct {
+	m       sync.Mutex
+	entries []*ProgressEntry
+}
+
+// ProgressEntry is a unit of work made up of one or more acknowledgements
+type ProgressEntry struct {
+	queue       *ProgressQueue
+	outstanding int
+	commit      func()
+}
+
+// Add appends an entry that completes after count acknowledgements.  An entry
+// with a count of zero completes as soon as the entries before it do.
+func (q *ProgressQueue) Add(count int, commit func()) *ProgressEntry {
+	entry := &ProgressEntry{
+		queue:       q,
+		outstanding: count,
+		commit:      commit,
+	}
+
+	q.m.Lock()
+	q.entries = append(q.entries, entry)
+	q.m.Unlock()
+
+	if count == 0 {
+		q.advance()
+	}
+	return entry
+}
+
+// Len returns the number of entries that have not been committed
+func (q *ProgressQueue) Len() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return len(q.entries)
+}
+
+// Ack acknowledges a single unit of the entry's work
+func (e *ProgressEntry) Ack() {
+	e.queue.m.Lock()
+	e.outstanding--
+	e.queue.m.Unlock()
+
+	e.queue.advance()
+}
+
+func (q *ProgressQueue) advance() {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for len(q.entries) > 0 && q.entries[0].outstanding <= 0 {
+		entry := q.entries[0]
+		q.entries[0] = nil
+		q.entries = q.entries[1:]
+
+		if entry.commit != nil {
+			entry.commit()
+		}
+	}
+}
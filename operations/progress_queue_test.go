@@ -0,0 +1,69 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/instructure/ddb-sync/operations"
+)
+
+func TestProgressQueueCommitsInOrder(t *testing.T) {
+	queue := &operations.ProgressQueue{}
+	committed := []string{}
+	commit := func(name string) func() {
+		return func() { committed = append(committed, name) }
+	}
+
+	first := queue.Add(2, commit("first"))
+	second := queue.Add(1, commit("second"))
+	queue.Add(0, commit("end"))
+
+	second.Ack()
+	if len(committed) != 0 {
+		t.Fatalf("Expected nothing committed while the first entry is outstanding, got %v", committed)
+	}
+
+	first.Ack()
+	if len(committed) != 0 {
+		t.Fatalf("Expected nothing committed while the first entry is partially acknowledged, got %v", committed)
+	}
+
+	first.Ack()
+	expected := []string{"first", "second", "end"}
+	if !reflect.DeepEqual(committed, expected) {
+		t.Errorf("Expected commits %v, got %v", expected, committed)
+	}
+
+	if queue.Len() != 0 {
+		t.Errorf("Expected an empty queue, %d entries remain", queue.Len())
+	}
+}
+
+func TestProgressQueueEmptyEntryCommitsImmediately(t *testing.T) {
+	queue := &operations.ProgressQueue{}
+	committed := false
+
+	queue.Add(0, func() { committed = true })
+
+	if !committed {
+		t.Errorf("Expected an entry without work to commit immediately")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// checkProjection verifies a projection expression keeps the table's key
+// attributes, which every item written to the output table needs
+func checkProjection(expression string, names map[string]string, keySchema []*dynamodb.KeySchemaElement) error {
+	projected := projectedAttributes(expression, names)
+
+	var missing []string
+	for _, key := range keySchema {
+		if name := aws.StringValue(key.AttributeName); !projected[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("projection expression must include the key attributes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// projectedAttributes returns the whole top level attributes a projection
+// expression names, resolving expression attribute names.  Nested paths only
+// project part of an attribute and aren't included.
+func projectedAttributes(expression string, names map[string]string) map[string]bool {
+	attributes := make(map[string]bool)
+	for _, path := range strings.Split(expression, ",") {
+		path = strings.TrimSpace(path)
+		if strings.ContainsAny(path, ".[") {
+			continue
+		}
+		if name, ok := names[path]; ok {
+			path = name
+		}
+		attributes[path] = true
+	}
+	return attributes
+}
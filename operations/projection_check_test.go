@@ -0,0 +1,47 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestCheckProjection(t *testing.T) {
+	keySchema := []*dynamodb.KeySchemaElement{
+		{AttributeName: aws.String("tenant"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+	}
+	names := map[string]string{"#t": "tenant"}
+
+	if err := checkProjection("#t, id, profile.name, tags[0]", names, keySchema); err != nil {
+		t.Errorf("Expected a projection of both keys to pass, got %v", err)
+	}
+
+	err := checkProjection("tenant,profile", nil, keySchema)
+	if err == nil || err.Error() != "projection expression must include the key attributes: id" {
+		t.Errorf("Expected the missing id key to be reported, got %v", err)
+	}
+
+	if err := checkProjection("#t.id, id", names, keySchema); err == nil {
+		t.Errorf("Expected a nested path to not count as the key attribute")
+	}
+}
@@ -102,6 +102,13 @@ func (t *RateTracker) RatePerSecond() string {
 	return fmt.Sprintf("%.f %s/s", t.lastRate, t.rateType)
 }
 
+// Rate returns the rate per second from the last completed window
+func (t *RateTracker) Rate() float64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.lastRate
+}
+
 // Duration the duration since we started
 func (t *RateTracker) Duration() time.Duration {
 	return time.Since(t.startTime).Round(time.Second)
@@ -0,0 +1,329 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/report"
+	"github.com/instructure/ddb-sync/status"
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// RepairOperation rewrites the items a verification found differing.  The
+// differences are read from a verify report, or found by comparing the
+// tables inline, and each item is reread from the source table and written
+// in batches the way the backfill writes.
+type RepairOperation struct {
+	OperationPlan     config.OperationPlan
+	context           context.Context
+	contextCancelFunc context.CancelFunc
+
+	c chan *report.ItemDiff
+
+	// set when there's no report to repair from
+	verify *VerifyOperation
+
+	fetcher *itemFetcher
+	sender  *batchSender
+
+	// limit the capacity the repair reads and writes to the plan-wide limits
+	readLimit  capacityLimit
+	writeLimit capacityLimit
+
+	repairing Phase
+
+	putCount     int64
+	deleteCount  int64
+	skippedCount int64
+
+	rcuRateTracker         *RateTracker
+	wcuRateTracker         *RateTracker
+	writtenItemRateTracker *RateTracker
+}
+
+func NewRepairOperation(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*RepairOperation, error) {
+	inputSession, outputSession, err := plan.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	o := &RepairOperation{
+		OperationPlan:     plan,
+		context:           ctx,
+		contextCancelFunc: cancelFunc,
+
+		c: make(chan *report.ItemDiff, recordChanBuffer),
+
+		rcuRateTracker:         NewRateTracker("RCUs", 9*time.Second),
+		wcuRateTracker:         NewRateTracker("WCUs", 9*time.Second),
+		writtenItemRateTracker: NewRateTracker("Written Items", 9*time.Second),
+
+		readLimit:  readLimit(plan, 0),
+		writeLimit: writeLimit(plan, 0),
+	}
+
+	o.fetcher = &itemFetcher{
+		context:   ctx,
+		client:    dynamodb.New(inputSession),
+		tableName: plan.Input.TableName,
+		limit:     o.readLimit,
+		onRead:    o.updateReadCapacity,
+	}
+
+	o.sender = &batchSender{
+		context:   ctx,
+		client:    dynamodb.New(outputSession),
+		tableName: plan.Output.TableName,
+		limit:     o.writeLimit,
+		onWrite: func(items int, capacities []*dynamodb.ConsumedCapacity) {
+			o.writtenItemRateTracker.Increment(int64(items))
+			o.updateWriteCapacity(capacities)
+		},
+	}
+
+	if plan.Repair.ReportFile == "" {
+		o.verify, err = NewVerifyOperation(ctx, plan, cancelFunc)
+		if err != nil {
+			return nil, err
+		}
+		o.verify.onDiff = o.enqueue
+	}
+
+	return o, nil
+}
+
+func (o *RepairOperation) Preflights(in *dynamodb.DescribeTableOutput, out *dynamodb.DescribeTableOutput) error {
+	if o.verify != nil {
+		return o.verify.Preflights(in, out)
+	}
+	return nil
+}
+
+func (o *RepairOperation) Run() error {
+	o.repairing.Start()
+	if o.verify != nil {
+		log.Printf("%s: Repair started, comparing the tables…", o.OperationPlan.Description())
+	} else {
+		log.Printf("%s: Repair started from %s…", o.OperationPlan.Description(), o.OperationPlan.Repair.ReportFile)
+	}
+
+	o.rcuRateTracker.Start()
+	o.wcuRateTracker.Start()
+	o.writtenItemRateTracker.Start()
+
+	defer o.rcuRateTracker.Stop()
+	defer o.wcuRateTracker.Stop()
+	defer o.writtenItemRateTracker.Stop()
+
+	collator := ErrorCollator{
+		Cancel: o.contextCancelFunc,
+	}
+	collator.Register(o.readDiffs)
+	collator.Register(o.repair)
+
+	err := collator.Run()
+	if err == nil {
+		log.Printf("%s: Repair complete: %s over %s", o.OperationPlan.Description(), o.summary(), utils.FormatDuration(o.writtenItemRateTracker.Duration()))
+		o.repairing.Finish()
+		return nil
+	}
+
+	if err != context.Canceled {
+		o.repairing.Error()
+	}
+	return err
+}
+
+// readDiffs queues the differences to repair, from the report or an inline comparison
+func (o *RepairOperation) readDiffs() error {
+	defer close(o.c)
+
+	if o.verify != nil {
+		return o.verify.Run()
+	}
+
+	err := report.Read(o.OperationPlan.Repair.ReportFile, o.enqueue)
+	if err != nil && err != context.Canceled {
+		return fmt.Errorf("%s: Repair failed: (Read report) %v", o.OperationPlan.Description(), err)
+	}
+	return err
+}
+
+func (o *RepairOperation) enqueue(diff *report.ItemDiff) error {
+	select {
+	case o.c <- diff:
+		return nil
+	case <-o.context.Done():
+		return o.context.Err()
+	}
+}
+
+// repair rewrites the queued differences a batch at a time
+func (o *RepairOperation) repair() error {
+	var batch []map[string]*dynamodb.AttributeValue
+	queued := make(map[string]bool)
+
+	for diff := range o.c {
+		// A batch can't write the same key twice
+		key := ItemKey(diff.Key)
+		if queued[key] {
+			continue
+		}
+		queued[key] = true
+		batch = append(batch, diff.Key)
+
+		if len(batch) == batchWriteMaxItems {
+			err := o.flush(batch)
+			if err != nil {
+				return err
+			}
+			batch = nil
+			queued = make(map[string]bool)
+		}
+	}
+
+	return o.flush(batch)
+}
+
+func (o *RepairOperation) flush(keys []map[string]*dynamodb.AttributeValue) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	current, err := o.fetcher.getAll(keys)
+	if err != nil {
+		return o.failed("(Read source)", err)
+	}
+
+	requests, skipped := repairRequests(keys, current, o.OperationPlan.Repair.DeleteExtra)
+	atomic.AddInt64(&o.skippedCount, int64(skipped))
+	if len(requests) == 0 {
+		return nil
+	}
+
+	err = o.sender.send(requests)
+	if err != nil {
+		return o.failed("(BatchWrite)", err)
+	}
+
+	for _, request := range requests {
+		if request.PutRequest != nil {
+			atomic.AddInt64(&o.putCount, 1)
+		} else {
+			atomic.AddInt64(&o.deleteCount, 1)
+		}
+	}
+	return nil
+}
+
+func (o *RepairOperation) failed(step string, err error) error {
+	err = RequestCanceledCheck(err)
+	if err == context.Canceled {
+		return err
+	}
+	return fmt.Errorf("%s: Repair failed: %s %v", o.OperationPlan.Description(), step, err)
+}
+
+// repairRequests builds a write request for each key from the source table's
+// current items.  Items no longer in the source are deleted when deleteExtra is
+// set and skipped otherwise.
+func repairRequests(keys []map[string]*dynamodb.AttributeValue, current map[string]map[string]*dynamodb.AttributeValue, deleteExtra bool) ([]*dynamodb.WriteRequest, int) {
+	var requests []*dynamodb.WriteRequest
+	skipped := 0
+	for _, key := range keys {
+		item, exists := current[ItemKey(key)]
+		switch {
+		case exists:
+			requests = append(requests, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{Item: item},
+			})
+		case deleteExtra:
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: key},
+			})
+		default:
+			skipped++
+		}
+	}
+	return requests, skipped
+}
+
+func (o *RepairOperation) updateReadCapacity(capacities []*dynamodb.ConsumedCapacity) {
+	o.rcuRateTracker.Increment(capacityUnits(capacities))
+	o.readLimit.Take(capacities...)
+}
+
+func (o *RepairOperation) updateWriteCapacity(capacities []*dynamodb.ConsumedCapacity) {
+	o.wcuRateTracker.Increment(capacityUnits(capacities))
+	o.writeLimit.Take(capacities...)
+}
+
+func capacityUnits(capacities []*dynamodb.ConsumedCapacity) int64 {
+	var agg float64
+	for _, cap := range capacities {
+		if cap != nil && cap.CapacityUnits != nil {
+			agg = agg + *cap.CapacityUnits
+		}
+	}
+	return int64(math.Ceil(agg))
+}
+
+func (o *RepairOperation) summary() string {
+	return fmt.Sprintf("%d put, %d deleted, %d skipped", atomic.LoadInt64(&o.putCount), atomic.LoadInt64(&o.deleteCount), atomic.LoadInt64(&o.skippedCount))
+}
+
+func (o *RepairOperation) Status() string {
+	if o.repairing.Errored() {
+		return erroredMsg
+	}
+	if !o.repairing.Running() && !o.repairing.Complete() {
+		return pendingMsg
+	}
+	if o.verify != nil && o.verify.verifying.Running() {
+		return fmt.Sprintf("%s; %s", o.verify.Status(), o.summary())
+	}
+	return o.summary()
+}
+
+func (o *RepairOperation) Rate() string {
+	if o.repairing.Running() {
+		return fmt.Sprintf("%s %s %s", o.rcuRateTracker.RatePerSecond(), status.BufferStatus(len(o.c), cap(o.c)), o.wcuRateTracker.RatePerSecond())
+	}
+	return ""
+}
+
+func (o *RepairOperation) Checkpoint() string {
+	if o.repairing.Running() {
+		checkpoint := fmt.Sprintf("%s: Repair in progress: %s", o.OperationPlan.Description(), o.summary())
+		if o.verify != nil && o.verify.verifying.Running() {
+			checkpoint = fmt.Sprintf("%s\n%s", o.verify.Checkpoint(), checkpoint)
+		}
+		return checkpoint
+	}
+	return ""
+}
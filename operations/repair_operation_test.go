@@ -0,0 +1,53 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestRepairRequests(t *testing.T) {
+	present := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("present")}}
+	removed := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("removed")}}
+	item := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String("present")},
+		"value": {N: aws.String("1")},
+	}
+	current := map[string]map[string]*dynamodb.AttributeValue{ItemKey(present): item}
+	keys := []map[string]*dynamodb.AttributeValue{present, removed}
+
+	requests, skipped := repairRequests(keys, current, false)
+	if len(requests) != 1 || skipped != 1 {
+		t.Fatalf("Expected 1 request and 1 skipped item, got %d and %d", len(requests), skipped)
+	}
+	if requests[0].PutRequest == nil || *requests[0].PutRequest.Item["value"].N != "1" {
+		t.Errorf("Expected the source item to be put, got %v", requests[0])
+	}
+
+	requests, skipped = repairRequests(keys, current, true)
+	if len(requests) != 2 || skipped != 0 {
+		t.Fatalf("Expected 2 requests and no skipped items, got %d and %d", len(requests), skipped)
+	}
+	if requests[1].DeleteRequest == nil || *requests[1].DeleteRequest.Key["id"].S != "removed" {
+		t.Errorf("Expected the item missing from the source to be deleted, got %v", requests[1])
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/state"
+	"github.com/instructure/ddb-sync/utils"
+)
+
+const (
+	retentionCheckInterval = 30 * time.Second
+
+	// Warn once a backfill is projected to use this much of the stream's
+	// retention, and apply the guard's policy at the critical fraction, leaving
+	// the stream time to catch up
+	retentionWarnFraction     = 0.75
+	retentionCriticalFraction = 0.9
+)
+
+type retentionLevel int
+
+const (
+	retentionOK retentionLevel = iota
+	retentionWarning
+	retentionCritical
+)
+
+// projectBackfill estimates how long a backfill will have run once it
+// completes, from the items written so far and the current write rate
+func projectBackfill(elapsed time.Duration, written, total int64, rate float64) (time.Duration, bool) {
+	if rate <= 0 || total <= 0 {
+		return 0, false
+	}
+
+	remaining := total - written
+	if remaining < 0 {
+		remaining = 0
+	}
+	return elapsed + time.Duration(float64(remaining)/rate*float64(time.Second)), true
+}
+
+func retentionLevelOf(projected time.Duration) retentionLevel {
+	switch {
+	case projected >= time.Duration(retentionCriticalFraction*float64(streamRetention)):
+		return retentionCritical
+	case projected >= time.Duration(retentionWarnFraction*float64(streamRetention)):
+		return retentionWarning
+	}
+	return retentionOK
+}
+
+// retentionGuard watches a backfill that a stream will follow.  The stream
+// starts reading from around when the backfill began, so a backfill that
+// outlasts the stream's retention loses every change trimmed in the meantime.
+type retentionGuard struct {
+	OperationPlan config.OperationPlan
+
+	backfill *BackfillOperation
+	describe *DescribeOperation
+	state    *state.Store
+
+	m         sync.Mutex
+	projected time.Duration
+	level     retentionLevel
+
+	// closed once a critical projection has triggered the policy
+	triggered   chan struct{}
+	triggerOnce sync.Once
+}
+
+func newRetentionGuard(plan config.OperationPlan, backfill *BackfillOperation, describe *DescribeOperation, store *state.Store) *retentionGuard {
+	return &retentionGuard{
+		OperationPlan: plan,
+
+		backfill: backfill,
+		describe: describe,
+		state:    store,
+
+		triggered: make(chan struct{}),
+	}
+}
+
+// Run checks the projection until done is closed or the policy is triggered
+func (g *retentionGuard) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.check()
+		case <-g.triggered:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+func (g *retentionGuard) check() {
+	if !g.backfill.writing.Running() {
+		return
+	}
+
+	// A resumed backfill is projected from when it first began, with the items
+	// its earlier runs wrote
+	elapsed := g.backfill.writtenItemRateTracker.Duration()
+	if startedAt := g.state.BackfillStartedAt(); !startedAt.IsZero() {
+		elapsed = time.Since(startedAt)
+	}
+
+	projected, ok := projectBackfill(elapsed, g.backfill.writtenItemCount(), g.describe.ItemCount(), g.backfill.writtenItemRateTracker.Rate())
+	if !ok {
+		return
+	}
+	level := retentionLevelOf(projected)
+
+	g.m.Lock()
+	escalated := level > g.level
+	g.projected = projected
+	g.level = level
+	warning := g.warning()
+	g.m.Unlock()
+
+	if escalated {
+		log.Printf("[WARNING] %s", warning)
+	}
+	if level == retentionCritical && g.OperationPlan.Backfill.RetentionGuard != config.RetentionGuardWarn {
+		g.triggerOnce.Do(func() {
+			close(g.triggered)
+		})
+	}
+}
+
+// Triggered reports whether a critical projection has triggered the policy
+func (g *retentionGuard) Triggered() bool {
+	select {
+	case <-g.triggered:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status returns a short warning for the status table, or nothing while the projection is safe
+func (g *retentionGuard) Status() string {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if g.level == retentionOK || !g.backfill.writing.Running() {
+		return ""
+	}
+	return fmt.Sprintf("⚠ ETA ~%s of %.fh retention", utils.FormatDuration(g.projected), streamRetention.Hours())
+}
+
+// Checkpoint repeats the warning in each progress update while the projection is unsafe
+func (g *retentionGuard) Checkpoint() string {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if g.level == retentionOK || !g.backfill.writing.Running() {
+		return ""
+	}
+	return "[WARNING] " + g.warning()
+}
+
+// warning must be called with g.m held
+func (g *retentionGuard) warning() string {
+	return fmt.Sprintf("%s: Backfill is projected to take ~%s, stream records older than %.fh are trimmed and their changes will be lost", g.OperationPlan.Description(), utils.FormatDuration(g.projected), streamRetention.Hours())
+}
@@ -0,0 +1,55 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProjectBackfill(t *testing.T) {
+	projected, ok := projectBackfill(time.Hour, 1000, 5000, 2)
+	if !ok {
+		t.Fatalf("Expected a projection")
+	}
+	if expected := time.Hour + 2000*time.Second; projected != expected {
+		t.Errorf("Expected %s, got %s", expected, projected)
+	}
+
+	if _, ok := projectBackfill(time.Hour, 1000, 5000, 0); ok {
+		t.Errorf("Expected no projection without a write rate")
+	}
+	if projected, _ := projectBackfill(time.Hour, 6000, 5000, 2); projected != time.Hour {
+		t.Errorf("Expected a backfill past the approximate item count to be nearly done, got %s", projected)
+	}
+}
+
+func TestRetentionLevelOf(t *testing.T) {
+	cases := map[time.Duration]retentionLevel{
+		12 * time.Hour: retentionOK,
+		19 * time.Hour: retentionWarning,
+		22 * time.Hour: retentionCritical,
+		30 * time.Hour: retentionCritical,
+	}
+	for projected, expected := range cases {
+		if level := retentionLevelOf(projected); level != expected {
+			t.Errorf("Projection %s: expected level %d, got %d", projected, expected, level)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// schemaDifference is a way the output table's schema differs from the input
+// table's.  Fatal differences would fail writes, the others leave the output
+// table behaving differently once it's in use.
+type schemaDifference struct {
+	Fatal       bool
+	Description string
+}
+
+func (d schemaDifference) String() string {
+	if d.Fatal {
+		return "[FATAL]   " + d.Description
+	}
+	return "[WARNING] " + d.Description
+}
+
+// compareSchemas compares the key schemas, attribute definitions, secondary
+// indexes, and time to live of two tables.  Time to live isn't compared when
+// either description is nil.
+func compareSchemas(in, out *dynamodb.TableDescription, inTTL, outTTL *dynamodb.TimeToLiveDescription) []schemaDifference {
+	var differences []schemaDifference
+	add := func(fatal bool, format string, args ...interface{}) {
+		differences = append(differences, schemaDifference{Fatal: fatal, Description: fmt.Sprintf(format, args...)})
+	}
+
+	if inKeys, outKeys := keySchemaString(in.KeySchema), keySchemaString(out.KeySchema); inKeys != outKeys {
+		add(true, "key schema: (%s) on the input table, (%s) on the output table", inKeys, outKeys)
+	}
+
+	// Writes fail when an item's attribute doesn't match the type of a key
+	// attribute, so types that differ are fatal
+	inAttributes, outAttributes := attributeTypes(in.AttributeDefinitions), attributeTypes(out.AttributeDefinitions)
+	for _, name := range attributeNames(inAttributes, outAttributes) {
+		inType, inDefined := inAttributes[name]
+		outType, outDefined := outAttributes[name]
+		switch {
+		case !outDefined:
+			add(false, "attribute %q: defined as %s on the input table only", name, inType)
+		case !inDefined:
+			add(false, "attribute %q: defined as %s on the output table only", name, outType)
+		case inType != outType:
+			add(true, "attribute %q: %s on the input table, %s on the output table", name, inType, outType)
+		}
+	}
+
+	inGlobal, outGlobal := globalIndexes(in), globalIndexes(out)
+	for _, name := range indexNames(inGlobal, outGlobal) {
+		compareIndex(add, "global secondary index", name, inGlobal[name], outGlobal[name], "")
+	}
+
+	inLocal, outLocal := localIndexes(in), localIndexes(out)
+	for _, name := range indexNames(inLocal, outLocal) {
+		compareIndex(add, "local secondary index", name, inLocal[name], outLocal[name], ", local indexes can only be added when a table is created")
+	}
+
+	if inTTL != nil && outTTL != nil {
+		inAttribute, outAttribute := ttlAttribute(inTTL), ttlAttribute(outTTL)
+		switch {
+		case inAttribute == outAttribute:
+		case outAttribute == "":
+			add(false, "time to live: on attribute %q on the input table, disabled on the output table", inAttribute)
+		case inAttribute == "":
+			add(false, "time to live: disabled on the input table, on attribute %q on the output table", outAttribute)
+		default:
+			add(false, "time to live: on attribute %q on the input table, %q on the output table", inAttribute, outAttribute)
+		}
+	}
+
+	return differences
+}
+
+// indexSchema is the part of a secondary index that decides which items it holds
+type indexSchema struct {
+	keys       string
+	projection string
+}
+
+func compareIndex(add func(bool, string, ...interface{}), kind, name string, in, out *indexSchema, missingNote string) {
+	switch {
+	case out == nil:
+		add(false, "%s %q: missing from the output table%s", kind, name, missingNote)
+	case in == nil:
+		add(false, "%s %q: on the output table only", kind, name)
+	default:
+		if in.keys != out.keys {
+			add(false, "%s %q: key schema (%s) on the input table, (%s) on the output table", kind, name, in.keys, out.keys)
+		}
+		if in.projection != out.projection {
+			add(false, "%s %q: projects %s on the input table, %s on the output table", kind, name, in.projection, out.projection)
+		}
+	}
+}
+
+func globalIndexes(table *dynamodb.TableDescription) map[string]*indexSchema {
+	indexes := make(map[string]*indexSchema)
+	for _, index := range table.GlobalSecondaryIndexes {
+		indexes[aws.StringValue(index.IndexName)] = &indexSchema{keys: keySchemaString(index.KeySchema), projection: projectionString(index.Projection)}
+	}
+	return indexes
+}
+
+func localIndexes(table *dynamodb.TableDescription) map[string]*indexSchema {
+	indexes := make(map[string]*indexSchema)
+	for _, index := range table.LocalSecondaryIndexes {
+		indexes[aws.StringValue(index.IndexName)] = &indexSchema{keys: keySchemaString(index.KeySchema), projection: projectionString(index.Projection)}
+	}
+	return indexes
+}
+
+func keySchemaString(keySchema []*dynamodb.KeySchemaElement) string {
+	elements := make([]string, len(keySchema))
+	for i, element := range keySchema {
+		elements[i] = fmt.Sprintf("%s %s", aws.StringValue(element.AttributeName), aws.StringValue(element.KeyType))
+	}
+	return strings.Join(elements, ", ")
+}
+
+func projectionString(projection *dynamodb.Projection) string {
+	if projection == nil {
+		return "nothing"
+	}
+
+	projectionType := aws.StringValue(projection.ProjectionType)
+	if len(projection.NonKeyAttributes) == 0 {
+		return projectionType
+	}
+
+	attributes := aws.StringValueSlice(projection.NonKeyAttributes)
+	sort.Strings(attributes)
+	return fmt.Sprintf("%s (%s)", projectionType, strings.Join(attributes, ", "))
+}
+
+func attributeTypes(definitions []*dynamodb.AttributeDefinition) map[string]string {
+	types := make(map[string]string, len(definitions))
+	for _, definition := range definitions {
+		types[aws.StringValue(definition.AttributeName)] = aws.StringValue(definition.AttributeType)
+	}
+	return types
+}
+
+// ttlAttribute returns the time to live attribute, or "" when it's disabled
+func ttlAttribute(description *dynamodb.TimeToLiveDescription) string {
+	switch aws.StringValue(description.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return aws.StringValue(description.AttributeName)
+	}
+	return ""
+}
+
+func attributeNames(in, out map[string]string) []string {
+	names := make(map[string]bool)
+	for name := range in {
+		names[name] = true
+	}
+	for name := range out {
+		names[name] = true
+	}
+	return sortedNames(names)
+}
+
+func indexNames(in, out map[string]*indexSchema) []string {
+	names := make(map[string]bool)
+	for name := range in {
+		names[name] = true
+	}
+	for name := range out {
+		names[name] = true
+	}
+	return sortedNames(names)
+}
+
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,66 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func ttl(attribute string) *dynamodb.TimeToLiveDescription {
+	if attribute == "" {
+		return &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled)}
+	}
+	return &dynamodb.TimeToLiveDescription{AttributeName: aws.String(attribute), TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusEnabled)}
+}
+
+func TestCompareSchemasMatching(t *testing.T) {
+	differences := compareSchemas(testTable("by-email"), testTable("by-email"), ttl("expires"), ttl("expires"))
+	if len(differences) != 0 {
+		t.Errorf("Expected no differences, got %v", differences)
+	}
+}
+
+func TestCompareSchemasWarnings(t *testing.T) {
+	differences := compareSchemas(testTable("by-email"), testTable(), ttl("expires"), ttl(""))
+	if len(differences) != 2 {
+		t.Fatalf("Expected 2 differences, got %v", differences)
+	}
+	for _, difference := range differences {
+		if difference.Fatal {
+			t.Errorf("Expected only warnings, got %s", difference)
+		}
+	}
+	if expected := "[WARNING] global secondary index \"by-email\": missing from the output table"; differences[0].String() != expected {
+		t.Errorf("Expected %q, got %q", expected, differences[0])
+	}
+}
+
+func TestCompareSchemasFatal(t *testing.T) {
+	out := testTable("by-email")
+	out.AttributeDefinitions[1].AttributeType = aws.String("N")
+	out.KeySchema = append(out.KeySchema, &dynamodb.KeySchemaElement{AttributeName: aws.String("email"), KeyType: aws.String("RANGE")})
+
+	differences := compareSchemas(testTable("by-email"), out, nil, nil)
+	if len(differences) != 2 || !differences[0].Fatal || !differences[1].Fatal {
+		t.Errorf("Expected fatal key schema and attribute type differences, got %v", differences)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SegmentedScanner scans a table in parallel segments.  Each segment is read by
+// its own scanner, which hands the pages it reads to a handler in order.
+type SegmentedScanner struct {
+	Context   context.Context
+	Client    *dynamodb.DynamoDB
+	TableName string
+
+	// The table is scanned as a single segment when TotalSegments is below 1
+	TotalSegments int
+
+	// The segments to scan, every segment when empty
+	Segments []int
+
+	ConsistentRead bool
+
+	// Passed to every scan request when set
+	FilterExpression          string
+	ProjectionExpression      string
+	ExpressionAttributeNames  map[string]*string
+	ExpressionAttributeValues map[string]*dynamodb.AttributeValue
+
+	// PageSize returns the most items to read in each segment's next page,
+	// pages are only limited by size when it's nil or returns 0
+	PageSize func() int64
+
+	// StartKey returns the key to resume a segment after and whether the
+	// segment is already complete.  Segments start from the beginning without it.
+	StartKey func(segment int) (map[string]*dynamodb.AttributeValue, bool)
+
+	// PageHandler returns the handler for a segment's pages, handlers return
+	// false to stop scanning the segment
+	PageHandler func(segment int) func(output *dynamodb.ScanOutput) bool
+}
+
+// Scanners returns a function to scan each segment, meant to be registered with an ErrorCollator
+func (s *SegmentedScanner) Scanners() []func() error {
+	var scanners []func() error
+	for _, segment := range s.segmentIndexes() {
+		scanners = append(scanners, s.scanner(segment))
+	}
+	return scanners
+}
+
+func (s *SegmentedScanner) segmentIndexes() []int {
+	if s.TotalSegments < 1 {
+		return []int{0}
+	}
+
+	// If segment indexes are provided, run those segments
+	if len(s.Segments) > 0 {
+		return s.Segments
+	}
+
+	segments := make([]int, s.TotalSegments)
+	for i := range segments {
+		segments[i] = i
+	}
+	return segments
+}
+
+func (s *SegmentedScanner) scanner(segment int) func() error {
+	return func() error {
+		input := &dynamodb.ScanInput{
+			ReturnConsumedCapacity: aws.String("TOTAL"),
+			TableName:              aws.String(s.TableName),
+		}
+		if s.TotalSegments > 1 {
+			input.Segment = aws.Int64(int64(segment))
+			input.TotalSegments = aws.Int64(int64(s.TotalSegments))
+		}
+		if s.ConsistentRead {
+			input.ConsistentRead = aws.Bool(true)
+		}
+		if s.FilterExpression != "" {
+			input.FilterExpression = aws.String(s.FilterExpression)
+		}
+		if s.ProjectionExpression != "" {
+			input.ProjectionExpression = aws.String(s.ProjectionExpression)
+		}
+		if len(s.ExpressionAttributeNames) > 0 {
+			input.ExpressionAttributeNames = s.ExpressionAttributeNames
+		}
+		if len(s.ExpressionAttributeValues) > 0 {
+			input.ExpressionAttributeValues = s.ExpressionAttributeValues
+		}
+
+		if s.StartKey != nil {
+			startKey, complete := s.StartKey(segment)
+			if complete {
+				return nil
+			}
+			input.ExclusiveStartKey = startKey
+		}
+
+		handler := s.PageHandler(segment)
+		for {
+			input.Limit = nil
+			if s.PageSize != nil {
+				if pageSize := s.PageSize(); pageSize > 0 {
+					input.Limit = aws.Int64(pageSize)
+				}
+			}
+
+			output, err := s.Client.ScanWithContext(s.Context, input)
+			if err != nil {
+				select {
+				case <-s.Context.Done():
+					return s.Context.Err()
+				default:
+					return err
+				}
+			}
+
+			if !handler(output) || len(output.LastEvaluatedKey) == 0 {
+				break
+			}
+			input.ExclusiveStartKey = output.LastEvaluatedKey
+		}
+
+		select {
+		case <-s.Context.Done():
+			return s.Context.Err()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,516 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TagResource accepts at most this many tags
+const tagResourceMaxTags = 50
+
+// Tag keys reserved for AWS services, which TagResource rejects
+const awsTagPrefix = "aws:"
+
+// settingChange is a change that makes one of the output table's settings
+// match the input table's
+type settingChange struct {
+	Description string
+
+	apply func() error
+}
+
+// SettingsOperation copies the input table's time to live, tags, point in
+// time recovery, and auto scaling to the output table.  Settings only on the
+// output table are left alone, except that time to live and point in time
+// recovery are disabled when they are off on the input table.
+type SettingsOperation struct {
+	OperationPlan     config.OperationPlan
+	context           context.Context
+	contextCancelFunc context.CancelFunc
+
+	inputClient  *dynamodb.DynamoDB
+	outputClient *dynamodb.DynamoDB
+
+	inputScaling  *applicationautoscaling.ApplicationAutoScaling
+	outputScaling *applicationautoscaling.ApplicationAutoScaling
+
+	// the table descriptions, set by the preflights
+	input  *dynamodb.TableDescription
+	output *dynamodb.TableDescription
+
+	syncing Phase
+
+	changeCount  int64
+	appliedCount int64
+}
+
+func NewSettingsOperation(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*SettingsOperation, error) {
+	inputSession, outputSession, err := plan.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SettingsOperation{
+		OperationPlan:     plan,
+		context:           ctx,
+		contextCancelFunc: cancelFunc,
+
+		inputClient:  dynamodb.New(inputSession),
+		outputClient: dynamodb.New(outputSession),
+
+		inputScaling:  applicationautoscaling.New(inputSession),
+		outputScaling: applicationautoscaling.New(outputSession),
+	}, nil
+}
+
+func (o *SettingsOperation) Preflights(in *dynamodb.DescribeTableOutput, out *dynamodb.DescribeTableOutput) error {
+	o.input = in.Table
+	o.output = out.Table
+	return nil
+}
+
+func (o *SettingsOperation) Run() error {
+	o.syncing.Start()
+
+	changes, err := o.changes()
+	if err != nil {
+		return o.failed(err)
+	}
+	atomic.StoreInt64(&o.changeCount, int64(len(changes)))
+
+	if len(changes) == 0 {
+		log.Printf("%s: Settings already match", o.OperationPlan.Description())
+		o.syncing.Finish()
+		return nil
+	}
+
+	if o.OperationPlan.Settings.DryRun {
+		lines := []string{fmt.Sprintf("%s: Settings dry run, %d changes would be made:", o.OperationPlan.Description(), len(changes))}
+		for _, change := range changes {
+			lines = append(lines, "  "+change.Description)
+		}
+		log.Printf("%s", strings.Join(lines, "\n"))
+		o.syncing.Finish()
+		return nil
+	}
+
+	for _, change := range changes {
+		err := change.apply()
+		if err != nil {
+			return o.failed(fmt.Errorf("(%s) %v", change.Description, err))
+		}
+		atomic.AddInt64(&o.appliedCount, 1)
+		log.Printf("%s: Settings: %s", o.OperationPlan.Description(), change.Description)
+	}
+
+	log.Printf("%s: Settings sync complete: %d changes made", o.OperationPlan.Description(), len(changes))
+	o.syncing.Finish()
+	return nil
+}
+
+func (o *SettingsOperation) failed(err error) error {
+	err = RequestCanceledCheck(err)
+	if err == context.Canceled {
+		return err
+	}
+	o.syncing.Error()
+	return fmt.Errorf("%s: Settings sync failed: %v", o.OperationPlan.Description(), err)
+}
+
+// changes returns the changes the output table needs
+func (o *SettingsOperation) changes() ([]settingChange, error) {
+	var changes []settingChange
+	for _, settingChanges := range []func() ([]settingChange, error){o.ttlChanges, o.tagChanges, o.backupChanges, o.scalingChanges} {
+		found, err := settingChanges()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, found...)
+	}
+	return changes, nil
+}
+
+func (o *SettingsOperation) ttlChanges() ([]settingChange, error) {
+	in, err := o.inputClient.DescribeTimeToLiveWithContext(o.context, &dynamodb.DescribeTimeToLiveInput{TableName: o.input.TableName})
+	if err != nil {
+		return nil, err
+	}
+	out, err := o.outputClient.DescribeTimeToLiveWithContext(o.context, &dynamodb.DescribeTimeToLiveInput{TableName: o.output.TableName})
+	if err != nil {
+		return nil, err
+	}
+
+	return o.diffTTL(ttlAttribute(in.TimeToLiveDescription), ttlAttribute(out.TimeToLiveDescription)), nil
+}
+
+// diffTTL returns the change moving the output table's time to live attribute,
+// "" when disabled, to the input table's
+func (o *SettingsOperation) diffTTL(inAttribute, outAttribute string) []settingChange {
+	switch {
+	case inAttribute == outAttribute:
+		return nil
+	case outAttribute != "" && inAttribute != "":
+		// Time to live can't move straight to another attribute, and can only be
+		// changed once an hour
+		return []settingChange{o.ttlChange(fmt.Sprintf("time to live: disable on %q, sync again in an hour to enable it on %q", outAttribute, inAttribute), outAttribute, false)}
+	case inAttribute == "":
+		return []settingChange{o.ttlChange(fmt.Sprintf("time to live: disable on %q", outAttribute), outAttribute, false)}
+	default:
+		return []settingChange{o.ttlChange(fmt.Sprintf("time to live: enable on %q", inAttribute), inAttribute, true)}
+	}
+}
+
+func (o *SettingsOperation) ttlChange(description, attribute string, enabled bool) settingChange {
+	return settingChange{
+		Description: description,
+		apply: func() error {
+			_, err := o.outputClient.UpdateTimeToLiveWithContext(o.context, &dynamodb.UpdateTimeToLiveInput{
+				TableName: o.output.TableName,
+				TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+					AttributeName: aws.String(attribute),
+					Enabled:       aws.Bool(enabled),
+				},
+			})
+			return err
+		},
+	}
+}
+
+func (o *SettingsOperation) tagChanges() ([]settingChange, error) {
+	in, err := o.listTags(o.inputClient, o.input.TableArn)
+	if err != nil {
+		return nil, err
+	}
+	out, err := o.listTags(o.outputClient, o.output.TableArn)
+	if err != nil {
+		return nil, err
+	}
+	return o.diffTags(in, out), nil
+}
+
+// diffTags returns the changes setting the input table's tags on the output
+// table, in batches of the most TagResource accepts
+func (o *SettingsOperation) diffTags(in, out map[string]string) []settingChange {
+	var keys []string
+	for key, value := range in {
+		// AWS services tag their resources with reserved keys that can't be set
+		if strings.HasPrefix(key, awsTagPrefix) {
+			continue
+		}
+		if current, ok := out[key]; !ok || current != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []settingChange
+	for start := 0; start < len(keys); start += tagResourceMaxTags {
+		end := start + tagResourceMaxTags
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var tags []*dynamodb.Tag
+		var descriptions []string
+		for _, key := range keys[start:end] {
+			tags = append(tags, &dynamodb.Tag{Key: aws.String(key), Value: aws.String(in[key])})
+			descriptions = append(descriptions, fmt.Sprintf("%s=%s", key, in[key]))
+		}
+
+		changes = append(changes, settingChange{
+			Description: fmt.Sprintf("tags: set %s", strings.Join(descriptions, ", ")),
+			apply: func() error {
+				_, err := o.outputClient.TagResourceWithContext(o.context, &dynamodb.TagResourceInput{ResourceArn: o.output.TableArn, Tags: tags})
+				return err
+			},
+		})
+	}
+	return changes
+}
+
+func (o *SettingsOperation) listTags(client *dynamodb.DynamoDB, tableArn *string) (map[string]string, error) {
+	tags := make(map[string]string)
+	input := &dynamodb.ListTagsOfResourceInput{ResourceArn: tableArn}
+	for {
+		output, err := client.ListTagsOfResourceWithContext(o.context, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range output.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+
+		if output.NextToken == nil {
+			return tags, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+func (o *SettingsOperation) backupChanges() ([]settingChange, error) {
+	in, err := o.pointInTimeRecovery(o.inputClient, o.input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	out, err := o.pointInTimeRecovery(o.outputClient, o.output.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return o.diffBackups(in, out), nil
+}
+
+// diffBackups returns the change matching the output table's point in time
+// recovery to the input table's
+func (o *SettingsOperation) diffBackups(in, out bool) []settingChange {
+	if in == out {
+		return nil
+	}
+
+	description := "point in time recovery: disable"
+	if in {
+		description = "point in time recovery: enable"
+	}
+	return []settingChange{{
+		Description: description,
+		apply: func() error {
+			_, err := o.outputClient.UpdateContinuousBackupsWithContext(o.context, &dynamodb.UpdateContinuousBackupsInput{
+				TableName:                        o.output.TableName,
+				PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{PointInTimeRecoveryEnabled: aws.Bool(in)},
+			})
+			return err
+		},
+	}}
+}
+
+func (o *SettingsOperation) pointInTimeRecovery(client *dynamodb.DynamoDB, tableName *string) (bool, error) {
+	output, err := client.DescribeContinuousBackupsWithContext(o.context, &dynamodb.DescribeContinuousBackupsInput{TableName: tableName})
+	if err != nil {
+		return false, err
+	}
+
+	backups := output.ContinuousBackupsDescription
+	if backups == nil || backups.PointInTimeRecoveryDescription == nil {
+		return false, nil
+	}
+	return aws.StringValue(backups.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus) == dynamodb.PointInTimeRecoveryStatusEnabled, nil
+}
+
+// scalingChanges registers the input table's scalable targets and target
+// tracking policies, for the table and its global secondary indexes, on the
+// output table
+func (o *SettingsOperation) scalingChanges() ([]settingChange, error) {
+	resourceIds := scalingResourceIds(o.input, o.output)
+
+	var inIds, outIds []*string
+	for inId, outId := range resourceIds {
+		inIds = append(inIds, aws.String(inId))
+		outIds = append(outIds, aws.String(outId))
+	}
+
+	inTargets, err := o.scalableTargets(o.inputScaling, inIds)
+	if err != nil {
+		return nil, err
+	}
+	outTargets, err := o.scalableTargets(o.outputScaling, outIds)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := o.diffTargets(resourceIds, inTargets, outTargets)
+	for inId, outId := range resourceIds {
+		inPolicies, err := o.scalingPolicies(o.inputScaling, inId)
+		if err != nil {
+			return nil, err
+		}
+		outPolicies, err := o.scalingPolicies(o.outputScaling, outId)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, o.diffPolicies(inId, outId, inPolicies, outPolicies)...)
+	}
+
+	// Ranging over the resources isn't ordered
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Description < changes[j].Description })
+	return changes, nil
+}
+
+// scalingResourceIds maps the input table's auto scaling resources, the table
+// and the global secondary indexes both tables have, to the output table's
+func scalingResourceIds(input, output *dynamodb.TableDescription) map[string]string {
+	resourceIds := make(map[string]string)
+	resourceIds[tableResourceId(input.TableName)] = tableResourceId(output.TableName)
+
+	outputIndexes := globalIndexes(output)
+	for name := range globalIndexes(input) {
+		if outputIndexes[name] == nil {
+			continue
+		}
+		resourceIds[indexResourceId(input.TableName, name)] = indexResourceId(output.TableName, name)
+	}
+	return resourceIds
+}
+
+// diffTargets returns the changes registering the input table's scalable
+// targets on the output table's resources where their capacities differ
+func (o *SettingsOperation) diffTargets(resourceIds map[string]string, inTargets, outTargets map[string]*applicationautoscaling.ScalableTarget) []settingChange {
+	var changes []settingChange
+	for _, target := range inTargets {
+		outId := resourceIds[aws.StringValue(target.ResourceId)]
+		current := outTargets[scalingKey(outId, target.ScalableDimension)]
+		if current != nil && aws.Int64Value(current.MinCapacity) == aws.Int64Value(target.MinCapacity) && aws.Int64Value(current.MaxCapacity) == aws.Int64Value(target.MaxCapacity) {
+			continue
+		}
+		changes = append(changes, o.targetChange(outId, target))
+	}
+	return changes
+}
+
+// diffPolicies returns the changes putting a resource's target tracking
+// policies on the output table's resource where they differ
+func (o *SettingsOperation) diffPolicies(inId, outId string, inPolicies, outPolicies map[string]*applicationautoscaling.ScalingPolicy) []settingChange {
+	var changes []settingChange
+	for _, policy := range inPolicies {
+		if aws.StringValue(policy.PolicyType) != applicationautoscaling.PolicyTypeTargetTrackingScaling {
+			log.Printf("[WARNING] %s: Settings: auto scaling policy %q on %s isn't copied, only target tracking policies are", o.OperationPlan.Description(), aws.StringValue(policy.PolicyName), inId)
+			continue
+		}
+
+		current := outPolicies[aws.StringValue(policy.PolicyName)]
+		if current != nil && aws.StringValue(current.ScalableDimension) == aws.StringValue(policy.ScalableDimension) && reflect.DeepEqual(current.TargetTrackingScalingPolicyConfiguration, policy.TargetTrackingScalingPolicyConfiguration) {
+			continue
+		}
+		changes = append(changes, o.policyChange(outId, policy))
+	}
+	return changes
+}
+
+func (o *SettingsOperation) targetChange(resourceId string, target *applicationautoscaling.ScalableTarget) settingChange {
+	return settingChange{
+		Description: fmt.Sprintf("auto scaling: %s %s between %d and %d", resourceId, aws.StringValue(target.ScalableDimension), aws.Int64Value(target.MinCapacity), aws.Int64Value(target.MaxCapacity)),
+		apply: func() error {
+			_, err := o.outputScaling.RegisterScalableTargetWithContext(o.context, &applicationautoscaling.RegisterScalableTargetInput{
+				ServiceNamespace:  aws.String(applicationautoscaling.ServiceNamespaceDynamodb),
+				ResourceId:        aws.String(resourceId),
+				ScalableDimension: target.ScalableDimension,
+				MinCapacity:       target.MinCapacity,
+				MaxCapacity:       target.MaxCapacity,
+			})
+			return err
+		},
+	}
+}
+
+func (o *SettingsOperation) policyChange(resourceId string, policy *applicationautoscaling.ScalingPolicy) settingChange {
+	return settingChange{
+		Description: fmt.Sprintf("auto scaling: %s policy %q", resourceId, aws.StringValue(policy.PolicyName)),
+		apply: func() error {
+			_, err := o.outputScaling.PutScalingPolicyWithContext(o.context, &applicationautoscaling.PutScalingPolicyInput{
+				ServiceNamespace:  aws.String(applicationautoscaling.ServiceNamespaceDynamodb),
+				ResourceId:        aws.String(resourceId),
+				ScalableDimension: policy.ScalableDimension,
+				PolicyName:        policy.PolicyName,
+				PolicyType:        policy.PolicyType,
+
+				TargetTrackingScalingPolicyConfiguration: policy.TargetTrackingScalingPolicyConfiguration,
+			})
+			return err
+		},
+	}
+}
+
+// scalableTargets returns the scalable targets of resources, keyed by scalingKey
+func (o *SettingsOperation) scalableTargets(client *applicationautoscaling.ApplicationAutoScaling, resourceIds []*string) (map[string]*applicationautoscaling.ScalableTarget, error) {
+	targets := make(map[string]*applicationautoscaling.ScalableTarget)
+	input := &applicationautoscaling.DescribeScalableTargetsInput{
+		ServiceNamespace: aws.String(applicationautoscaling.ServiceNamespaceDynamodb),
+		ResourceIds:      resourceIds,
+	}
+	err := client.DescribeScalableTargetsPagesWithContext(o.context, input, func(output *applicationautoscaling.DescribeScalableTargetsOutput, _ bool) bool {
+		for _, target := range output.ScalableTargets {
+			targets[scalingKey(aws.StringValue(target.ResourceId), target.ScalableDimension)] = target
+		}
+		return true
+	})
+	return targets, err
+}
+
+// scalingPolicies returns the scaling policies of a resource, keyed by name
+func (o *SettingsOperation) scalingPolicies(client *applicationautoscaling.ApplicationAutoScaling, resourceId string) (map[string]*applicationautoscaling.ScalingPolicy, error) {
+	policies := make(map[string]*applicationautoscaling.ScalingPolicy)
+	input := &applicationautoscaling.DescribeScalingPoliciesInput{
+		ServiceNamespace: aws.String(applicationautoscaling.ServiceNamespaceDynamodb),
+		ResourceId:       aws.String(resourceId),
+	}
+	err := client.DescribeScalingPoliciesPagesWithContext(o.context, input, func(output *applicationautoscaling.DescribeScalingPoliciesOutput, _ bool) bool {
+		for _, policy := range output.ScalingPolicies {
+			policies[aws.StringValue(policy.PolicyName)] = policy
+		}
+		return true
+	})
+	return policies, err
+}
+
+func tableResourceId(tableName *string) string {
+	return "table/" + aws.StringValue(tableName)
+}
+
+func indexResourceId(tableName *string, indexName string) string {
+	return fmt.Sprintf("table/%s/index/%s", aws.StringValue(tableName), indexName)
+}
+
+func scalingKey(resourceId string, dimension *string) string {
+	return resourceId + " " + aws.StringValue(dimension)
+}
+
+func (o *SettingsOperation) Status() string {
+	if o.syncing.Errored() {
+		return erroredMsg
+	}
+	if !o.syncing.Running() && !o.syncing.Complete() {
+		return pendingMsg
+	}
+	if o.OperationPlan.Settings.DryRun {
+		return fmt.Sprintf("dry run, %d changes", atomic.LoadInt64(&o.changeCount))
+	}
+	return fmt.Sprintf("%d of %d changes made", atomic.LoadInt64(&o.appliedCount), atomic.LoadInt64(&o.changeCount))
+}
+
+func (o *SettingsOperation) Rate() string {
+	return ""
+}
+
+func (o *SettingsOperation) Checkpoint() string {
+	if o.syncing.Running() {
+		return fmt.Sprintf("%s: Settings sync in progress: %s", o.OperationPlan.Description(), o.Status())
+	}
+	return ""
+}
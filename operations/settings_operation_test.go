@@ -0,0 +1,177 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+)
+
+func changeDescriptions(changes []settingChange) []string {
+	descriptions := make([]string, len(changes))
+	for i, change := range changes {
+		descriptions[i] = change.Description
+	}
+	return descriptions
+}
+
+func TestDiffTTL(t *testing.T) {
+	tests := []struct {
+		in, out  string
+		expected []string
+	}{
+		{"expires", "expires", []string{}},
+		{"", "", []string{}},
+		{"expires", "", []string{`time to live: enable on "expires"`}},
+		{"", "expires", []string{`time to live: disable on "expires"`}},
+		{"expires", "ttl", []string{`time to live: disable on "ttl", sync again in an hour to enable it on "expires"`}},
+	}
+
+	o := &SettingsOperation{}
+	for _, test := range tests {
+		if descriptions := changeDescriptions(o.diffTTL(test.in, test.out)); fmt.Sprint(descriptions) != fmt.Sprint(test.expected) {
+			t.Errorf("Expected %v moving time to live from %q to %q, got %v", test.expected, test.out, test.in, descriptions)
+		}
+	}
+}
+
+func TestDiffTagsSkipsReservedKeys(t *testing.T) {
+	in := map[string]string{
+		"team":                          "data",
+		"env":                           "prod",
+		"aws:cloudformation:stack-name": "tables",
+	}
+	out := map[string]string{"env": "prod"}
+
+	o := &SettingsOperation{}
+	descriptions := changeDescriptions(o.diffTags(in, out))
+	if len(descriptions) != 1 || descriptions[0] != "tags: set team=data" {
+		t.Errorf("Expected only the missing, unreserved tag to be set, got %v", descriptions)
+	}
+
+	if changes := o.diffTags(map[string]string{"aws:cloudformation:stack-id": "arn"}, nil); len(changes) != 0 {
+		t.Errorf("Expected no changes for only reserved tags, got %v", changeDescriptions(changes))
+	}
+}
+
+func TestDiffTagsBatches(t *testing.T) {
+	in := make(map[string]string)
+	for i := 0; i < tagResourceMaxTags+1; i++ {
+		in[fmt.Sprintf("tag-%03d", i)] = "value"
+	}
+
+	o := &SettingsOperation{}
+	if changes := o.diffTags(in, nil); len(changes) != 2 {
+		t.Errorf("Expected the tags to be set in 2 batches, got %d", len(changes))
+	}
+}
+
+func TestDiffBackups(t *testing.T) {
+	o := &SettingsOperation{}
+	if changes := o.diffBackups(true, true); len(changes) != 0 {
+		t.Errorf("Expected no change when point in time recovery matches, got %v", changeDescriptions(changes))
+	}
+	if descriptions := changeDescriptions(o.diffBackups(true, false)); len(descriptions) != 1 || descriptions[0] != "point in time recovery: enable" {
+		t.Errorf("Expected point in time recovery to be enabled, got %v", descriptions)
+	}
+	if descriptions := changeDescriptions(o.diffBackups(false, true)); len(descriptions) != 1 || descriptions[0] != "point in time recovery: disable" {
+		t.Errorf("Expected point in time recovery to be disabled, got %v", descriptions)
+	}
+}
+
+func TestScalingResourceIds(t *testing.T) {
+	input := testTable("by-email", "by-name")
+	input.TableName = aws.String("source")
+	output := testTable("by-email")
+	output.TableName = aws.String("dest")
+
+	resourceIds := scalingResourceIds(input, output)
+	expected := map[string]string{
+		"table/source":                "table/dest",
+		"table/source/index/by-email": "table/dest/index/by-email",
+	}
+	if fmt.Sprint(resourceIds) != fmt.Sprint(expected) {
+		t.Errorf("Expected the table and the indexes both tables have, got %v", resourceIds)
+	}
+}
+
+func scalableTarget(resourceId string, min, max int64) *applicationautoscaling.ScalableTarget {
+	return &applicationautoscaling.ScalableTarget{
+		ResourceId:        aws.String(resourceId),
+		ScalableDimension: aws.String(applicationautoscaling.ScalableDimensionDynamodbTableWriteCapacityUnits),
+		MinCapacity:       aws.Int64(min),
+		MaxCapacity:       aws.Int64(max),
+	}
+}
+
+func TestDiffTargets(t *testing.T) {
+	resourceIds := map[string]string{"table/source": "table/dest", "table/source/index/by-email": "table/dest/index/by-email"}
+	in := map[string]*applicationautoscaling.ScalableTarget{
+		"table":    scalableTarget("table/source", 5, 100),
+		"by-email": scalableTarget("table/source/index/by-email", 5, 50),
+	}
+	out := map[string]*applicationautoscaling.ScalableTarget{}
+	for _, target := range []*applicationautoscaling.ScalableTarget{scalableTarget("table/dest", 5, 100), scalableTarget("table/dest/index/by-email", 5, 20)} {
+		out[scalingKey(*target.ResourceId, target.ScalableDimension)] = target
+	}
+
+	o := &SettingsOperation{}
+	descriptions := changeDescriptions(o.diffTargets(resourceIds, in, out))
+	if len(descriptions) != 1 || descriptions[0] != "auto scaling: table/dest/index/by-email dynamodb:table:WriteCapacityUnits between 5 and 50" {
+		t.Errorf("Expected only the index's differing target to be registered, got %v", descriptions)
+	}
+}
+
+func scalingPolicy(name, policyType string, target float64) *applicationautoscaling.ScalingPolicy {
+	policy := &applicationautoscaling.ScalingPolicy{
+		PolicyName:        aws.String(name),
+		PolicyType:        aws.String(policyType),
+		ScalableDimension: aws.String(applicationautoscaling.ScalableDimensionDynamodbTableWriteCapacityUnits),
+	}
+	if policyType == applicationautoscaling.PolicyTypeTargetTrackingScaling {
+		policy.TargetTrackingScalingPolicyConfiguration = &applicationautoscaling.TargetTrackingScalingPolicyConfiguration{TargetValue: aws.Float64(target)}
+	}
+	return policy
+}
+
+func TestDiffPolicies(t *testing.T) {
+	in := map[string]*applicationautoscaling.ScalingPolicy{
+		"matching": scalingPolicy("matching", applicationautoscaling.PolicyTypeTargetTrackingScaling, 70),
+		"changed":  scalingPolicy("changed", applicationautoscaling.PolicyTypeTargetTrackingScaling, 50),
+		"missing":  scalingPolicy("missing", applicationautoscaling.PolicyTypeTargetTrackingScaling, 70),
+		"stepped":  scalingPolicy("stepped", applicationautoscaling.PolicyTypeStepScaling, 0),
+	}
+	out := map[string]*applicationautoscaling.ScalingPolicy{
+		"matching": scalingPolicy("matching", applicationautoscaling.PolicyTypeTargetTrackingScaling, 70),
+		"changed":  scalingPolicy("changed", applicationautoscaling.PolicyTypeTargetTrackingScaling, 70),
+	}
+
+	o := &SettingsOperation{}
+	changes := o.diffPolicies("table/source", "table/dest", in, out)
+	found := make(map[string]bool)
+	for _, description := range changeDescriptions(changes) {
+		found[description] = true
+	}
+	if len(found) != 2 || !found[`auto scaling: table/dest policy "changed"`] || !found[`auto scaling: table/dest policy "missing"`] {
+		t.Errorf("Expected the changed and missing target tracking policies to be put, got %v", changeDescriptions(changes))
+	}
+}
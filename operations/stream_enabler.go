@@ -0,0 +1,103 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/instructure/ddb-sync/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// streamEnablePollInterval is how often a newly enabled stream is checked until it's ready
+const streamEnablePollInterval = 5 * time.Second
+
+// enableStream turns on a NEW_AND_OLD_IMAGES stream for the input table,
+// records it for the cleanup command, and waits for it to become ENABLED
+func (o *StreamOperation) enableStream(table *dynamodb.TableDescription) (*dynamodb.TableDescription, error) {
+	tableName := aws.StringValue(table.TableName)
+	log.Printf("%s: Enabling a NEW_AND_OLD_IMAGES stream on the input table…", o.OperationPlan.Description())
+
+	output, err := o.sourceClient.UpdateTableWithContext(o.context, &dynamodb.UpdateTableInput{
+		TableName: table.TableName,
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Enable stream operation failed with %v", tableName, err)
+	}
+	streamARN := aws.StringValue(output.TableDescription.LatestStreamArn)
+	if streamARN == "" {
+		return nil, fmt.Errorf("[%s] Fails pre-flight check: no stream was created when enabling it", tableName)
+	}
+
+	// Recorded before waiting so the stream can be cleaned up even if this run goes no further
+	o.state.SetAutoEnabledStream(streamARN)
+	err = o.state.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	describeInput := &dynamodb.DescribeTableInput{TableName: table.TableName}
+	err = o.sourceClient.WaitUntilTableExistsWithContext(o.context, describeInput)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Failed waiting for the table to become active after enabling its stream: %v", tableName, err)
+	}
+
+	description, err := o.sourceClient.DescribeTableWithContext(o.context, describeInput)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Describe table operation failed with %v", tableName, err)
+	}
+
+	err = o.waitForStream(streamARN)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] Failed waiting for the enabled stream: %v", tableName, err)
+	}
+	log.Printf("%s: Stream enabled on the input table, run the cleanup command to disable it once the sync is done", o.OperationPlan.Description())
+
+	return description.Table, nil
+}
+
+// waitForStream polls the stream until its status is ENABLED
+func (o *StreamOperation) waitForStream(streamARN string) error {
+	for {
+		output, err := o.inputClient.DescribeStreamWithContext(o.context, &dynamodbstreams.DescribeStreamInput{
+			StreamArn: aws.String(streamARN),
+			Limit:     aws.Int64(1),
+		})
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(output.StreamDescription.StreamStatus) == dynamodbstreams.StreamStatusEnabled {
+			return nil
+		}
+
+		select {
+		case <-time.After(streamEnablePollInterval):
+		case <-o.context.Done():
+			return o.context.Err()
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/shard_tree"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+var errRebackfillRequired = errors.New("Stream data was trimmed, a backfill is required")
+
+// shardPosition is the last record delivered from a shard
+type shardPosition struct {
+	shard *shard_tree.Shard
+
+	sequenceNumber string
+	created        time.Time
+
+	// set for a shard present at startup when starting at latest, which is
+	// opened at LATEST until a record is delivered from it
+	atLatest bool
+
+	// when the shard was first opened at LATEST.  Opening it at LATEST again
+	// would skip the records created since, so it's read from the trim
+	// horizon instead, skipping the records created before.
+	openedAtLatest time.Time
+}
+
+func (p *shardPosition) delivered(record *dynamodbstreams.Record) {
+	p.sequenceNumber = *record.Dynamodb.SequenceNumber
+	p.created = *record.Dynamodb.ApproximateCreationDateTime
+}
+
+// skipped reports whether a record was created before the shard was first
+// opened at LATEST, once it's read from the trim horizon instead
+func (p *shardPosition) skipped(record *dynamodbstreams.Record) bool {
+	return !p.openedAtLatest.IsZero() && record.Dynamodb.ApproximateCreationDateTime.Before(p.openedAtLatest)
+}
+
+// shardIterator opens a shard after the last delivered record, or at the
+// configured start position if no record has been delivered
+func (o *StreamOperation) shardIterator(position *shardPosition) (*string, error) {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         &o.streamARN,
+		ShardId:           &position.shard.Id,
+		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
+	}
+
+	if position.sequenceNumber != "" {
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		input.SequenceNumber = aws.String(position.sequenceNumber)
+	} else if position.atLatest && position.openedAtLatest.IsZero() {
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeLatest)
+		position.openedAtLatest = time.Now()
+	}
+
+	output, err := o.inputClient.GetShardIteratorWithContext(o.context, input)
+	if err != nil {
+		return nil, err
+	}
+	return output.ShardIterator, nil
+}
+
+// recoverIterator replaces an iterator that has expired or points at trimmed
+// data.  Any other error is returned unchanged.
+func (o *StreamOperation) recoverIterator(position *shardPosition, cause error) (*string, error) {
+	awsErr, ok := cause.(awserr.Error)
+	if !ok {
+		return nil, cause
+	}
+
+	switch awsErr.Code() {
+	case dynamodbstreams.ErrCodeExpiredIteratorException:
+		if position.sequenceNumber == "" && !position.openedAtLatest.IsZero() {
+			log.Printf("%s: Stream: iterator for shard %s expired before any record was read, reading it from the trim horizon and skipping records created before %s", o.OperationPlan.Description(), position.shard.Id, position.openedAtLatest.Format(time.RFC3339))
+		} else {
+			log.Printf("%s: Stream: iterator for shard %s expired, resuming after the last record read", o.OperationPlan.Description(), position.shard.Id)
+		}
+
+		iterator, err := o.shardIterator(position)
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodbstreams.ErrCodeTrimmedDataAccessException {
+				return o.handleTrimmedData(position)
+			}
+			return nil, err
+		}
+		return iterator, nil
+
+	case dynamodbstreams.ErrCodeTrimmedDataAccessException:
+		return o.handleTrimmedData(position)
+	}
+	return nil, cause
+}
+
+// handleTrimmedData applies the trimmed data policy once records that have not
+// been read yet have aged out of the stream
+func (o *StreamOperation) handleTrimmedData(position *shardPosition) (*string, error) {
+	trimHorizon := time.Now().Add(-streamRetention)
+
+	var lastRead string
+	switch {
+	case !position.created.IsZero():
+		lastRead = fmt.Sprintf("the last record read (sequence number %s) was created %s", position.sequenceNumber, position.created.Format(time.RFC3339))
+	case position.sequenceNumber != "":
+		lastRead = fmt.Sprintf("the last record written (sequence number %s) is no longer in the stream", position.sequenceNumber)
+	default:
+		lastRead = "no records had been read from it"
+	}
+	log.Printf("[WARNING] %s: Stream: shard %s has been trimmed, %s. Changes made before ~%s may have been lost.", o.OperationPlan.Description(), position.shard.Id, lastRead, trimHorizon.Format(time.RFC3339))
+
+	switch o.OperationPlan.Stream.TrimmedDataPolicy {
+	case config.TrimmedDataSkip:
+		log.Printf("[WARNING] %s: Stream: skipping shard %s ahead to the oldest available record", o.OperationPlan.Description(), position.shard.Id)
+
+		// Open the shard at its trim horizon explicitly: shardIterator would open
+		// an initial shard at LATEST when starting at latest, skipping everything
+		// still in the stream instead of just the records that were trimmed
+		output, err := o.inputClient.GetShardIteratorWithContext(o.context, &dynamodbstreams.GetShardIteratorInput{
+			StreamArn:         &o.streamARN,
+			ShardId:           &position.shard.Id,
+			ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
+		})
+		if err != nil {
+			return nil, err
+		}
+		*position = shardPosition{shard: position.shard}
+		return output.ShardIterator, nil
+
+	case config.TrimmedDataBackfill:
+		log.Printf("[WARNING] %s: Stream: stopping to backfill the table again", o.OperationPlan.Description())
+
+		atomic.StoreInt32(&o.rebackfillRequested, 1)
+		o.streamCancelFunc()
+		return nil, context.Canceled
+	}
+
+	return nil, fmt.Errorf("%s: Stream failed: shard %s was trimmed before it could be read", o.OperationPlan.Description(), position.shard.Id)
+}
@@ -0,0 +1,107 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/shard_tree"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+// iteratorStream records the shard iterators requested from it
+type iteratorStream struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+
+	requested []*dynamodbstreams.GetShardIteratorInput
+}
+
+func (f *iteratorStream) GetShardIteratorWithContext(_ aws.Context, input *dynamodbstreams.GetShardIteratorInput, _ ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	f.requested = append(f.requested, input)
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+}
+
+func TestSkipTrimmedDataAtTrimHorizon(t *testing.T) {
+	for _, startAtLatest := range []bool{false, true} {
+		stream := &iteratorStream{}
+		var plan config.OperationPlan
+		plan.Stream.TrimmedDataPolicy = config.TrimmedDataSkip
+		o := &StreamOperation{
+			OperationPlan: plan,
+			context:       context.Background(),
+			inputClient:   stream,
+		}
+
+		position := &shardPosition{shard: &shard_tree.Shard{Id: "shard-1"}, sequenceNumber: "100", atLatest: startAtLatest}
+		iterator, err := o.handleTrimmedData(position)
+		if err != nil || aws.StringValue(iterator) != "iterator" {
+			t.Fatalf("Expected an iterator, got %v, %v", iterator, err)
+		}
+		if len(stream.requested) != 1 || aws.StringValue(stream.requested[0].ShardIteratorType) != dynamodbstreams.ShardIteratorTypeTrimHorizon {
+			t.Errorf("Expected the shard to be opened at its trim horizon with start at latest %v, got %v", startAtLatest, stream.requested)
+		}
+		if position.sequenceNumber != "" || position.shard.Id != "shard-1" {
+			t.Errorf("Expected the position to restart at the beginning of the shard, got %+v", position)
+		}
+	}
+}
+
+func TestExpiredLatestIteratorReadsFromTrimHorizon(t *testing.T) {
+	stream := &iteratorStream{}
+	o := &StreamOperation{
+		context:     context.Background(),
+		inputClient: stream,
+	}
+
+	position := &shardPosition{shard: &shard_tree.Shard{Id: "shard-1"}, atLatest: true}
+	if _, err := o.shardIterator(position); err != nil {
+		t.Fatalf("Unexpected error opening the shard: %v", err)
+	}
+	if aws.StringValue(stream.requested[0].ShardIteratorType) != dynamodbstreams.ShardIteratorTypeLatest {
+		t.Fatalf("Expected the shard to be opened at LATEST first, got %v", stream.requested[0])
+	}
+	opened := position.openedAtLatest
+
+	// Expired while the buffer was full, before any record was delivered
+	expired := awserr.New(dynamodbstreams.ErrCodeExpiredIteratorException, "Iterator expired", nil)
+	if _, err := o.recoverIterator(position, expired); err != nil {
+		t.Fatalf("Unexpected error recovering the iterator: %v", err)
+	}
+	if len(stream.requested) != 2 || aws.StringValue(stream.requested[1].ShardIteratorType) != dynamodbstreams.ShardIteratorTypeTrimHorizon {
+		t.Fatalf("Expected the shard to be opened again at its trim horizon, got %v", stream.requested)
+	}
+
+	record := func(created time.Time) *dynamodbstreams.Record {
+		return &dynamodbstreams.Record{Dynamodb: &dynamodbstreams.StreamRecord{ApproximateCreationDateTime: aws.Time(created)}}
+	}
+	if !position.skipped(record(opened.Add(-time.Minute))) {
+		t.Errorf("Expected records created before the shard was opened to be skipped")
+	}
+	if position.skipped(record(opened.Add(time.Second))) {
+		t.Errorf("Expected records created while the iterator was stalled to be read")
+	}
+}
@@ -21,41 +21,85 @@ package operations
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/instructure/ddb-sync/config"
 	"github.com/instructure/ddb-sync/log"
 	"github.com/instructure/ddb-sync/shard_tree"
 	"github.com/instructure/ddb-sync/shard_watcher"
+	"github.com/instructure/ddb-sync/state"
 	"github.com/instructure/ddb-sync/status"
 	"github.com/instructure/ddb-sync/utils"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
 )
 
-const (
-	// In testing, this is sufficient to move to on from a blank shard
-	// without backing off prematurely
-	blankCountThreshold = 5
+// streamRecord is a record read from a shard along with the progress entry to
+// acknowledge once it has been written
+type streamRecord struct {
+	dynamodbstreams.Record
 
-	backoffDuration = 3 * time.Second
-)
+	progress *ProgressEntry
+}
 
 type StreamOperation struct {
 	OperationPlan     config.OperationPlan
 	context           context.Context
 	contextCancelFunc context.CancelFunc
+	streamCancelFunc  context.CancelFunc
 
-	inputClient  *dynamodbstreams.DynamoDBStreams
+	// set when trimmed data stops the stream so the plan can be backfilled again
+	rebackfillRequested int32
+
+	inputClient  dynamodbstreamsiface.DynamoDBStreamsAPI
 	outputClient *dynamodb.DynamoDB
 
+	// updates the input table when auto_enable turns its stream on
+	sourceClient *dynamodb.DynamoDB
+
+	sender *batchSender
+
+	// limit the capacity read from the source table and written by the writers
+	readLimit  capacityLimit
+	writeLimit capacityLimit
+
+	// reads current items from the source table when fetch_from_source is enabled
+	fetcher *itemFetcher
+
+	// set while a backfill runs alongside the stream, claims each key before
+	// it is written so the backfill can't overwrite it
+	fence *KeyFence
+
 	writeLatency LatencyLock
 
-	c         chan dynamodbstreams.Record
+	// set when consistency checks are enabled, samples the keys written
+	checker *consistencyChecker
+
+	c         chan streamRecord
+	lanes     []chan streamRecord
 	streamARN string
 
+	state *state.Store
+
+	// Records created before startCutoff are skipped; shards present at
+	// startup are opened at LATEST when startAtLatest is set
+	startCutoff   time.Time
+	startAtLatest bool
+
+	skippedItemCount   int64
+	coalescedItemCount int64
+
+	// the current time between GetRecords calls for each shard being read
+	mPollIntervals sync.Mutex
+	pollIntervals  map[string]time.Duration
+
 	streamRead Phase
 	writing    Phase
 
@@ -66,7 +110,7 @@ type StreamOperation struct {
 	writtenItemRateTracker *RateTracker
 }
 
-func NewStreamOperation(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*StreamOperation, error) {
+func NewStreamOperation(ctx context.Context, plan config.OperationPlan, store *state.Store, cancelFunc context.CancelFunc) (*StreamOperation, error) {
 	inputSession, outputSession, err := plan.GetSessions()
 	if err != nil {
 		return nil, err
@@ -75,47 +119,102 @@ func NewStreamOperation(ctx context.Context, plan config.OperationPlan, cancelFu
 	inputClient := dynamodbstreams.New(inputSession)
 	outputClient := dynamodb.New(outputSession)
 
+	// Streaming runs under its own context so that it can be stopped for a
+	// re-backfill without canceling the rest of the plan
+	ctx, streamCancel := context.WithCancel(ctx)
+
 	watcherInput := &shard_watcher.RunInput{
 		Context:           ctx,
-		ContextCancelFunc: cancelFunc,
+		ContextCancelFunc: streamCancel,
 
 		InputTableName:       plan.Input.TableName,
 		OperationDescription: plan.Description(),
 		Client:               inputClient,
 	}
 
-	return &StreamOperation{
+	lanes := make([]chan streamRecord, plan.Stream.Writers)
+	for i := range lanes {
+		lanes[i] = make(chan streamRecord, laneChanBuffer)
+	}
+
+	o := &StreamOperation{
 		OperationPlan:     plan,
 		context:           ctx,
 		contextCancelFunc: cancelFunc,
+		streamCancelFunc:  streamCancel,
 
-		c: make(chan dynamodbstreams.Record, recordChanBuffer),
+		c:     make(chan streamRecord, recordChanBuffer),
+		lanes: lanes,
+
+		state: store,
 
 		inputClient:  inputClient,
 		outputClient: outputClient,
+		sourceClient: dynamodb.New(inputSession),
 
 		watcher: shard_watcher.New(watcherInput),
 
 		readItemRateTracker:    NewRateTracker("Items", 9*time.Second),
 		wcuRateTracker:         NewRateTracker("WCUs", 9*time.Second),
 		writtenItemRateTracker: NewRateTracker("Items", 9*time.Second),
-	}, nil
+
+		readLimit:  readLimit(plan, plan.Stream.ReadCapacityLimit),
+		writeLimit: writeLimit(plan, plan.Stream.WriteCapacityLimit),
+	}
+
+	if plan.Stream.FetchFromSource {
+		o.fetcher = &itemFetcher{
+			context:   ctx,
+			client:    dynamodb.New(inputSession),
+			tableName: plan.Input.TableName,
+			limit:     o.readLimit,
+		}
+		if len(o.readLimit) > 0 {
+			o.fetcher.onRead = func(capacities []*dynamodb.ConsumedCapacity) {
+				o.readLimit.Take(capacities...)
+			}
+		}
+	}
+
+	o.sender = &batchSender{
+		context:   ctx,
+		client:    outputClient,
+		tableName: plan.Output.TableName,
+		onWrite:   o.markItemsWritten,
+		limit:     o.writeLimit,
+	}
+
+	if plan.Stream.ConsistencyCheckInterval > 0 {
+		o.checker = newConsistencyChecker(ctx, plan, &o.writeLatency, dynamodb.New(inputSession), outputClient)
+	}
+
+	return o, nil
 }
 
 func (o *StreamOperation) Preflights(in *dynamodb.DescribeTableOutput, _ *dynamodb.DescribeTableOutput) error {
-	streamSpecification := in.Table.StreamSpecification
-	if streamSpecification == nil {
-		return fmt.Errorf("[%s] Fails pre-flight check: stream is not enabled", *in.Table.TableName)
-	}
-	if !*streamSpecification.StreamEnabled {
-		return fmt.Errorf("[%s] Fails pre-flight check: stream is not enabled", *in.Table.TableName)
+	table := in.Table
+	streamSpecification := table.StreamSpecification
+	if streamSpecification == nil || !aws.BoolValue(streamSpecification.StreamEnabled) {
+		if !o.OperationPlan.Stream.AutoEnable {
+			return fmt.Errorf("[%s] Fails pre-flight check: stream is not enabled", *in.Table.TableName)
+		}
+
+		var err error
+		table, err = o.enableStream(table)
+		if err != nil {
+			return err
+		}
+		streamSpecification = table.StreamSpecification
 	}
 
-	if !(*streamSpecification.StreamViewType == dynamodb.StreamViewTypeNewImage || *streamSpecification.StreamViewType == dynamodb.StreamViewTypeNewAndOldImages) {
-		return fmt.Errorf("[%s] Fails pre-flight check: stream is not a correct type 'NEW_IMAGE' or 'NEW_AND_OLD_IMAGES'", *in.Table.TableName)
+	// Without a new image the current item has to be read from the source
+	// table.  An existing stream's view type is never changed.
+	viewType := *streamSpecification.StreamViewType
+	if !(viewType == dynamodb.StreamViewTypeNewImage || viewType == dynamodb.StreamViewTypeNewAndOldImages || o.OperationPlan.Stream.FetchFromSource) {
+		return fmt.Errorf("[%s] Fails pre-flight check: stream is not a correct type 'NEW_IMAGE' or 'NEW_AND_OLD_IMAGES', enable fetch_from_source to sync a '%s' stream", *in.Table.TableName, viewType)
 	}
 
-	o.streamARN = *in.Table.LatestStreamArn
+	o.streamARN = *table.LatestStreamArn
 
 	return nil
 }
@@ -128,6 +227,13 @@ func (o *StreamOperation) Run() error {
 	defer o.readItemRateTracker.Stop()
 	defer o.wcuRateTracker.Stop()
 	defer o.writtenItemRateTracker.Stop()
+	defer o.streamCancelFunc()
+
+	if o.checker != nil {
+		checkerDone := make(chan struct{})
+		defer close(checkerDone)
+		go o.checker.Run(checkerDone)
+	}
 
 	collator := ErrorCollator{
 		Cancel: o.contextCancelFunc,
@@ -135,7 +241,11 @@ func (o *StreamOperation) Run() error {
 	collator.Register(o.readStream)
 	collator.Register(o.writeRecords)
 
-	return collator.Run()
+	err := collator.Run()
+	if err == context.Canceled && atomic.LoadInt32(&o.rebackfillRequested) == 1 {
+		return errRebackfillRequired
+	}
+	return err
 }
 
 func (o *StreamOperation) Status() string {
@@ -143,17 +253,108 @@ func (o *StreamOperation) Status() string {
 		return pendingMsg
 	}
 
-	return fmt.Sprintf("%d written (%s latent)", o.writtenItemRateTracker.Count(), o.writeLatency.Status())
+	var polling string
+	if fastest, slowest, ok := o.pollIntervalRange(); ok {
+		if fastest == slowest {
+			polling = fmt.Sprintf(", polling every %s", fastest)
+		} else {
+			polling = fmt.Sprintf(", polling every %s-%s", fastest, slowest)
+		}
+	}
+	return fmt.Sprintf("%d written (%s latent%s)", o.writtenItemRateTracker.Count(), o.writeLatency.Status(), polling)
+}
+
+// ConsistencyStatus returns the running mismatch rate of the consistency
+// checks, or "" when they're disabled
+func (o *StreamOperation) ConsistencyStatus() string {
+	if o.checker == nil {
+		return ""
+	}
+	return o.checker.Status()
 }
 
 // Checkpoint is a periodic status output meant for historical tracking.  This will be called when an update is desired.
 func (o *StreamOperation) Checkpoint() string {
 	if o.writing.Running() {
-		return fmt.Sprintf("%s: Streaming: %d items written over %s", o.OperationPlan.Description(), o.writtenItemRateTracker.Count(), utils.FormatDuration(o.writtenItemRateTracker.Duration()))
+		checkpoint := fmt.Sprintf("%s: Streaming: %d items written over %s", o.OperationPlan.Description(), o.writtenItemRateTracker.Count(), utils.FormatDuration(o.writtenItemRateTracker.Duration()))
+		if skipped := atomic.LoadInt64(&o.skippedItemCount); skipped > 0 {
+			checkpoint += fmt.Sprintf(" (%d skipped before start position)", skipped)
+		}
+		if coalesced := atomic.LoadInt64(&o.coalescedItemCount); coalesced > 0 {
+			checkpoint += fmt.Sprintf(" (%d superseded changes coalesced)", coalesced)
+		}
+		if polling := o.pollIntervalSummary(); polling != "" {
+			checkpoint += fmt.Sprintf(", polling %s", polling)
+		}
+		if consistency := o.checker.Checkpoint(); consistency != "" {
+			checkpoint += ", " + consistency
+		}
+		return checkpoint
 	}
 	return ""
 }
 
+// setPollInterval records how often a shard is being polled, zero removes the shard
+func (o *StreamOperation) setPollInterval(shardId string, interval time.Duration) {
+	o.mPollIntervals.Lock()
+	defer o.mPollIntervals.Unlock()
+
+	if interval == 0 {
+		delete(o.pollIntervals, shardId)
+		return
+	}
+	if o.pollIntervals == nil {
+		o.pollIntervals = make(map[string]time.Duration)
+	}
+	o.pollIntervals[shardId] = interval
+}
+
+func (o *StreamOperation) pollIntervalRange() (time.Duration, time.Duration, bool) {
+	o.mPollIntervals.Lock()
+	defer o.mPollIntervals.Unlock()
+
+	var fastest, slowest time.Duration
+	for _, interval := range o.pollIntervals {
+		if fastest == 0 || interval < fastest {
+			fastest = interval
+		}
+		if interval > slowest {
+			slowest = interval
+		}
+	}
+	return fastest, slowest, len(o.pollIntervals) > 0
+}
+
+// pollIntervalSummary summarizes how often the shards being read are polled:
+// the number of shards and the fastest, median and slowest poll interval
+func (o *StreamOperation) pollIntervalSummary() string {
+	o.mPollIntervals.Lock()
+	defer o.mPollIntervals.Unlock()
+
+	intervals := make([]time.Duration, 0, len(o.pollIntervals))
+	for _, interval := range o.pollIntervals {
+		intervals = append(intervals, interval)
+	}
+	return summarizePollIntervals(intervals)
+}
+
+func summarizePollIntervals(intervals []time.Duration) string {
+	switch len(intervals) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("1 shard every %s", intervals[0])
+	}
+
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	middle := len(intervals) / 2
+	median := intervals[middle]
+	if len(intervals)%2 == 0 {
+		median = (intervals[middle-1] + intervals[middle]) / 2
+	}
+	return fmt.Sprintf("%d shards every %s min, %s median, %s max", len(intervals), intervals[0], median, intervals[len(intervals)-1])
+}
+
 func (o *StreamOperation) Rate() string {
 	if o.writing.Running() {
 		return fmt.Sprintf("%s %s %s", o.readItemRateTracker.RatePerSecond(), status.BufferStatus(o.bufferFill(), o.bufferCapacity()), o.wcuRateTracker.RatePerSecond())
@@ -166,8 +367,13 @@ func (o *StreamOperation) readStream() error {
 	log.Printf("%s: Streaming started…", o.OperationPlan.Description())
 	o.streamRead.Start()
 
+	resumed := o.state.ResetStream(o.streamARN)
+	o.resolveStartPosition(resumed)
+
 	o.watcher.StreamARN = o.streamARN
 	o.watcher.ShardProcessor = o.processShard
+	o.watcher.CompletedShardIds = o.state.CompletedShards()
+	o.watcher.ShardsDescribed = o.state.RetainShards
 
 	err := o.watcher.RunWorkers()
 	if err == nil {
@@ -180,49 +386,103 @@ func (o *StreamOperation) readStream() error {
 	return err
 }
 
-func (o *StreamOperation) processShard(shard *shard_tree.Shard) error {
-	shardIteratorOutput, err := o.inputClient.GetShardIteratorWithContext(
-		o.context,
-		&dynamodbstreams.GetShardIteratorInput{
-			StreamArn:         &o.streamARN,
-			ShardId:           &shard.Id,
-			ShardIteratorType: aws.String("TRIM_HORIZON"),
-		},
-	)
-	if err != nil {
-		return err
+func (o *StreamOperation) resolveStartPosition(resumed bool) {
+	streamPlan := o.OperationPlan.Stream
+
+	switch streamPlan.StartPosition {
+	case config.StartPositionTrimHorizon:
+	case config.StartPositionLatest:
+		if resumed {
+			// Shards opened at LATEST by a previous run may not have saved
+			// progress, so read them from when that run started instead
+			o.startCutoff = o.state.StreamStartedAt()
+		} else {
+			o.startAtLatest = true
+		}
+	case config.StartPositionAuto:
+		backfillStart := o.state.BackfillStartedAt()
+		if backfillStart.IsZero() {
+			log.Printf("%s: Stream: no backfill start time recorded, reading from the trim horizon", o.OperationPlan.Description())
+			return
+		}
+		o.startCutoff = backfillStart.Add(-*streamPlan.StartMargin)
+	default:
+		o.startCutoff, _ = streamPlan.StartTimestamp()
 	}
 
-	iterator := shardIteratorOutput.ShardIterator
-	done := o.context.Done()
-	var blankCounter uint
+	if !o.startCutoff.IsZero() {
+		log.Printf("%s: Stream: skipping records created before %s", o.OperationPlan.Description(), o.startCutoff.Format(time.RFC3339))
+	}
+}
 
-	for iterator != nil && *iterator != "" {
-		recordInput := &dynamodbstreams.GetRecordsInput{Limit: aws.Int64(1000), ShardIterator: iterator}
-		recordOutput, err := o.inputClient.GetRecordsWithContext(o.context, recordInput)
+func (o *StreamOperation) processShard(shard *shard_tree.Shard) error {
+	position := &shardPosition{
+		shard: shard,
+
+		// Resume after the last record written by a previous run
+		sequenceNumber: o.state.ShardSequenceNumber(shard.Id),
+
+		atLatest: o.startAtLatest && o.watcher.InitialShard(shard.Id),
+	}
+
+	iterator, err := o.shardIterator(position)
+	if err != nil {
+		iterator, err = o.recoverIterator(position, err)
 		if err != nil {
 			return err
 		}
+	}
 
-		if len(recordOutput.Records) > 0 {
-			blankCounter++
-		} else {
-			blankCounter = 0
-		}
+	done := o.context.Done()
+	scheduler := NewPollScheduler(config.MinPollInterval, o.OperationPlan.Stream.MaxPollInterval)
+	o.setPollInterval(shard.Id, scheduler.Interval())
+	defer o.setPollInterval(shard.Id, 0)
 
-		if blankCounter > blankCountThreshold {
-			slpCh := time.After(backoffDuration)
+	// Sequence numbers are only checkpointed once they and every record before
+	// them in the shard have been written
+	progress := &ProgressQueue{}
+
+	for iterator != nil && *iterator != "" {
+		if delay := scheduler.Delay(time.Now()); delay > 0 {
 			select {
-			case <-slpCh:
+			case <-time.After(delay):
 			case <-done:
 				return o.context.Err()
 			}
 		}
 
+		recordInput := &dynamodbstreams.GetRecordsInput{Limit: aws.Int64(1000), ShardIterator: iterator}
+		recordOutput, err := o.inputClient.GetRecordsWithContext(o.context, recordInput)
+		if err != nil {
+			iterator, err = o.recoverIterator(position, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		scheduler.Polled(time.Now(), len(recordOutput.Records))
+		o.setPollInterval(shard.Id, scheduler.Interval())
+
 		for _, record := range recordOutput.Records {
 			o.readItemRateTracker.Increment(1)
+
+			sequenceNumber := *record.Dynamodb.SequenceNumber
+			position.delivered(record)
+			commit := func() {
+				o.state.SetShardSequenceNumber(shard.Id, sequenceNumber)
+			}
+
+			if (!o.startCutoff.IsZero() && record.Dynamodb.ApproximateCreationDateTime.Before(o.startCutoff)) || position.skipped(record) {
+				atomic.AddInt64(&o.skippedItemCount, 1)
+				progress.Add(0, commit)
+				continue
+			}
+
+			entry := progress.Add(1, commit)
+
 			select {
-			case o.c <- *record:
+			case o.c <- streamRecord{Record: *record, progress: entry}:
 			case <-done:
 				return o.context.Err()
 			}
@@ -230,69 +490,303 @@ func (o *StreamOperation) processShard(shard *shard_tree.Shard) error {
 
 		iterator = recordOutput.NextShardIterator
 	}
+
+	progress.Add(0, func() {
+		o.state.CompleteShard(shard.Id)
+	})
 	return nil
 }
 
 func (o *StreamOperation) writeRecords() error {
 	o.writing.Start()
 
+	collator := ErrorCollator{
+		Cancel: o.contextCancelFunc,
+	}
+	collator.Register(o.routeRecords)
+	for lane := range o.lanes {
+		if o.OperationPlan.Stream.CoalesceWindow > 0 {
+			collator.Register(o.coalescingWriter(lane))
+		} else if o.fetcher != nil {
+			collator.Register(o.fetchingWriter(lane))
+		} else {
+			collator.Register(o.recordWriter(lane))
+		}
+	}
+
+	err := collator.Run()
+	if err == nil {
+		o.writing.Finish()
+		return nil
+	}
+
+	if err != context.Canceled {
+		o.writing.Error()
+	}
+	return err
+}
+
+// routeRecords hands each record to a writer chosen by its key, so every change
+// to an item is written by the same writer in stream order
+func (o *StreamOperation) routeRecords() error {
+	defer func() {
+		for _, lane := range o.lanes {
+			close(lane)
+		}
+	}()
+
 	done := o.context.Done()
-channel:
+	laneCount := uint32(len(o.lanes))
 	for {
-		var consumedCap *dynamodb.ConsumedCapacity
-		var err error
 		select {
 		case record, ok := <-o.c:
 			if !ok {
-				break channel
+				return nil
 			}
-			o.writeLatency.Update(*record.Dynamodb.ApproximateCreationDateTime)
-			if *record.EventName == "REMOVE" {
-				input := &dynamodb.DeleteItemInput{
-					Key:                    record.Dynamodb.Keys,
-					ReturnConsumedCapacity: aws.String("TOTAL"),
-					TableName:              aws.String(o.OperationPlan.Output.TableName),
-				}
-				var resp *dynamodb.DeleteItemOutput
-				resp, err = o.outputClient.DeleteItemWithContext(o.context, input)
-				consumedCap = resp.ConsumedCapacity
-			} else {
-				input := &dynamodb.PutItemInput{
-					Item:                   record.Dynamodb.NewImage,
-					ReturnConsumedCapacity: aws.String("TOTAL"),
-					TableName:              aws.String(o.OperationPlan.Output.TableName),
-				}
-				var resp *dynamodb.PutItemOutput
-				resp, err = o.outputClient.PutItemWithContext(o.context, input)
-				consumedCap = resp.ConsumedCapacity
 
+			lane := o.lanes[ItemKeyHash(record.Dynamodb.Keys)%laneCount]
+			select {
+			case lane <- record:
+			case <-done:
+				return o.context.Err()
 			}
 		case <-done:
 			return o.context.Err()
 		}
+	}
+}
+
+func (o *StreamOperation) recordWriter(lane int) func() error {
+	return func() error {
+		records := o.lanes[lane]
+		done := o.context.Done()
+		for {
+			var record streamRecord
+			var ok bool
+			select {
+			case record, ok = <-records:
+				if !ok {
+					return nil
+				}
+			case <-done:
+				return o.context.Err()
+			}
+
+			o.writeLatency.Update(lane, *record.Dynamodb.ApproximateCreationDateTime)
+			o.fence.Claim(record.Dynamodb.Keys)
+			consumedCap, err := o.writeRecord(record)
+			if err != nil {
+				return fmt.Errorf("%s: Stream Failed (writeRecords): %v\n", o.OperationPlan.Description(), err)
+			}
+
+			o.markItemWritten(consumedCap)
+			o.checker.Written(record.Dynamodb.Keys)
+			record.progress.Ack()
+
+			if len(records) == 0 {
+				o.writeLatency.Idle(lane)
+			}
+		}
+	}
+}
+
+// coalescingWriter collects records for the coalesce window and writes the last
+// change to each key in batches
+func (o *StreamOperation) coalescingWriter(lane int) func() error {
+	return func() error {
+		records := o.lanes[lane]
+		done := o.context.Done()
+
+		pending := newCoalescedBatch()
+		var flushTimer <-chan time.Time
+
+		for {
+			select {
+			case record, ok := <-records:
+				if !ok {
+					return o.flushCoalesced(lane, pending)
+				}
+
+				if pending.recordCount() == 0 {
+					flushTimer = time.After(o.OperationPlan.Stream.CoalesceWindow)
+				}
+				pending.add(record)
+
+				if pending.keyCount() < coalesceMaxKeys {
+					continue
+				}
+			case <-flushTimer:
+			case <-done:
+				return o.context.Err()
+			}
+
+			err := o.flushCoalesced(lane, pending)
+			if err != nil {
+				return err
+			}
+			pending = newCoalescedBatch()
+			flushTimer = nil
+		}
+	}
+}
+
+// fetchingWriter writes the records waiting in a lane together, reading their
+// current items from the source table with one BatchGetItem rather than a
+// read for each record.  It doesn't wait for more records, so a quiet lane
+// writes each record as it arrives.
+func (o *StreamOperation) fetchingWriter(lane int) func() error {
+	return func() error {
+		records := o.lanes[lane]
+		done := o.context.Done()
+		for {
+			pending := newCoalescedBatch()
+			select {
+			case record, ok := <-records:
+				if !ok {
+					return nil
+				}
+				pending.add(record)
+			case <-done:
+				return o.context.Err()
+			}
+
+			takeWaiting(records, pending, batchGetMaxKeys)
+			err := o.flushCoalesced(lane, pending)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// takeWaiting adds the records already waiting in a lane to a batch, up to
+// max distinct keys, without waiting for more
+func takeWaiting(records <-chan streamRecord, batch *coalescedBatch, max int) {
+	for batch.keyCount() < max {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				return
+			}
+			batch.add(record)
+		default:
+			return
+		}
+	}
+}
+
+func (o *StreamOperation) flushCoalesced(lane int, batch *coalescedBatch) error {
+	if batch.recordCount() == 0 {
+		return nil
+	}
 
+	for _, record := range batch.latestRecords() {
+		o.fence.Claim(record.Dynamodb.Keys)
+	}
+
+	requests := batch.requests()
+	if o.fetcher != nil {
+		var err error
+		requests, err = o.fetcher.requests(batch.latestRecords())
 		if err != nil {
-			o.writing.Error()
-			return fmt.Errorf("%s: Stream Failed (writeRecords): %v\n", o.OperationPlan.Description(), err)
+			return fmt.Errorf("%s: Stream Failed (BatchGetItem): %v\n", o.OperationPlan.Description(), err)
+		}
+	}
+
+	for start := 0; start < len(requests); start += batchWriteMaxItems {
+		end := start + batchWriteMaxItems
+		if end > len(requests) {
+			end = len(requests)
 		}
 
-		o.markItemWritten(consumedCap)
+		err := o.sender.send(requests[start:end])
+		if err != nil {
+			return fmt.Errorf("%s: Stream Failed (BatchWriteItem): %v\n", o.OperationPlan.Description(), err)
+		}
 	}
 
-	o.writing.Finish()
+	atomic.AddInt64(&o.coalescedItemCount, int64(batch.recordCount()-batch.keyCount()))
+	for _, record := range batch.latestRecords() {
+		o.checker.Written(record.Dynamodb.Keys)
+	}
+	for _, entry := range batch.progress {
+		entry.Ack()
+	}
 
+	o.writeLatency.Update(lane, batch.newest)
+	if len(o.lanes[lane]) == 0 {
+		o.writeLatency.Idle(lane)
+	}
 	return nil
 }
 
+func (o *StreamOperation) writeRecord(record streamRecord) (*dynamodb.ConsumedCapacity, error) {
+	if *record.EventName == "REMOVE" {
+		return o.deleteItem(record.Dynamodb.Keys)
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                   record.Dynamodb.NewImage,
+		ReturnConsumedCapacity: aws.String("TOTAL"),
+		TableName:              aws.String(o.OperationPlan.Output.TableName),
+	}
+	err := o.writeLimit.Wait(o.context)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.outputClient.PutItemWithContext(o.context, input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ConsumedCapacity, nil
+}
+
+func (o *StreamOperation) deleteItem(keys map[string]*dynamodb.AttributeValue) (*dynamodb.ConsumedCapacity, error) {
+	input := &dynamodb.DeleteItemInput{
+		Key:                    keys,
+		ReturnConsumedCapacity: aws.String("TOTAL"),
+		TableName:              aws.String(o.OperationPlan.Output.TableName),
+	}
+	err := o.writeLimit.Wait(o.context)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.outputClient.DeleteItemWithContext(o.context, input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ConsumedCapacity, nil
+}
+
 func (o *StreamOperation) bufferFill() int {
-	return len(o.c)
+	fill := len(o.c)
+	for _, lane := range o.lanes {
+		fill += len(lane)
+	}
+	return fill
 }
 
 func (o *StreamOperation) bufferCapacity() int {
-	return cap(o.c)
+	capacity := cap(o.c)
+	for _, lane := range o.lanes {
+		capacity += cap(lane)
+	}
+	return capacity
 }
 
 func (o *StreamOperation) markItemWritten(cap *dynamodb.ConsumedCapacity) {
 	o.writtenItemRateTracker.Increment(1)
 	o.wcuRateTracker.Increment(int64(*cap.CapacityUnits))
+	o.writeLimit.Take(cap)
+}
+
+func (o *StreamOperation) markItemsWritten(items int, capacities []*dynamodb.ConsumedCapacity) {
+	var agg float64
+	for _, cap := range capacities {
+		agg = agg + *cap.CapacityUnits
+	}
+
+	o.writtenItemRateTracker.Increment(int64(items))
+	o.wcuRateTracker.Increment(int64(math.Ceil(agg)))
+	o.writeLimit.Take(capacities...)
 }
@@ -0,0 +1,113 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestStreamPreflightsViewType(t *testing.T) {
+	tests := []struct {
+		viewType        string
+		fetchFromSource bool
+		ok              bool
+	}{
+		{dynamodb.StreamViewTypeNewImage, false, true},
+		{dynamodb.StreamViewTypeNewAndOldImages, false, true},
+		{dynamodb.StreamViewTypeKeysOnly, false, false},
+		{dynamodb.StreamViewTypeOldImage, false, false},
+		{dynamodb.StreamViewTypeKeysOnly, true, true},
+		{dynamodb.StreamViewTypeOldImage, true, true},
+	}
+
+	for _, test := range tests {
+		var plan config.OperationPlan
+		plan.Stream.FetchFromSource = test.fetchFromSource
+		o := &StreamOperation{OperationPlan: plan}
+
+		input := &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+			TableName:       aws.String("source"),
+			LatestStreamArn: aws.String("arn:stream"),
+			StreamSpecification: &dynamodb.StreamSpecification{
+				StreamEnabled:  aws.Bool(true),
+				StreamViewType: aws.String(test.viewType),
+			},
+		}}
+		err := o.Preflights(input, nil)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s stream with fetch from source %v: expected ok %v, got %v", test.viewType, test.fetchFromSource, test.ok, err)
+		}
+	}
+}
+
+func TestSummarizePollIntervals(t *testing.T) {
+	tests := []struct {
+		intervals []time.Duration
+		expected  string
+	}{
+		{nil, ""},
+		{[]time.Duration{time.Second}, "1 shard every 1s"},
+		{[]time.Duration{4 * time.Second, 250 * time.Millisecond, time.Second}, "3 shards every 250ms min, 1s median, 4s max"},
+		{[]time.Duration{5 * time.Second, time.Second, 2 * time.Second, 250 * time.Millisecond}, "4 shards every 250ms min, 1.5s median, 5s max"},
+	}
+
+	for _, test := range tests {
+		if summary := summarizePollIntervals(test.intervals); summary != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, summary)
+		}
+	}
+}
+
+func TestTakeWaitingRecords(t *testing.T) {
+	records := make(chan streamRecord, 10)
+	for i := 0; i < 5; i++ {
+		records <- testRecord("MODIFY", fmt.Sprintf("item-%d", i%4), "")
+	}
+
+	batch := newCoalescedBatch()
+	takeWaiting(records, batch, 3)
+	if batch.keyCount() != 3 || len(records) != 2 {
+		t.Fatalf("Expected 3 keys taken and 2 records left waiting, got %d and %d", batch.keyCount(), len(records))
+	}
+
+	// Stops once the lane is empty rather than waiting for more
+	batch = newCoalescedBatch()
+	takeWaiting(records, batch, batchGetMaxKeys)
+	if batch.recordCount() != 2 || len(records) != 0 {
+		t.Fatalf("Expected the 2 waiting records taken, got %d", batch.recordCount())
+	}
+
+	// The items are read with a single request
+	source := &currentItems{}
+	fetcher := &itemFetcher{context: context.Background(), client: source, tableName: "source"}
+	if _, err := fetcher.requests(batch.latestRecords()); err != nil {
+		t.Fatalf("Unexpected error reading the items: %v", err)
+	}
+	if source.requests != 1 || source.reads != 2 {
+		t.Errorf("Expected both items read in 1 request, got %d reads in %d requests", source.reads, source.requests)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// createTableInput builds a table like the source table: its keys, indexes,
+// billing mode and capacity, encryption, and stream.  Encryption with a KMS
+// key uses the destination account's AWS managed key, since the source's key
+// may not be usable there.
+func createTableInput(tableName string, source *dynamodb.TableDescription) *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName:            aws.String(tableName),
+		AttributeDefinitions: source.AttributeDefinitions,
+		KeySchema:            source.KeySchema,
+	}
+
+	onDemand := source.BillingModeSummary != nil && aws.StringValue(source.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest
+	if onDemand {
+		input.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+	} else {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		input.ProvisionedThroughput = provisionedThroughput(source.ProvisionedThroughput)
+	}
+
+	for _, index := range source.GlobalSecondaryIndexes {
+		gsi := &dynamodb.GlobalSecondaryIndex{
+			IndexName:  index.IndexName,
+			KeySchema:  index.KeySchema,
+			Projection: index.Projection,
+		}
+		if !onDemand {
+			gsi.ProvisionedThroughput = provisionedThroughput(index.ProvisionedThroughput)
+		}
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, gsi)
+	}
+
+	for _, index := range source.LocalSecondaryIndexes {
+		input.LocalSecondaryIndexes = append(input.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndex{
+			IndexName:  index.IndexName,
+			KeySchema:  index.KeySchema,
+			Projection: index.Projection,
+		})
+	}
+
+	if sse := source.SSEDescription; sse != nil {
+		switch aws.StringValue(sse.Status) {
+		case dynamodb.SSEStatusEnabled, dynamodb.SSEStatusEnabling, dynamodb.SSEStatusUpdating:
+			input.SSESpecification = &dynamodb.SSESpecification{
+				Enabled: aws.Bool(true),
+				SSEType: sse.SSEType,
+			}
+		}
+	}
+
+	if stream := source.StreamSpecification; stream != nil && aws.BoolValue(stream.StreamEnabled) {
+		input.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: stream.StreamViewType,
+		}
+	}
+
+	return input
+}
+
+func provisionedThroughput(description *dynamodb.ProvisionedThroughputDescription) *dynamodb.ProvisionedThroughput {
+	if description == nil {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  description.ReadCapacityUnits,
+		WriteCapacityUnits: description.WriteCapacityUnits,
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestCreateTableInputProvisioned(t *testing.T) {
+	table := provisioned(testTable("by-email"), testThroughput(5, 10), testThroughput(5, 10))
+	table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModeProvisioned)}
+	table.SSEDescription = &dynamodb.SSEDescription{
+		Status:          aws.String(dynamodb.SSEStatusEnabled),
+		SSEType:         aws.String(dynamodb.SSETypeKms),
+		KMSMasterKeyArn: aws.String("arn:aws:kms:us-west-2:123456789012:key/source"),
+	}
+	table.StreamSpecification = &dynamodb.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: aws.String(dynamodb.StreamViewTypeNewImage),
+	}
+
+	input := createTableInput("destination", table)
+
+	if err := input.Validate(); err != nil {
+		t.Fatalf("Expected a valid input, got %v", err)
+	}
+	if *input.TableName != "destination" || *input.BillingMode != dynamodb.BillingModeProvisioned {
+		t.Errorf("Expected a provisioned table named destination, got %v", input)
+	}
+	if *input.ProvisionedThroughput.WriteCapacityUnits != 10 || *input.GlobalSecondaryIndexes[0].ProvisionedThroughput.ReadCapacityUnits != 5 {
+		t.Errorf("Expected the source capacity, got %v", input)
+	}
+	if input.SSESpecification.KMSMasterKeyId != nil || *input.SSESpecification.SSEType != dynamodb.SSETypeKms {
+		t.Errorf("Expected KMS encryption with the destination's managed key, got %v", input.SSESpecification)
+	}
+	if *input.StreamSpecification.StreamViewType != dynamodb.StreamViewTypeNewImage {
+		t.Errorf("Expected the source stream, got %v", input.StreamSpecification)
+	}
+}
+
+func TestCreateTableInputOnDemand(t *testing.T) {
+	table := provisioned(testTable("by-email"), testThroughput(5, 10), testThroughput(5, 10))
+	table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+
+	input := createTableInput("destination", table)
+
+	if err := input.Validate(); err != nil {
+		t.Fatalf("Expected a valid input, got %v", err)
+	}
+	if input.ProvisionedThroughput != nil || input.GlobalSecondaryIndexes[0].ProvisionedThroughput != nil {
+		t.Errorf("Expected no provisioned capacity on demand, got %v", input)
+	}
+}
@@ -0,0 +1,328 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// how often the scan page size and writer concurrency are adjusted, longer
+	// than the rate trackers' window so each adjustment sees a new rate
+	throughputControlInterval = 10 * time.Second
+
+	// how often the tables' provisioned capacity is described again
+	throughputDescribeInterval = time.Minute
+
+	// settings are raised while the consumed capacity is below this fraction of the target
+	throughputHeadroom = 0.9
+
+	initialScanPageSize = 100
+	minScanPageSize     = 10
+	maxScanPageSize     = 2000
+	scanPageSizeStep    = 50
+)
+
+// throughputController tunes the backfill's scan page size and writer
+// concurrency so that the capacity consumed approaches a percentage of each
+// table's provisioned capacity.  Each is raised additively while under its
+// target and halved when over it or throttled.  A table with on demand
+// capacity has no target, and its setting is left alone.
+type throughputController struct {
+	OperationPlan config.OperationPlan
+	context       context.Context
+
+	inputClient  *dynamodb.DynamoDB
+	outputClient *dynamodb.DynamoDB
+
+	// the backfill's consumed capacity rates
+	rcuRateTracker *RateTracker
+	wcuRateTracker *RateTracker
+
+	// limits the writers flushing batches at once
+	writers    *adjustableSemaphore
+	maxWriters int
+
+	readThrottles  int64
+	writeThrottles int64
+
+	m          sync.Mutex
+	pageSize   int64
+	targetRCUs float64
+	targetWCUs float64
+}
+
+func newThroughputController(ctx context.Context, plan config.OperationPlan, inputClient, outputClient *dynamodb.DynamoDB, rcuRateTracker, wcuRateTracker *RateTracker) *throughputController {
+	c := &throughputController{
+		OperationPlan: plan,
+		context:       ctx,
+
+		inputClient:  inputClient,
+		outputClient: outputClient,
+
+		rcuRateTracker: rcuRateTracker,
+		wcuRateTracker: wcuRateTracker,
+
+		writers:    newAdjustableSemaphore(runtime.NumCPU()),
+		maxWriters: 4 * runtime.NumCPU(),
+
+		pageSize: initialScanPageSize,
+	}
+
+	// The SDK retries throttled requests itself, count each one it retries
+	inputClient.Handlers.Retry.PushBack(c.throttleCounter(&c.readThrottles))
+	outputClient.Handlers.Retry.PushBack(c.throttleCounter(&c.writeThrottles))
+
+	return c
+}
+
+func (c *throughputController) throttleCounter(counter *int64) func(*request.Request) {
+	return func(r *request.Request) {
+		if request.IsErrorThrottle(r.Error) {
+			atomic.AddInt64(counter, 1)
+		}
+	}
+}
+
+// Run adjusts the settings until done is closed
+func (c *throughputController) Run(done <-chan struct{}) {
+	c.describe()
+
+	control := time.NewTicker(throughputControlInterval)
+	defer control.Stop()
+	describe := time.NewTicker(throughputDescribeInterval)
+	defer describe.Stop()
+
+	for {
+		select {
+		case <-control.C:
+			c.adjust()
+		case <-describe.C:
+			c.describe()
+		case <-done:
+			return
+		case <-c.context.Done():
+			return
+		}
+	}
+}
+
+// describe sets the targets from the tables' current provisioned capacity.
+// The writes' consumed capacity includes the output table's global secondary
+// indexes, so their capacity is included in the write target.
+func (c *throughputController) describe() {
+	targetRCUs, ok := c.target(c.inputClient, c.OperationPlan.Input.TableName, func(throughput *dynamodb.ProvisionedThroughputDescription) *int64 {
+		return throughput.ReadCapacityUnits
+	}, false)
+	if ok {
+		c.m.Lock()
+		c.targetRCUs = targetRCUs
+		c.m.Unlock()
+	}
+
+	targetWCUs, ok := c.target(c.outputClient, c.OperationPlan.Output.TableName, func(throughput *dynamodb.ProvisionedThroughputDescription) *int64 {
+		return throughput.WriteCapacityUnits
+	}, true)
+	if ok {
+		c.m.Lock()
+		c.targetWCUs = targetWCUs
+		c.m.Unlock()
+	}
+}
+
+// target returns the target utilization of a table's provisioned capacity,
+// zero when it has on demand capacity, and false when it couldn't be described
+func (c *throughputController) target(client *dynamodb.DynamoDB, tableName string, units func(*dynamodb.ProvisionedThroughputDescription) *int64, withIndexes bool) (float64, bool) {
+	output, err := client.DescribeTableWithContext(c.context, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		log.Printf("[WARNING] %s: Throughput control couldn't describe [%s]: %v", c.OperationPlan.Description(), tableName, err)
+		return 0, false
+	}
+	return tableTarget(output.Table, units, withIndexes, c.OperationPlan.Backfill.TargetUtilization), true
+}
+
+// tableTarget returns a percentage of a table's provisioned capacity, and of
+// its global secondary indexes' with withIndexes, or zero when it has on
+// demand capacity
+func tableTarget(table *dynamodb.TableDescription, units func(*dynamodb.ProvisionedThroughputDescription) *int64, withIndexes bool, utilization float64) float64 {
+	if table.BillingModeSummary != nil && aws.StringValue(table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest {
+		return 0
+	}
+	if table.ProvisionedThroughput == nil {
+		return 0
+	}
+
+	provisioned := aws.Int64Value(units(table.ProvisionedThroughput))
+	if withIndexes {
+		for _, index := range table.GlobalSecondaryIndexes {
+			if index.ProvisionedThroughput != nil {
+				provisioned += aws.Int64Value(units(index.ProvisionedThroughput))
+			}
+		}
+	}
+	return float64(provisioned) * utilization / 100
+}
+
+func (c *throughputController) adjust() {
+	readThrottled := atomic.SwapInt64(&c.readThrottles, 0) > 0
+	writeThrottled := atomic.SwapInt64(&c.writeThrottles, 0) > 0
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.targetRCUs > 0 {
+		c.pageSize = aimd(c.pageSize, scanPageSizeStep, minScanPageSize, maxScanPageSize, c.rcuRateTracker.Rate(), c.targetRCUs, readThrottled)
+	}
+	if c.targetWCUs > 0 {
+		c.writers.SetLimit(int(aimd(int64(c.writers.Limit()), 1, 1, int64(c.maxWriters), c.wcuRateTracker.Rate(), c.targetWCUs, writeThrottled)))
+	}
+}
+
+// aimd returns a setting's next value: halved when the consumed capacity is
+// over its target or requests were throttled, and raised by step while there's
+// room under the target
+func aimd(value, step, min, max int64, consumed, target float64, throttled bool) int64 {
+	switch {
+	case throttled || consumed > target:
+		value /= 2
+	case consumed < target*throughputHeadroom:
+		value += step
+	}
+
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// PageSize returns the scan page size, 0 when the input table has no target
+func (c *throughputController) PageSize() int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.targetRCUs == 0 {
+		return 0
+	}
+	return c.pageSize
+}
+
+// Throttled counts an unprocessed batch write as throttling
+func (c *throughputController) Throttled() {
+	atomic.AddInt64(&c.writeThrottles, 1)
+}
+
+// ReadTarget and WriteTarget describe the target rates shown after the
+// consumed rates, "" for a table with no target
+func (c *throughputController) ReadTarget() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.targetRCUs == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (target %.f, page %d)", c.targetRCUs, c.pageSize)
+}
+
+func (c *throughputController) WriteTarget() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.targetWCUs == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (target %.f, %d writers)", c.targetWCUs, c.writers.Limit())
+}
+
+// adjustableSemaphore is a semaphore whose limit can change while it's held
+type adjustableSemaphore struct {
+	m       sync.Mutex
+	limit   int
+	held    int
+	changed chan struct{}
+}
+
+func newAdjustableSemaphore(limit int) *adjustableSemaphore {
+	return &adjustableSemaphore{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire waits for a slot under the limit
+func (s *adjustableSemaphore) Acquire(ctx context.Context) error {
+	for {
+		s.m.Lock()
+		if s.held < s.limit {
+			s.held++
+			s.m.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *adjustableSemaphore) Release() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.held--
+	s.broadcast()
+}
+
+func (s *adjustableSemaphore) Limit() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.limit
+}
+
+func (s *adjustableSemaphore) SetLimit(limit int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.limit = limit
+	s.broadcast()
+}
+
+func (s *adjustableSemaphore) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
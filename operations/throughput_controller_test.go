@@ -0,0 +1,99 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestAIMD(t *testing.T) {
+	cases := []struct {
+		name      string
+		value     int64
+		consumed  float64
+		throttled bool
+		expected  int64
+	}{
+		{"under the target", 100, 50, false, 150},
+		{"near the target", 100, 95, false, 100},
+		{"over the target", 100, 120, false, 50},
+		{"throttled", 100, 50, true, 50},
+		{"at the minimum", 15, 120, false, 10},
+		{"at the maximum", 1980, 50, false, 2000},
+	}
+
+	for _, c := range cases {
+		if value := aimd(c.value, 50, 10, 2000, c.consumed, 100, c.throttled); value != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.name, c.expected, value)
+		}
+	}
+}
+
+func TestWriteTargetWithIndexes(t *testing.T) {
+	writeUnits := func(throughput *dynamodb.ProvisionedThroughputDescription) *int64 {
+		return throughput.WriteCapacityUnits
+	}
+	table := provisioned(testTable("by-email"), testThroughput(10, 100), testThroughput(5, 100))
+
+	if target := tableTarget(table, writeUnits, false, 80); target != 80 {
+		t.Errorf("Expected the base table's target, got %v", target)
+	}
+	target := tableTarget(table, writeUnits, true, 80)
+	if target != 160 {
+		t.Fatalf("Expected the table's and its index's target, got %v", target)
+	}
+
+	// Consumed capacity counts each item's writes to the table and its index
+	if writers := aimd(4, 1, 1, 16, 140, target, false); writers != 5 {
+		t.Errorf("Expected the writers to be raised while under the combined target, got %d", writers)
+	}
+	if writers := aimd(4, 1, 1, 16, 180, target, false); writers != 2 {
+		t.Errorf("Expected the writers to be halved over the combined target, got %d", writers)
+	}
+}
+
+func TestAdjustableSemaphoreRaisedLimit(t *testing.T) {
+	semaphore := newAdjustableSemaphore(1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := semaphore.Acquire(ctx); err != nil {
+		t.Fatalf("Unexpected error acquiring the first slot: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- semaphore.Acquire(ctx)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Expected the second acquire to wait for the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	semaphore.SetLimit(2)
+	if err := <-acquired; err != nil {
+		t.Errorf("Expected raising the limit to let the second acquire through, got %v", err)
+	}
+}
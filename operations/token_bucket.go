@@ -0,0 +1,112 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the capacity units consumed per second.  DynamoDB only
+// reports what a request consumed once it completes, so requests wait until the
+// bucket is out of debt and then take what they consumed, which may put it back
+// into debt.  The bucket holds at most a second of capacity.
+type TokenBucket struct {
+	m sync.Mutex
+
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		tokens: rate,
+	}
+}
+
+// Take removes the units a request consumed at the given time
+func (b *TokenBucket) Take(at time.Time, units float64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.refill(at)
+	b.tokens -= units
+}
+
+// Delay returns how long to wait from the given time before the next request
+func (b *TokenBucket) Delay(now time.Time) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait blocks until the next request can be made or the context is done
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		delay := b.Delay(time.Now())
+		if delay <= 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Rate returns the capacity units allowed per second
+func (b *TokenBucket) Rate() float64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.rate
+}
+
+// SetRate changes the capacity units allowed per second
+func (b *TokenBucket) SetRate(rate float64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/instructure/ddb-sync/operations"
+)
+
+func TestTokenBucketWaitsOutDebt(t *testing.T) {
+	bucket := operations.NewTokenBucket(100)
+	now := time.Now()
+
+	bucket.Take(now, 50)
+	if delay := bucket.Delay(now); delay != 0 {
+		t.Errorf("Expected no delay with capacity left, got %s", delay)
+	}
+
+	// A request can consume more than the bucket holds, the debt is repaid over time
+	bucket.Take(now, 250)
+	if delay := bucket.Delay(now); delay != 2*time.Second {
+		t.Errorf("Expected a 2s delay to repay 200 units, got %s", delay)
+	}
+	if delay := bucket.Delay(now.Add(1500 * time.Millisecond)); delay != 500*time.Millisecond {
+		t.Errorf("Expected a 500ms delay, got %s", delay)
+	}
+	if delay := bucket.Delay(now.Add(2 * time.Second)); delay != 0 {
+		t.Errorf("Expected no delay once the debt is repaid, got %s", delay)
+	}
+}
+
+func TestTokenBucketHoldsAtMostOneSecond(t *testing.T) {
+	bucket := operations.NewTokenBucket(100)
+	now := time.Now()
+
+	bucket.Take(now, 0)
+	bucket.Take(now.Add(time.Minute), 150)
+	if delay := bucket.Delay(now.Add(time.Minute)); delay != 500*time.Millisecond {
+		t.Errorf("Expected idle time not to build up more than a second of capacity, got %s delay", delay)
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	bucket := operations.NewTokenBucket(100)
+	now := time.Now()
+
+	bucket.SetRate(10)
+	bucket.Take(now, 20)
+	if delay := bucket.Delay(now); delay != time.Second {
+		t.Errorf("Expected a lowered rate to cap the capacity held, got %s delay", delay)
+	}
+}
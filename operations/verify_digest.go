@@ -0,0 +1,270 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/report"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The most mismatched ranges listed when the digests are compared
+const maxLoggedMismatches = 10
+
+// digestEntry is an item's key, range, and hash, kept from the digest scan so
+// the items in ranges that differ can be compared without scanning again
+type digestEntry struct {
+	key  map[string]*dynamodb.AttributeValue
+	r    int
+	hash uint64
+}
+
+// segmentDigest is the digest of one scan segment and the entries it read
+type segmentDigest struct {
+	digest  TableDigest
+	entries []digestEntry
+}
+
+// digestCollector builds a digest for each segment a table is scanned in,
+// merging them once the scan completes.  Each item's entry is kept until more
+// than keyLimit have been read.
+type digestCollector struct {
+	ranges   int
+	keyLimit int
+	tracker  *RateTracker
+
+	keyCount    int64
+	keysDropped int32
+
+	mu       sync.Mutex
+	segments []*segmentDigest
+}
+
+func (c *digestCollector) pageHandler(o *VerifyOperation) func(int) func(*dynamodb.ScanOutput) bool {
+	return func(_ int) func(*dynamodb.ScanOutput) bool {
+		segment := &segmentDigest{digest: NewTableDigest(c.ranges)}
+		c.mu.Lock()
+		c.segments = append(c.segments, segment)
+		c.mu.Unlock()
+
+		return func(output *dynamodb.ScanOutput) bool {
+			o.updateConsumedCapacity([]*dynamodb.ConsumedCapacity{output.ConsumedCapacity})
+
+			if atomic.AddInt64(&c.keyCount, int64(len(output.Items))) > int64(c.keyLimit) {
+				atomic.StoreInt32(&c.keysDropped, 1)
+			}
+			keep := atomic.LoadInt32(&c.keysDropped) == 0
+
+			for _, item := range output.Items {
+				key := o.itemKey(item)
+				r, hash := segment.digest.Add(key, item)
+				if keep {
+					segment.entries = append(segment.entries, digestEntry{key: key, r: r, hash: hash})
+				}
+			}
+			if !keep {
+				segment.entries = nil
+			}
+
+			c.tracker.Increment(int64(len(output.Items)))
+			return true
+		}
+	}
+}
+
+func (c *digestCollector) merged() TableDigest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	merged := NewTableDigest(c.ranges)
+	for _, segment := range c.segments {
+		merged.Merge(segment.digest)
+	}
+	return merged
+}
+
+// entries returns the entries in the mismatched ranges keyed by ItemKey, false
+// when more than the key limit were read and they weren't kept
+func (c *digestCollector) entries(mismatched []bool) (map[string]digestEntry, bool) {
+	if atomic.LoadInt32(&c.keysDropped) != 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make(map[string]digestEntry)
+	for _, segment := range c.segments {
+		for _, entry := range segment.entries {
+			if mismatched[entry.r] {
+				entries[ItemKey(entry.key)] = entry
+			}
+		}
+	}
+	return entries, true
+}
+
+// differingKeys returns the keys that are only in one table or whose items'
+// hashes differ, ordered by ItemKey
+func differingKeys(source, destination map[string]digestEntry) []map[string]*dynamodb.AttributeValue {
+	var differing []string
+	for itemKey, entry := range source {
+		if other, ok := destination[itemKey]; !ok || other.hash != entry.hash {
+			differing = append(differing, itemKey)
+		}
+	}
+	for itemKey := range destination {
+		if _, ok := source[itemKey]; !ok {
+			differing = append(differing, itemKey)
+		}
+	}
+	sort.Strings(differing)
+
+	keys := make([]map[string]*dynamodb.AttributeValue, len(differing))
+	for i, itemKey := range differing {
+		if entry, ok := source[itemKey]; ok {
+			keys[i] = entry.key
+		} else {
+			keys[i] = destination[itemKey].key
+		}
+	}
+	return keys
+}
+
+// compareDigests scans both tables into digests of ranges of key hashes and
+// records which ranges differ, along with the keys in them whose items' hashes
+// differ.  Only those items are compared after, or every item in the ranges
+// when the keys couldn't be kept.
+func (o *VerifyOperation) compareDigests() error {
+	o.digesting.Start()
+
+	ranges := o.OperationPlan.Verify.DigestRanges
+	keyLimit := o.OperationPlan.Verify.DigestKeyLimit
+	sourceDigests := &digestCollector{ranges: ranges, keyLimit: keyLimit, tracker: o.sourceItemRateTracker}
+	destinationDigests := &digestCollector{ranges: ranges, keyLimit: keyLimit, tracker: o.destinationItemRateTracker}
+
+	collator := ErrorCollator{
+		Cancel: o.contextCancelFunc,
+	}
+	source := o.segmentedScanner(o.inputClient, o.OperationPlan.Input.TableName, sourceDigests.pageHandler(o))
+	destination := o.segmentedScanner(o.outputClient, o.OperationPlan.Output.TableName, destinationDigests.pageHandler(o))
+	for _, scanner := range append(source.Scanners(), destination.Scanners()...) {
+		collator.Register(scanner)
+	}
+
+	err := collator.Run()
+	if err != nil {
+		o.digesting.Error()
+		return err
+	}
+
+	sourceDigest, destinationDigest := sourceDigests.merged(), destinationDigests.merged()
+	mismatches := sourceDigest.Mismatches(destinationDigest)
+
+	o.mismatchedRanges = make([]bool, ranges)
+	for _, r := range mismatches {
+		o.mismatchedRanges[r] = true
+	}
+	o.mismatchedRangeCount = len(mismatches)
+	o.digesting.Finish()
+
+	log.Printf("%s: Digests compared: %d of %d ranges differ%s", o.OperationPlan.Description(), len(mismatches), ranges, mismatchSummary(mismatches, sourceDigest, destinationDigest))
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	sourceEntries, sourceKept := sourceDigests.entries(o.mismatchedRanges)
+	destinationEntries, destinationKept := destinationDigests.entries(o.mismatchedRanges)
+	if !sourceKept || !destinationKept {
+		log.Printf("[WARNING] %s: More than %d keys were read from a table, scanning both tables again to compare the ranges that differ", o.OperationPlan.Description(), keyLimit)
+		return nil
+	}
+
+	o.differingKeys = differingKeys(sourceEntries, destinationEntries)
+	log.Printf("%s: %d items in the ranges that differ have different hashes", o.OperationPlan.Description(), len(o.differingKeys))
+	return nil
+}
+
+// compareDifferingKeys looks up the items whose hashes differed in both tables,
+// reporting the differences that remain
+func (o *VerifyOperation) compareDifferingKeys() error {
+	source := o.fetcher(o.inputClient, o.OperationPlan.Input.TableName)
+	destination := o.fetcher(o.outputClient, o.OperationPlan.Output.TableName)
+
+	for start := 0; start < len(o.differingKeys); start += batchGetMaxKeys {
+		end := start + batchGetMaxKeys
+		if end > len(o.differingKeys) {
+			end = len(o.differingKeys)
+		}
+		keys := o.differingKeys[start:end]
+
+		sourceItems, err := source.getAll(keys)
+		if err != nil {
+			return RequestCanceledCheck(err)
+		}
+		destinationItems, err := destination.getAll(keys)
+		if err != nil {
+			return RequestCanceledCheck(err)
+		}
+
+		for _, key := range keys {
+			itemKey := ItemKey(key)
+			diff := report.Compare(key, sourceItems[itemKey], destinationItems[itemKey])
+			if diff != nil {
+				err := o.record(diff)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		o.sourceItemRateTracker.Increment(int64(len(keys)))
+		o.destinationItemRateTracker.Increment(int64(len(keys)))
+	}
+	return nil
+}
+
+// mismatchSummary lists the first mismatched ranges with their key hash bounds and item counts
+func mismatchSummary(mismatches []int, source, destination TableDigest) string {
+	var b strings.Builder
+	for i, r := range mismatches {
+		if i == maxLoggedMismatches {
+			fmt.Fprintf(&b, "\n  … and %d more", len(mismatches)-i)
+			break
+		}
+		first, last := source.KeyHashBounds(r)
+		fmt.Fprintf(&b, "\n  range %d (key hashes %08x-%08x): %d source items, %d destination items", r, first, last, source[r].Count, destination[r].Count)
+	}
+	return b.String()
+}
+
+// inMismatchedRange returns whether an item needs to be compared, every item
+// does unless the digests have been compared
+func (o *VerifyOperation) inMismatchedRange(key map[string]*dynamodb.AttributeValue) bool {
+	if o.mismatchedRanges == nil {
+		return true
+	}
+	return o.mismatchedRanges[keyHashRange(ItemKeyHash(key), len(o.mismatchedRanges))]
+}
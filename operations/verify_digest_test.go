@@ -0,0 +1,87 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func digestEntries(hashes map[string]uint64) map[string]digestEntry {
+	entries := make(map[string]digestEntry, len(hashes))
+	for id, hash := range hashes {
+		key := map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}}
+		entries[ItemKey(key)] = digestEntry{key: key, hash: hash}
+	}
+	return entries
+}
+
+func TestDifferingKeys(t *testing.T) {
+	source := digestEntries(map[string]uint64{"a": 1, "b": 2, "c": 3})
+	destination := digestEntries(map[string]uint64{"a": 1, "b": 20, "d": 4})
+
+	var ids []string
+	for _, key := range differingKeys(source, destination) {
+		ids = append(ids, *key["id"].S)
+	}
+	if len(ids) != 3 || ids[0] != "b" || ids[1] != "c" || ids[2] != "d" {
+		t.Errorf("Expected the changed, missing, and extra keys b, c, and d, got %v", ids)
+	}
+}
+
+func TestDigestCollectorKeyLimit(t *testing.T) {
+	o := &VerifyOperation{
+		keyNames:       []string{"id"},
+		rcuRateTracker: NewRateTracker("RCUs", 9*time.Second),
+	}
+	page := func(ids ...string) *dynamodb.ScanOutput {
+		output := &dynamodb.ScanOutput{ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)}}
+		for _, id := range ids {
+			output.Items = append(output.Items, map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}})
+		}
+		return output
+	}
+	everyRange := []bool{true, true, true, true}
+
+	collector := &digestCollector{ranges: 4, keyLimit: 3, tracker: NewRateTracker("Items", 9*time.Second)}
+	handler := collector.pageHandler(o)(0)
+	handler(page("a", "b"))
+	if entries, kept := collector.entries(everyRange); !kept || len(entries) != 2 {
+		t.Errorf("Expected both keys to be kept, got %d", len(entries))
+	}
+
+	handler(page("c", "d"))
+	if _, kept := collector.entries(everyRange); kept {
+		t.Errorf("Expected the keys to be dropped once more than the limit were read")
+	}
+	if digest := collector.merged(); digestCount(digest) != 4 {
+		t.Errorf("Expected the digest to include every item, got %d", digestCount(digest))
+	}
+}
+
+func digestCount(digest TableDigest) uint64 {
+	var count uint64
+	for _, r := range digest {
+		count += r.Count
+	}
+	return count
+}
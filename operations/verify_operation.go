@@ -0,0 +1,351 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package operations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/report"
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// VerifyOperation compares the source and destination tables.  Both tables
+// are scanned in parallel segments and each page is looked up in the other
+// table, differences are written to a report file.  With the digest strategy
+// the tables are first scanned into digests of ranges of key hashes, and only
+// items whose hashes differ in ranges whose digests differ are looked up.
+type VerifyOperation struct {
+	OperationPlan     config.OperationPlan
+	context           context.Context
+	contextCancelFunc context.CancelFunc
+
+	inputClient  *dynamodb.DynamoDB
+	outputClient *dynamodb.DynamoDB
+
+	// the key schema's attribute names, set by the preflights
+	keyNames []string
+
+	report *report.Writer
+
+	// called with each difference after it's reported when set, by the repair command
+	onDiff func(diff *report.ItemDiff) error
+
+	verifying Phase
+	digesting Phase
+
+	// the ranges of key hashes whose digests differ, nil to compare every item
+	mismatchedRanges     []bool
+	mismatchedRangeCount int
+
+	// the keys in those ranges whose items' hashes differ, nil when the
+	// digests found none or too many keys were read to keep them
+	differingKeys []map[string]*dynamodb.AttributeValue
+
+	sourceItemRateTracker      *RateTracker
+	destinationItemRateTracker *RateTracker
+	rcuRateTracker             *RateTracker
+
+	missingCount int64
+	extraCount   int64
+	changedCount int64
+
+	// the first error from a page handler, which can only stop its scan
+	failOnce sync.Once
+	failErr  error
+}
+
+func NewVerifyOperation(ctx context.Context, plan config.OperationPlan, cancelFunc context.CancelFunc) (*VerifyOperation, error) {
+	inputSession, outputSession, err := plan.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &VerifyOperation{
+		OperationPlan:     plan,
+		context:           ctx,
+		contextCancelFunc: cancelFunc,
+
+		inputClient:  dynamodb.New(inputSession),
+		outputClient: dynamodb.New(outputSession),
+
+		sourceItemRateTracker:      NewRateTracker("Source Items", 9*time.Second),
+		destinationItemRateTracker: NewRateTracker("Dest Items", 9*time.Second),
+		rcuRateTracker:             NewRateTracker("RCUs", 9*time.Second),
+	}, nil
+}
+
+func (o *VerifyOperation) Preflights(in *dynamodb.DescribeTableOutput, _ *dynamodb.DescribeTableOutput) error {
+	for _, element := range in.Table.KeySchema {
+		o.keyNames = append(o.keyNames, *element.AttributeName)
+	}
+	return nil
+}
+
+func (o *VerifyOperation) Run() error {
+	o.verifying.Start()
+	log.Printf("%s: Verify started…", o.OperationPlan.Description())
+
+	var err error
+	o.report, err = report.Create(o.OperationPlan.Verify.ReportFile)
+	if err != nil {
+		o.verifying.Error()
+		return err
+	}
+
+	o.sourceItemRateTracker.Start()
+	o.destinationItemRateTracker.Start()
+	o.rcuRateTracker.Start()
+
+	defer o.sourceItemRateTracker.Stop()
+	defer o.destinationItemRateTracker.Stop()
+	defer o.rcuRateTracker.Stop()
+
+	if o.OperationPlan.Verify.Strategy == config.VerifyStrategyDigest {
+		err = o.compareDigests()
+	}
+	switch {
+	case err != nil:
+	case o.differingKeys != nil:
+		err = o.compareDifferingKeys()
+	case o.mismatchedRanges == nil || o.mismatchedRangeCount > 0:
+		err = o.compareItems()
+	}
+	if closeErr := o.report.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		log.Printf("%s: Verify complete: %s over %s, report written to %s", o.OperationPlan.Description(), o.summary(), utils.FormatDuration(o.sourceItemRateTracker.Duration()), o.OperationPlan.Verify.ReportFile)
+		o.verifying.Finish()
+		return nil
+	}
+
+	if err != context.Canceled {
+		o.verifying.Error()
+		return fmt.Errorf("%s: Verify failed: %v", o.OperationPlan.Description(), err)
+	}
+	return err
+}
+
+func (o *VerifyOperation) compareItems() error {
+	collator := ErrorCollator{
+		Cancel: o.contextCancelFunc,
+	}
+
+	// Changed items are found from the source side, only extra items are
+	// reported from the destination side
+	source := o.segmentedScanner(o.inputClient, o.OperationPlan.Input.TableName, o.sourcePageHandler)
+	destination := o.segmentedScanner(o.outputClient, o.OperationPlan.Output.TableName, o.destinationPageHandler)
+	for _, scanner := range append(source.Scanners(), destination.Scanners()...) {
+		collator.Register(scanner)
+	}
+
+	err := collator.Run()
+	if o.failErr != nil {
+		return o.failErr
+	}
+	return err
+}
+
+func (o *VerifyOperation) segmentedScanner(client *dynamodb.DynamoDB, tableName string, pageHandler func(int) func(*dynamodb.ScanOutput) bool) *SegmentedScanner {
+	return &SegmentedScanner{
+		Context:       o.context,
+		Client:        client,
+		TableName:     tableName,
+		TotalSegments: o.OperationPlan.Backfill.TotalSegments,
+		Segments:      o.OperationPlan.Backfill.Segments,
+		PageHandler:   pageHandler,
+	}
+}
+
+func (o *VerifyOperation) fetcher(client *dynamodb.DynamoDB, tableName string) *itemFetcher {
+	return &itemFetcher{
+		context:   o.context,
+		client:    client,
+		tableName: tableName,
+		onRead:    o.updateConsumedCapacity,
+	}
+}
+
+// sourcePageHandler looks up each page of source items in the destination,
+// reporting missing and changed items
+func (o *VerifyOperation) sourcePageHandler(_ int) func(*dynamodb.ScanOutput) bool {
+	destination := o.fetcher(o.outputClient, o.OperationPlan.Output.TableName)
+
+	return func(output *dynamodb.ScanOutput) bool {
+		o.updateConsumedCapacity([]*dynamodb.ConsumedCapacity{output.ConsumedCapacity})
+		return o.comparePage(output.Items, destination, func(key, item, other map[string]*dynamodb.AttributeValue) *report.ItemDiff {
+			return report.Compare(key, item, other)
+		}, o.sourceItemRateTracker)
+	}
+}
+
+// destinationPageHandler looks up each page of destination items in the
+// source, reporting extra items.  Only whether each item exists matters, so
+// only its key is read.
+func (o *VerifyOperation) destinationPageHandler(_ int) func(*dynamodb.ScanOutput) bool {
+	source := o.fetcher(o.inputClient, o.OperationPlan.Input.TableName)
+	source.attributes = o.keyNames
+
+	return func(output *dynamodb.ScanOutput) bool {
+		o.updateConsumedCapacity([]*dynamodb.ConsumedCapacity{output.ConsumedCapacity})
+		return o.comparePage(output.Items, source, func(key, item, other map[string]*dynamodb.AttributeValue) *report.ItemDiff {
+			if other != nil {
+				return nil
+			}
+			return report.Compare(key, nil, item)
+		}, o.destinationItemRateTracker)
+	}
+}
+
+func (o *VerifyOperation) comparePage(items []map[string]*dynamodb.AttributeValue, other *itemFetcher, compare func(key, item, other map[string]*dynamodb.AttributeValue) *report.ItemDiff, tracker *RateTracker) bool {
+	defer tracker.Increment(int64(len(items)))
+
+	var compared []map[string]*dynamodb.AttributeValue
+	var keys []map[string]*dynamodb.AttributeValue
+	for _, item := range items {
+		key := o.itemKey(item)
+		if o.inMismatchedRange(key) {
+			compared = append(compared, item)
+			keys = append(keys, key)
+		}
+	}
+	if len(compared) == 0 {
+		return true
+	}
+
+	current, err := other.getAll(keys)
+	if err != nil {
+		o.fail(err)
+		return false
+	}
+
+	for i, item := range compared {
+		diff := compare(keys[i], item, current[ItemKey(keys[i])])
+		if diff != nil {
+			err := o.record(diff)
+			if err != nil {
+				o.fail(err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (o *VerifyOperation) itemKey(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := make(map[string]*dynamodb.AttributeValue, len(o.keyNames))
+	for _, name := range o.keyNames {
+		key[name] = item[name]
+	}
+	return key
+}
+
+func (o *VerifyOperation) record(diff *report.ItemDiff) error {
+	switch diff.Kind {
+	case report.Missing:
+		atomic.AddInt64(&o.missingCount, 1)
+	case report.Extra:
+		atomic.AddInt64(&o.extraCount, 1)
+	case report.Changed:
+		atomic.AddInt64(&o.changedCount, 1)
+	}
+
+	err := o.report.Write(diff)
+	if err != nil || o.onDiff == nil {
+		return err
+	}
+	return o.onDiff(diff)
+}
+
+// fail stops the verification, scan page handlers can't return errors
+func (o *VerifyOperation) fail(err error) {
+	if RequestCanceledCheck(err) == context.Canceled {
+		return
+	}
+
+	o.failOnce.Do(func() {
+		o.failErr = err
+		o.contextCancelFunc()
+	})
+}
+
+func (o *VerifyOperation) updateConsumedCapacity(capacities []*dynamodb.ConsumedCapacity) {
+	var agg float64
+	for _, cap := range capacities {
+		if cap != nil && cap.CapacityUnits != nil {
+			agg = agg + *cap.CapacityUnits
+		}
+	}
+
+	o.rcuRateTracker.Increment(int64(math.Ceil(agg)))
+}
+
+// Differences returns the number of differences found
+func (o *VerifyOperation) Differences() int64 {
+	return atomic.LoadInt64(&o.missingCount) + atomic.LoadInt64(&o.extraCount) + atomic.LoadInt64(&o.changedCount)
+}
+
+func (o *VerifyOperation) summary() string {
+	return fmt.Sprintf("%s%d source and %d destination items checked, %d missing, %d extra, %d changed", o.rangeSummary(), o.sourceItemRateTracker.Count(), o.destinationItemRateTracker.Count(), atomic.LoadInt64(&o.missingCount), atomic.LoadInt64(&o.extraCount), atomic.LoadInt64(&o.changedCount))
+}
+
+// rangeSummary returns how many ranges' digests differ once they've been compared
+func (o *VerifyOperation) rangeSummary() string {
+	if !o.digesting.Complete() {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d ranges differ, ", o.mismatchedRangeCount, len(o.mismatchedRanges))
+}
+
+func (o *VerifyOperation) Status() string {
+	if o.verifying.Errored() {
+		return erroredMsg
+	}
+	if !o.verifying.Running() && !o.verifying.Complete() {
+		return pendingMsg
+	}
+	if o.digesting.Running() {
+		return fmt.Sprintf("digesting, %d hashed", o.sourceItemRateTracker.Count()+o.destinationItemRateTracker.Count())
+	}
+	return fmt.Sprintf("%s%d checked, %d missing, %d extra, %d changed", o.rangeSummary(), o.sourceItemRateTracker.Count()+o.destinationItemRateTracker.Count(), atomic.LoadInt64(&o.missingCount), atomic.LoadInt64(&o.extraCount), atomic.LoadInt64(&o.changedCount))
+}
+
+func (o *VerifyOperation) Rate() string {
+	if o.verifying.Running() {
+		return fmt.Sprintf("%s %s %s", o.sourceItemRateTracker.RatePerSecond(), o.destinationItemRateTracker.RatePerSecond(), o.rcuRateTracker.RatePerSecond())
+	}
+	return ""
+}
+
+func (o *VerifyOperation) Checkpoint() string {
+	if o.verifying.Running() {
+		return fmt.Sprintf("%s: Verify in progress: %s", o.OperationPlan.Description(), o.summary())
+	}
+	return ""
+}
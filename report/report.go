@@ -0,0 +1,182 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Kinds of difference between the source and destination tables
+const (
+	// The item exists in the source table only
+	Missing = "missing"
+
+	// The item exists in the destination table only
+	Extra = "extra"
+
+	// The item exists in both tables with different attributes
+	Changed = "changed"
+)
+
+// ItemDiff is a difference found for a single item, it is written to a report
+// as one line of JSON
+type ItemDiff struct {
+	Kind string     `json:"kind"`
+	Key  utils.Item `json:"key"`
+
+	// The attributes that differ, for changed items
+	Attributes []AttributeDiff `json:"attributes,omitempty"`
+}
+
+// AttributeDiff is an attribute that differs between the tables, an attribute
+// missing from one table has no value for it
+type AttributeDiff struct {
+	Name        string                `json:"name"`
+	Source      *utils.AttributeValue `json:"source,omitempty"`
+	Destination *utils.AttributeValue `json:"destination,omitempty"`
+}
+
+// Compare returns the difference between the source and destination versions
+// of an item, nil if they match.  Either version may be nil if it doesn't exist.
+func Compare(key, source, destination map[string]*dynamodb.AttributeValue) *ItemDiff {
+	switch {
+	case source == nil && destination == nil:
+		return nil
+	case destination == nil:
+		return &ItemDiff{Kind: Missing, Key: key}
+	case source == nil:
+		return &ItemDiff{Kind: Extra, Key: key}
+	}
+
+	names := make(map[string]bool, len(source))
+	for name := range source {
+		names[name] = true
+	}
+	for name := range destination {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var attributes []AttributeDiff
+	for _, name := range sorted {
+		sourceValue, destinationValue := source[name], destination[name]
+		if utils.AttributeValuesEqual(sourceValue, destinationValue) {
+			continue
+		}
+
+		diff := AttributeDiff{Name: name}
+		if sourceValue != nil {
+			diff.Source = &utils.AttributeValue{AttributeValue: sourceValue}
+		}
+		if destinationValue != nil {
+			diff.Destination = &utils.AttributeValue{AttributeValue: destinationValue}
+		}
+		attributes = append(attributes, diff)
+	}
+
+	if len(attributes) == 0 {
+		return nil
+	}
+	return &ItemDiff{Kind: Changed, Key: key, Attributes: attributes}
+}
+
+// Writer writes item differences to a report file, it is safe for concurrent use
+type Writer struct {
+	m    sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// Create creates or truncates the report file at path
+func Create(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create report file: %v", err)
+	}
+
+	return &Writer{
+		file: file,
+		buf:  bufio.NewWriter(file),
+	}, nil
+}
+
+func (w *Writer) Write(diff *ItemDiff) error {
+	line, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	_, err = w.buf.Write(append(line, '\n'))
+	return err
+}
+
+// Close flushes the report and closes its file
+func (w *Writer) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	err := w.buf.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read calls handle with each difference in the report file at path, in order
+func Read(path string, handle func(*ItemDiff) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open report file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		diff := &ItemDiff{}
+		err := decoder.Decode(diff)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to parse report file %s: %v", path, err)
+		}
+
+		err = handle(diff)
+		if err != nil {
+			return err
+		}
+	}
+}
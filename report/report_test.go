@@ -0,0 +1,116 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package report_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/instructure/ddb-sync/report"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var testKey = map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}}
+
+func TestCompareFindsChangedAttributes(t *testing.T) {
+	source := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String("1")},
+		"name":  {S: aws.String("new")},
+		"count": {N: aws.String("2")},
+		"tags":  {SS: aws.StringSlice([]string{"a", "b"})},
+	}
+	destination := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String("1")},
+		"name":  {S: aws.String("old")},
+		"tags":  {SS: aws.StringSlice([]string{"b", "a"})},
+		"stale": {BOOL: aws.Bool(true)},
+	}
+
+	diff := report.Compare(testKey, source, destination)
+	if diff == nil || diff.Kind != report.Changed {
+		t.Fatalf("Expected a changed item, got %v", diff)
+	}
+
+	names := []string{}
+	for _, attribute := range diff.Attributes {
+		names = append(names, attribute.Name)
+	}
+	if len(names) != 3 || names[0] != "count" || names[1] != "name" || names[2] != "stale" {
+		t.Errorf("Expected count, name, and stale to differ, got %v", names)
+	}
+	if diff.Attributes[0].Destination != nil || diff.Attributes[2].Source != nil {
+		t.Errorf("Expected attributes missing from one side to have no value there")
+	}
+}
+
+func TestCompareMissingAndExtra(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}}
+
+	if diff := report.Compare(testKey, item, nil); diff == nil || diff.Kind != report.Missing {
+		t.Errorf("Expected a missing item, got %v", diff)
+	}
+	if diff := report.Compare(testKey, nil, item); diff == nil || diff.Kind != report.Extra {
+		t.Errorf("Expected an extra item, got %v", diff)
+	}
+	if diff := report.Compare(testKey, item, item); diff != nil {
+		t.Errorf("Expected matching items to have no difference, got %v", diff)
+	}
+}
+
+func TestReportRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddb-sync-report")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.jsonl")
+
+	writer, err := report.Create(path)
+	if err != nil {
+		t.Fatalf("Unexpected error creating report: %v", err)
+	}
+	writer.Write(&report.ItemDiff{Kind: report.Missing, Key: testKey})
+	writer.Write(report.Compare(testKey, map[string]*dynamodb.AttributeValue{"id": testKey["id"], "a": {N: aws.String("1")}}, testKey))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unexpected error closing report: %v", err)
+	}
+
+	var diffs []*report.ItemDiff
+	err = report.Read(path, func(diff *report.ItemDiff) error {
+		diffs = append(diffs, diff)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error reading report: %v", err)
+	}
+
+	if len(diffs) != 2 {
+		t.Fatalf("Expected 2 differences, got %d", len(diffs))
+	}
+	if diffs[0].Kind != report.Missing || *diffs[0].Key["id"].S != "1" {
+		t.Errorf("Expected the missing item first, got %v", diffs[0])
+	}
+	if diffs[1].Kind != report.Changed || *diffs[1].Attributes[0].Source.N != "1" {
+		t.Errorf("Expected the changed item second, got %v", diffs[1])
+	}
+}
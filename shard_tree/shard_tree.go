@@ -107,6 +107,22 @@ func (t *ShardTree) ShardComplete(shard *Shard) error {
 	return nil
 }
 
+// Restore marks shards completed in a previous run as complete.  Shards that
+// are not in the tree (e.g. trimmed from the stream) are ignored.
+func (t *ShardTree) Restore(completedShardIds []string) int {
+	restored := 0
+	for _, id := range completedShardIds {
+		shardStatus := t.shardStatuses[id]
+		if shardStatus == nil || shardStatus.Complete || shardStatus.InProgress {
+			continue
+		}
+
+		shardStatus.Complete = true
+		restored++
+	}
+	return restored
+}
+
 func (t *ShardTree) AvailableShards() []*Shard {
 	availableShards := []*Shard{}
 	for _, descendant := range t.descendentShards {
@@ -125,6 +141,16 @@ func (t *ShardTree) AvailableShards() []*Shard {
 	return availableShards
 }
 
+// HasChildren reports whether any shard in the tree descends directly from shardId
+func (t *ShardTree) HasChildren(shardId string) bool {
+	for _, status := range t.shardStatuses {
+		if status.Shard.ParentId == shardId {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *ShardTree) Count() int {
 	return len(t.shardStatuses)
 }
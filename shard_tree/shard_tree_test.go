@@ -395,3 +395,53 @@ func TestShardTreeParentShardNotProvidedReturnsAsAvailableShard(t *testing.T) {
 		t.Errorf("Received invalid shard(s): '%s'", extraneousId)
 	}
 }
+
+func TestShardTreeRestoredShardsAreNotAvailable(t *testing.T) {
+	tree := shard_tree.New()
+	shardSet := []*shard_tree.Shard{
+		&shard_tree.Shard{Id: "test-1"},
+		&shard_tree.Shard{Id: "test-2"},
+		&shard_tree.Shard{Id: "test-3", ParentId: "test-1"},
+	}
+
+	tree.Add(shardSet)
+
+	restored := tree.Restore([]string{"test-1", "test-trimmed"})
+	if restored != 1 {
+		t.Errorf("Expected 1 shard to be restored, got %d", restored)
+	}
+
+	availableShardIds := make(map[string]bool)
+	for _, shard := range tree.AvailableShards() {
+		availableShardIds[shard.Id] = true
+	}
+
+	for _, expectedId := range []string{"test-2", "test-3"} {
+		if _, exists := availableShardIds[expectedId]; !exists {
+			t.Errorf("Expected '%s' to be available, but wasn't", expectedId)
+		}
+		delete(availableShardIds, expectedId)
+	}
+
+	for extraneousId := range availableShardIds {
+		t.Errorf("Received invalid shard(s): '%s'", extraneousId)
+	}
+}
+
+func TestShardTreeHasChildren(t *testing.T) {
+	tree := shard_tree.New()
+	shardSet := []*shard_tree.Shard{
+		&shard_tree.Shard{Id: "test-1"},
+		&shard_tree.Shard{Id: "test-2"},
+		&shard_tree.Shard{Id: "test-3", ParentId: "test-1"},
+	}
+
+	tree.Add(shardSet)
+
+	if !tree.HasChildren("test-1") {
+		t.Errorf("Expected 'test-1' to have children")
+	}
+	if tree.HasChildren("test-2") {
+		t.Errorf("Expected 'test-2' to have no children")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"context"
 	"fmt"
 	"sync/atomic"
+	"time"
 
 	"github.com/instructure/ddb-sync/log"
 	"github.com/instructure/ddb-sync/shard_tree"
@@ -30,6 +31,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 )
 
+// How often the stream is described to discover new shards
+const describeInterval = time.Minute
+
 type shardResult struct {
 	err   error
 	shard *shard_tree.Shard
@@ -51,8 +55,17 @@ type Watcher struct {
 	ShardProcessor func(*shard_tree.Shard) error
 	StreamARN      string
 
+	// Shards completed by a previous run, these are never dispatched
+	CompletedShardIds []string
+
+	// Called with the id of every shard each time the stream is described
+	ShardsDescribed func(shardIds []string)
+
 	tree *shard_tree.ShardTree
 
+	// Shards present in the first description of the stream
+	initialShardIds map[string]bool
+
 	results chan *shardResult
 
 	dispatchedCount int32
@@ -78,12 +91,16 @@ func (w *Watcher) dispatchWork() error {
 	if err != nil {
 		return err
 	}
+	w.dispatchAvailable()
+	return nil
+}
+
+func (w *Watcher) dispatchAvailable() {
 	for _, availableShard := range w.tree.AvailableShards() {
 		atomic.AddInt32(&w.dispatchedCount, 1)
 		atomic.AddInt32(&w.workerCount, 1)
 		go w.shardHandler(availableShard)
 	}
-	return nil
 }
 
 func (w *Watcher) logShardCompletion() {
@@ -96,26 +113,58 @@ func (w *Watcher) RunWorkers() error {
 	if err != nil {
 		return err
 	}
+
+	// Shards are created as the table splits, so describe the stream
+	// periodically rather than only when a shard completes
+	describeTicker := time.NewTicker(describeInterval)
+	defer describeTicker.Stop()
+
+	done := w.Context.Done()
 loop:
 	for {
 		select {
 		case result := <-w.results:
 			atomic.AddInt32(&w.workerCount, -1)
 			if result.err != nil {
-				finalErr = result.err
+				if finalErr == nil {
+					finalErr = result.err
+				}
 				w.ContextCancelFunc()
-				continue
+				break
 			}
 			w.tree.ShardComplete(result.shard)
 			w.logShardCompletion()
+			if finalErr != nil {
+				break
+			}
+
+			// Children are usually known by the time their parent completes,
+			// only describe the stream if they aren't
+			if w.tree.HasChildren(result.shard.Id) {
+				w.dispatchAvailable()
+				break
+			}
+			err = w.dispatchWork()
+			if err != nil {
+				finalErr = err
+				w.ContextCancelFunc()
+			}
+
+		case <-describeTicker.C:
+			if finalErr != nil {
+				break
+			}
 			err = w.dispatchWork()
 			if err != nil {
 				finalErr = err
 				w.ContextCancelFunc()
 			}
 
-		case <-w.Context.Done():
-			finalErr = w.Context.Err()
+		case <-done:
+			if finalErr == nil {
+				finalErr = w.Context.Err()
+			}
+			done = nil
 		}
 
 		if finalErr != nil && atomic.LoadInt32(&w.workerCount) == 0 {
@@ -138,6 +187,11 @@ func (w *Watcher) ActiveWorkerCount() int32 {
 	return atomic.LoadInt32(&w.workerCount)
 }
 
+// InitialShard reports whether a shard existed when the watcher first described the stream
+func (w *Watcher) InitialShard(shardId string) bool {
+	return w.initialShardIds[shardId]
+}
+
 func (w *Watcher) shardHandler(shard *shard_tree.Shard) {
 	err := w.ShardProcessor(shard)
 	w.results <- &shardResult{
@@ -153,30 +207,71 @@ func (w *Watcher) updateShardTree() error {
 		return err
 	}
 
-	shards := shard_tree.ShardsForDynamoDBShards(streamDescription.StreamDescription.Shards)
+	shards := shard_tree.ShardsForDynamoDBShards(streamDescription.Shards)
 
 	err = w.tree.Add(shards)
+	if err != nil {
+		return err
+	}
+
+	if w.initialShardIds == nil {
+		w.initialShardIds = make(map[string]bool)
+		for _, shard := range shards {
+			w.initialShardIds[shard.Id] = true
+		}
+	}
+
+	if restored := w.tree.Restore(w.CompletedShardIds); restored > 0 {
+		log.Printf("%s: Resuming stream, %d shard(s) already complete.\n", w.OperationDescription, restored)
+	}
+
+	if w.ShardsDescribed != nil {
+		shardIds := make([]string, 0, len(shards))
+		for _, shard := range shards {
+			shardIds = append(shardIds, shard.Id)
+		}
+		w.ShardsDescribed(shardIds)
+	}
 
-	return err
+	return nil
 }
 
-func (w *Watcher) describeStreamWithChecks() (*dynamodbstreams.DescribeStreamOutput, error) {
-	streamRequest := dynamodbstreams.DescribeStreamInput{StreamArn: &w.StreamARN}
-	streamDescription, err := w.Client.DescribeStreamWithContext(w.Context, &streamRequest)
+// describeStreamWithChecks describes the stream, paging through every shard
+func (w *Watcher) describeStreamWithChecks() (*dynamodbstreams.StreamDescription, error) {
+	var description *dynamodbstreams.StreamDescription
+	var exclusiveStartShardId *string
 
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == dynamodbstreams.ErrCodeResourceNotFoundException {
-				return nil, fmt.Errorf("[%s] Error: Stream not found", w.InputTableName)
+	for {
+		streamRequest := dynamodbstreams.DescribeStreamInput{
+			StreamArn:             &w.StreamARN,
+			ExclusiveStartShardId: exclusiveStartShardId,
+		}
+		streamDescription, err := w.Client.DescribeStreamWithContext(w.Context, &streamRequest)
+
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				if aerr.Code() == dynamodbstreams.ErrCodeResourceNotFoundException {
+					return nil, fmt.Errorf("[%s] Error: Stream not found", w.InputTableName)
+				}
 			}
+			return nil, err
+		}
+		if streamDescription.StreamDescription == nil {
+			return nil, fmt.Errorf("[%s] Error: Stream not found", w.InputTableName)
+		}
+		if *streamDescription.StreamDescription.StreamStatus != "ENABLED" {
+			return nil, fmt.Errorf("[%s] Error: Stream not found", w.InputTableName)
+		}
+
+		if description == nil {
+			description = streamDescription.StreamDescription
+		} else {
+			description.Shards = append(description.Shards, streamDescription.StreamDescription.Shards...)
+		}
+
+		exclusiveStartShardId = streamDescription.StreamDescription.LastEvaluatedShardId
+		if exclusiveStartShardId == nil {
+			return description, nil
 		}
-		return nil, err
-	}
-	if streamDescription.StreamDescription == nil {
-		return nil, fmt.Errorf("[%s] Error: Stream not found", w.InputTableName)
-	}
-	if *streamDescription.StreamDescription.StreamStatus != "ENABLED" {
-		return nil, fmt.Errorf("[%s] Error: Stream not found", w.InputTableName)
 	}
-	return streamDescription, nil
 }
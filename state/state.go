@@ -0,0 +1,538 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/log"
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const saveInterval = 5 * time.Second
+
+var ErrStateFileMismatch = errors.New("State file belongs to a different operation plan")
+
+type StreamState struct {
+	StreamARN string `json:"stream_arn"`
+
+	// When streaming first began from this stream
+	StartedAt time.Time `json:"started_at"`
+
+	// Shards whose records have all been written to the output table
+	CompletedShards map[string]bool `json:"completed_shards"`
+
+	// The last sequence number written to the output table for each in-progress shard
+	SequenceNumbers map[string]string `json:"sequence_numbers"`
+}
+
+type SegmentState struct {
+	// The LastEvaluatedKey of the last page whose items were all written
+	LastEvaluatedKey utils.Item `json:"last_evaluated_key,omitempty"`
+
+	Complete bool `json:"complete"`
+
+	// The items written up to LastEvaluatedKey, by this run and earlier ones
+	WrittenCount int64 `json:"written_count,omitempty"`
+}
+
+type BackfillState struct {
+	TotalSegments int `json:"total_segments"`
+
+	// When the scan began, resumed backfills keep their original start time
+	StartedAt time.Time `json:"started_at"`
+
+	Segments map[int]*SegmentState `json:"segments"`
+}
+
+type IndexCapacity struct {
+	ReadCapacity  int64 `json:"read_capacity"`
+	WriteCapacity int64 `json:"write_capacity"`
+}
+
+// CapacityState is the output table's provisioned capacity from before the
+// backfill raised it
+type CapacityState struct {
+	BillingMode   string `json:"billing_mode"`
+	ReadCapacity  int64  `json:"read_capacity"`
+	WriteCapacity int64  `json:"write_capacity"`
+
+	Indexes map[string]IndexCapacity `json:"indexes,omitempty"`
+}
+
+type document struct {
+	Plan string `json:"plan"`
+
+	Backfill *BackfillState `json:"backfill,omitempty"`
+	Stream   *StreamState   `json:"stream,omitempty"`
+
+	// The input table's stream when ddb-sync enabled it, so that it can be
+	// disabled again once the sync is done
+	AutoEnabledStreamARN string `json:"auto_enabled_stream_arn,omitempty"`
+
+	// Set while the output table's capacity is raised for the backfill
+	SavedCapacity *CapacityState `json:"saved_capacity,omitempty"`
+
+	// The output table's indexes ddb-sync removed for the backfill and hasn't
+	// created again yet
+	DeferredIndexes []string `json:"deferred_indexes,omitempty"`
+}
+
+// Store holds the progress of an operation plan and persists it to a file so
+// that an interrupted run can pick up where it left off.  A Store without a
+// path keeps its state in memory only.
+type Store struct {
+	m     sync.Mutex
+	path  string
+	doc   document
+	dirty bool
+
+	// serializes writes so an older snapshot never replaces a newer one
+	saveM sync.Mutex
+
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+// Open loads the state file at path, creating an empty state if the file does
+// not exist yet.  An empty path returns an in-memory store.
+func Open(path string, plan config.OperationPlan) (*Store, error) {
+	s := &Store{
+		path: path,
+		doc: document{
+			Plan: planKey(plan),
+		},
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read state file: %v", err)
+	}
+
+	var doc document
+	err = json.Unmarshal(contents, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse state file %s: %v", path, err)
+	}
+
+	if doc.Plan != s.doc.Plan {
+		return nil, fmt.Errorf("%s: %v", path, ErrStateFileMismatch)
+	}
+	s.doc = doc
+
+	return s, nil
+}
+
+func planKey(plan config.OperationPlan) string {
+	return fmt.Sprintf("%s/%s ⇨ %s/%s", plan.Input.Region, plan.Input.TableName, plan.Output.Region, plan.Output.TableName)
+}
+
+// Persistent reports whether the store is backed by a file
+func (s *Store) Persistent() bool {
+	return s.path != ""
+}
+
+// Start periodically saves any changes to the state file
+func (s *Store) Start() {
+	if !s.Persistent() {
+		return
+	}
+
+	s.ticker = time.NewTicker(saveInterval)
+	s.done = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				err := s.Save()
+				if err != nil {
+					log.Printf("[ERROR] %v", err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic save and writes any outstanding changes
+func (s *Store) Stop() error {
+	if s.ticker != nil {
+		s.ticker.Stop()
+		close(s.done)
+		s.ticker = nil
+	}
+	return s.Save()
+}
+
+// Save writes the state file if it has changed since the last save.  The file
+// is replaced atomically so a crash never leaves a partially written state.
+func (s *Store) Save() error {
+	if !s.Persistent() {
+		return nil
+	}
+
+	s.saveM.Lock()
+	defer s.saveM.Unlock()
+
+	s.m.Lock()
+	if !s.dirty {
+		s.m.Unlock()
+		return nil
+	}
+	contents, err := json.MarshalIndent(s.doc, "", "  ")
+	s.dirty = false
+	s.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return s.saveFailed(err)
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return s.saveFailed(err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return s.saveFailed(err)
+	}
+	return nil
+}
+
+func (s *Store) saveFailed(err error) error {
+	s.m.Lock()
+	s.dirty = true
+	s.m.Unlock()
+
+	return fmt.Errorf("Failed to save state file %s: %v", s.path, err)
+}
+
+// ResetStream discards stream progress recorded for any stream other than
+// streamARN.  It reports whether progress from a previous run was kept.
+func (s *Store) ResetStream(streamARN string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Stream != nil && s.doc.Stream.StreamARN == streamARN {
+		return true
+	}
+
+	s.doc.Stream = &StreamState{
+		StreamARN:       streamARN,
+		StartedAt:       time.Now(),
+		CompletedShards: make(map[string]bool),
+		SequenceNumbers: make(map[string]string),
+	}
+	s.dirty = true
+	return false
+}
+
+// ClearStream discards all stream progress, the next call to ResetStream
+// starts over even for the same stream
+func (s *Store) ClearStream() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.doc.Stream = nil
+	s.dirty = true
+}
+
+// AutoEnabledStream returns the ARN of the stream ddb-sync enabled on the input
+// table, or "" when it didn't enable one
+func (s *Store) AutoEnabledStream() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.doc.AutoEnabledStreamARN
+}
+
+// SetAutoEnabledStream records that ddb-sync enabled the input table's stream
+func (s *Store) SetAutoEnabledStream(streamARN string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.doc.AutoEnabledStreamARN = streamARN
+	s.dirty = true
+}
+
+// ClearAutoEnabledStream forgets the stream ddb-sync enabled
+func (s *Store) ClearAutoEnabledStream() {
+	s.SetAutoEnabledStream("")
+}
+
+// SavedCapacity returns the output table's capacity from before the backfill
+// raised it, or nil when it isn't raised
+func (s *Store) SavedCapacity() *CapacityState {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.doc.SavedCapacity
+}
+
+// SetSavedCapacity records the output table's capacity before raising it
+func (s *Store) SetSavedCapacity(capacity *CapacityState) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.doc.SavedCapacity = capacity
+	s.dirty = true
+}
+
+// ClearSavedCapacity forgets the saved capacity once it has been restored
+func (s *Store) ClearSavedCapacity() {
+	s.SetSavedCapacity(nil)
+}
+
+// DeferredIndexes returns the names of the output table's indexes ddb-sync
+// removed and hasn't created again
+func (s *Store) DeferredIndexes() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return append([]string(nil), s.doc.DeferredIndexes...)
+}
+
+// AddDeferredIndex records that ddb-sync is removing an output table index
+func (s *Store) AddDeferredIndex(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, deferred := range s.doc.DeferredIndexes {
+		if deferred == name {
+			return
+		}
+	}
+	s.doc.DeferredIndexes = append(s.doc.DeferredIndexes, name)
+	s.dirty = true
+}
+
+// ClearDeferredIndex forgets a removed index once it has been created again
+func (s *Store) ClearDeferredIndex(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var remaining []string
+	for _, deferred := range s.doc.DeferredIndexes {
+		if deferred != name {
+			remaining = append(remaining, deferred)
+		}
+	}
+	s.doc.DeferredIndexes = remaining
+	s.dirty = true
+}
+
+// StreamStartedAt returns when streaming first began from the current stream
+func (s *Store) StreamStartedAt() time.Time {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Stream == nil {
+		return time.Time{}
+	}
+	return s.doc.Stream.StartedAt
+}
+
+// CompletedShards returns the ids of the shards recorded as complete
+func (s *Store) CompletedShards() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ids := []string{}
+	if s.doc.Stream == nil {
+		return ids
+	}
+	for id := range s.doc.Stream.CompletedShards {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ShardSequenceNumber returns the last sequence number written for a shard, if any
+func (s *Store) ShardSequenceNumber(shardId string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Stream == nil {
+		return ""
+	}
+	return s.doc.Stream.SequenceNumbers[shardId]
+}
+
+// SetShardSequenceNumber records the last sequence number written for a shard
+func (s *Store) SetShardSequenceNumber(shardId, sequenceNumber string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Stream == nil {
+		return
+	}
+	s.doc.Stream.SequenceNumbers[shardId] = sequenceNumber
+	s.dirty = true
+}
+
+// CompleteShard records that every record in a shard has been written
+func (s *Store) CompleteShard(shardId string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Stream == nil {
+		return
+	}
+	delete(s.doc.Stream.SequenceNumbers, shardId)
+	s.doc.Stream.CompletedShards[shardId] = true
+	s.dirty = true
+}
+
+// RetainShards forgets the completed shards and sequence numbers of shards
+// the stream no longer has.  Shards are trimmed from the stream after 24
+// hours, so without this the completed shards grow for as long as a stream
+// is synced.
+func (s *Store) RetainShards(shardIds []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Stream == nil {
+		return
+	}
+
+	current := make(map[string]bool, len(shardIds))
+	for _, id := range shardIds {
+		current[id] = true
+	}
+	for id := range s.doc.Stream.CompletedShards {
+		if !current[id] {
+			delete(s.doc.Stream.CompletedShards, id)
+			s.dirty = true
+		}
+	}
+	for id := range s.doc.Stream.SequenceNumbers {
+		if !current[id] {
+			delete(s.doc.Stream.SequenceNumbers, id)
+			s.dirty = true
+		}
+	}
+}
+
+// ResetBackfill discards any recorded backfill progress
+func (s *Store) ResetBackfill(totalSegments int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.doc.Backfill = &BackfillState{
+		TotalSegments: totalSegments,
+		StartedAt:     time.Now(),
+		Segments:      make(map[int]*SegmentState),
+	}
+	s.dirty = true
+}
+
+// BackfillTotalSegments returns the segment count of the recorded backfill,
+// or zero if no backfill has been recorded
+func (s *Store) BackfillTotalSegments() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Backfill == nil {
+		return 0
+	}
+	return s.doc.Backfill.TotalSegments
+}
+
+// BackfillStartedAt returns when the recorded backfill began scanning, or the
+// zero time if no backfill has been recorded
+func (s *Store) BackfillStartedAt() time.Time {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Backfill == nil {
+		return time.Time{}
+	}
+	return s.doc.Backfill.StartedAt
+}
+
+// BackfillSegment returns the recorded progress of a scan segment
+func (s *Store) BackfillSegment(segment int) SegmentState {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Backfill == nil || s.doc.Backfill.Segments[segment] == nil {
+		return SegmentState{}
+	}
+	return *s.doc.Backfill.Segments[segment]
+}
+
+// SetBackfillSegment records the progress of a scan segment, and the items
+// written since its last recorded key.  A nil key marks the segment complete.
+func (s *Store) SetBackfillSegment(segment int, lastEvaluatedKey map[string]*dynamodb.AttributeValue, written int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.doc.Backfill == nil {
+		return
+	}
+	if previous := s.doc.Backfill.Segments[segment]; previous != nil {
+		written += previous.WrittenCount
+	}
+	s.doc.Backfill.Segments[segment] = &SegmentState{
+		LastEvaluatedKey: lastEvaluatedKey,
+		Complete:         lastEvaluatedKey == nil,
+		WrittenCount:     written,
+	}
+	s.dirty = true
+}
+
+// BackfillWrittenCount returns the items recorded as written across every segment
+func (s *Store) BackfillWrittenCount() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var written int64
+	if s.doc.Backfill == nil {
+		return written
+	}
+	for _, segment := range s.doc.Backfill.Segments {
+		written += segment.WrittenCount
+	}
+	return written
+}
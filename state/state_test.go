@@ -0,0 +1,256 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/instructure/ddb-sync/config"
+	"github.com/instructure/ddb-sync/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var testPlan = config.OperationPlan{
+	Input:  config.Input{Region: "us-west-2", TableName: "source"},
+	Output: config.Output{Region: "us-east-2", TableName: "dest"},
+}
+
+func tempStatePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ddb-sync-state")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return filepath.Join(dir, "state.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestStoreStreamStateRoundTrip(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	store, err := state.Open(path, testPlan)
+	if err != nil {
+		t.Fatalf("Unexpected error opening store: %v", err)
+	}
+	store.ResetStream("arn:stream-1")
+	store.SetShardSequenceNumber("shard-1", "100")
+	store.SetShardSequenceNumber("shard-2", "200")
+	store.CompleteShard("shard-2")
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("Unexpected error saving store: %v", err)
+	}
+
+	reopened, err := state.Open(path, testPlan)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %v", err)
+	}
+	reopened.ResetStream("arn:stream-1")
+
+	if seq := reopened.ShardSequenceNumber("shard-1"); seq != "100" {
+		t.Errorf("Expected sequence number 100 for shard-1, got %q", seq)
+	}
+	if seq := reopened.ShardSequenceNumber("shard-2"); seq != "" {
+		t.Errorf("Expected completed shard-2 to have no sequence number, got %q", seq)
+	}
+	if completed := reopened.CompletedShards(); len(completed) != 1 || completed[0] != "shard-2" {
+		t.Errorf("Expected shard-2 to be complete, got %v", completed)
+	}
+}
+
+func TestStoreRetainShardsForgetsTrimmedShards(t *testing.T) {
+	store, _ := state.Open("", testPlan)
+	store.ResetStream("arn:stream-1")
+	store.SetShardSequenceNumber("shard-1", "100")
+	store.SetShardSequenceNumber("shard-3", "300")
+	store.CompleteShard("shard-2")
+	store.CompleteShard("shard-4")
+
+	// shard-1 and shard-2 have been trimmed from the stream
+	store.RetainShards([]string{"shard-3", "shard-4", "shard-5"})
+
+	if seq := store.ShardSequenceNumber("shard-1"); seq != "" {
+		t.Errorf("Expected the trimmed shard-1's sequence number to be forgotten, got %q", seq)
+	}
+	if seq := store.ShardSequenceNumber("shard-3"); seq != "300" {
+		t.Errorf("Expected sequence number 300 for shard-3, got %q", seq)
+	}
+	if completed := store.CompletedShards(); len(completed) != 1 || completed[0] != "shard-4" {
+		t.Errorf("Expected only shard-4 to remain complete, got %v", completed)
+	}
+}
+
+func TestStoreResetStreamDiscardsOtherStreams(t *testing.T) {
+	store, _ := state.Open("", testPlan)
+	store.ResetStream("arn:stream-1")
+	store.SetShardSequenceNumber("shard-1", "100")
+
+	store.ResetStream("arn:stream-2")
+	if seq := store.ShardSequenceNumber("shard-1"); seq != "" {
+		t.Errorf("Expected progress from another stream to be discarded, got %q", seq)
+	}
+}
+
+func TestStoreClearStreamDiscardsSameStream(t *testing.T) {
+	store, _ := state.Open("", testPlan)
+	store.ResetStream("arn:stream-1")
+	store.SetShardSequenceNumber("shard-1", "100")
+
+	store.ClearStream()
+	if resumed := store.ResetStream("arn:stream-1"); resumed {
+		t.Errorf("Expected a cleared stream not to be resumed")
+	}
+	if seq := store.ShardSequenceNumber("shard-1"); seq != "" {
+		t.Errorf("Expected cleared progress to be discarded, got %q", seq)
+	}
+}
+
+func TestStoreOpenRejectsOtherPlans(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	store, _ := state.Open(path, testPlan)
+	store.ResetStream("arn:stream-1")
+	store.Save()
+
+	otherPlan := testPlan
+	otherPlan.Output.TableName = "other-dest"
+	if _, err := state.Open(path, otherPlan); err == nil {
+		t.Errorf("Expected opening a state file from another plan to fail")
+	}
+}
+
+func TestStoreBackfillSegmentRoundTrip(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	store, _ := state.Open(path, testPlan)
+	store.ResetBackfill(4)
+	store.SetBackfillSegment(0, map[string]*dynamodb.AttributeValue{"id": {S: aws.String("abc")}}, 100)
+	store.SetBackfillSegment(0, map[string]*dynamodb.AttributeValue{"id": {S: aws.String("abc")}}, 50)
+	store.SetBackfillSegment(1, nil, 25)
+	store.Save()
+
+	reopened, err := state.Open(path, testPlan)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %v", err)
+	}
+
+	if total := reopened.BackfillTotalSegments(); total != 4 {
+		t.Errorf("Expected 4 total segments, got %d", total)
+	}
+
+	segment0 := reopened.BackfillSegment(0)
+	if segment0.Complete || segment0.LastEvaluatedKey == nil || *segment0.LastEvaluatedKey["id"].S != "abc" {
+		t.Errorf("Expected segment 0 to resume from id abc, got %+v", segment0)
+	}
+
+	if segment1 := reopened.BackfillSegment(1); !segment1.Complete {
+		t.Errorf("Expected segment 1 to be complete")
+	}
+
+	if segment2 := reopened.BackfillSegment(2); segment2.Complete || segment2.LastEvaluatedKey != nil {
+		t.Errorf("Expected segment 2 to have no progress, got %+v", segment2)
+	}
+
+	if written := reopened.BackfillWrittenCount(); written != 175 {
+		t.Errorf("Expected the segments' written items to add up to 175, got %d", written)
+	}
+}
+
+func TestStoreDeferredIndexesRoundTrip(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	store, _ := state.Open(path, testPlan)
+	store.AddDeferredIndex("by-email")
+	store.AddDeferredIndex("by-name")
+	store.AddDeferredIndex("by-email")
+	store.Save()
+
+	reopened, err := state.Open(path, testPlan)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %v", err)
+	}
+	if deferred := reopened.DeferredIndexes(); !reflect.DeepEqual(deferred, []string{"by-email", "by-name"}) {
+		t.Errorf("Expected both deferred indexes to be read back once, got %v", deferred)
+	}
+
+	reopened.ClearDeferredIndex("by-email")
+	if deferred := reopened.DeferredIndexes(); !reflect.DeepEqual(deferred, []string{"by-name"}) {
+		t.Errorf("Expected only the other index to remain, got %v", deferred)
+	}
+}
+
+func TestStoreAutoEnabledStreamSurvivesStreamReset(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	store, _ := state.Open(path, testPlan)
+	store.SetAutoEnabledStream("arn:stream-1")
+	store.ResetStream("arn:stream-1")
+	store.ClearStream()
+	store.Save()
+
+	reopened, err := state.Open(path, testPlan)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %v", err)
+	}
+	if arn := reopened.AutoEnabledStream(); arn != "arn:stream-1" {
+		t.Errorf("Expected the auto enabled stream to be recorded, got %q", arn)
+	}
+
+	reopened.ClearAutoEnabledStream()
+	if arn := reopened.AutoEnabledStream(); arn != "" {
+		t.Errorf("Expected the auto enabled stream to be cleared, got %q", arn)
+	}
+}
+
+func TestStoreSavedCapacityRoundTrip(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	store, _ := state.Open(path, testPlan)
+	store.SetSavedCapacity(&state.CapacityState{
+		BillingMode:   "PROVISIONED",
+		ReadCapacity:  10,
+		WriteCapacity: 50,
+		Indexes:       map[string]state.IndexCapacity{"by-email": {ReadCapacity: 5, WriteCapacity: 25}},
+	})
+	store.Save()
+
+	reopened, err := state.Open(path, testPlan)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %v", err)
+	}
+	saved := reopened.SavedCapacity()
+	if saved == nil || saved.WriteCapacity != 50 || saved.Indexes["by-email"].WriteCapacity != 25 {
+		t.Errorf("Expected the saved capacity to be read back, got %+v", saved)
+	}
+
+	reopened.ClearSavedCapacity()
+	if saved := reopened.SavedCapacity(); saved != nil {
+		t.Errorf("Expected the saved capacity to be cleared, got %+v", saved)
+	}
+}
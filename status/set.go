@@ -74,9 +74,40 @@ func (s *Set) Delimiter() string {
 }
 
 func (s *Set) Header() []string {
+	if s != nil && len(s.Statuses) > 0 && s.Statuses[0].Estimating() {
+		return []string{"TABLE", "DETAILS", "ESTIMATE", "RATES"}
+	}
+	if s != nil && len(s.Statuses) > 0 && s.Statuses[0].CleaningUp() {
+		return []string{"TABLE", "DETAILS", "CLEANUP", "RATES"}
+	}
+	if s != nil && len(s.Statuses) > 0 && s.Statuses[0].SyncingSettings() {
+		return []string{"TABLE", "DETAILS", "SETTINGS", "RATES"}
+	}
+	if s != nil && len(s.Statuses) > 0 && s.Statuses[0].Repairing() {
+		return []string{"TABLE", "DETAILS", "REPAIR", "RATES"}
+	}
+	if s != nil && len(s.Statuses) > 0 && s.Statuses[0].Verifying() {
+		return []string{"TABLE", "DETAILS", "VERIFY", "RATES"}
+	}
+	if s.checkingConsistency() {
+		return []string{"TABLE", "DETAILS", "BACKFILL", "STREAM", "CONSISTENCY", "RATES & BUFFER"}
+	}
 	return []string{"TABLE", "DETAILS", "BACKFILL", "STREAM", "RATES & BUFFER"}
 }
 
+// checkingConsistency reports whether any stream runs consistency checks
+func (s *Set) checkingConsistency() bool {
+	if s == nil {
+		return false
+	}
+	for _, status := range s.Statuses {
+		if status.Consistency != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Set) Display() []string {
 	s.UpdateViewport()
 	renderer.MaxWidth = s.ViewportWidth
@@ -105,8 +136,13 @@ func (s *Set) statusRows() [][]string {
 		return output
 	}
 
+	checkingConsistency := s.checkingConsistency()
 	for _, status := range s.Statuses {
-		output = append(output, status.Display())
+		if checkingConsistency {
+			output = append(output, status.DisplayWithConsistency())
+		} else {
+			output = append(output, status.Display())
+		}
 	}
 	return output
 }
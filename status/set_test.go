@@ -19,8 +19,10 @@
 package status_test
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/instructure/ddb-sync/config"
 	"github.com/instructure/ddb-sync/status"
 )
 
@@ -43,3 +45,53 @@ func TestSetDelimiter(t *testing.T) {
 		t.Errorf("@120 width: set didn't match\nTest   : %q\nPrinted: %q", wideTest, wideSet.Delimiter())
 	}
 }
+
+func TestSetHeaderForVerify(t *testing.T) {
+	syncStatus := status.New(config.OperationPlan{})
+	if header := status.NewSet([]*status.Status{syncStatus}).Header(); len(header) != 5 {
+		t.Errorf("Expected the sync header to have 5 columns, got %v", header)
+	}
+
+	verifyStatus := status.New(config.OperationPlan{})
+	verifyStatus.Verify = "-PENDING-"
+	set := status.NewSet([]*status.Status{verifyStatus})
+	if header := set.Header(); len(header) != 4 || header[2] != "VERIFY" {
+		t.Errorf("Expected the verify header, got %v", header)
+	}
+	if row := verifyStatus.Display(); len(row) != 4 || row[2] != "-PENDING-" {
+		t.Errorf("Expected the verify status in the third column, got %v", row)
+	}
+}
+
+func TestSetHeaderForRepair(t *testing.T) {
+	repairStatus := status.New(config.OperationPlan{})
+	repairStatus.Verify = "10 checked, 1 missing, 0 extra, 0 changed"
+	repairStatus.Repair = "1 put, 0 deleted, 0 skipped"
+	set := status.NewSet([]*status.Status{repairStatus})
+	if header := set.Header(); len(header) != 4 || header[2] != "REPAIR" {
+		t.Errorf("Expected the repair header, got %v", header)
+	}
+	if row := repairStatus.Display(); len(row) != 4 || row[2] != repairStatus.Repair {
+		t.Errorf("Expected the repair status in the third column, got %v", row)
+	}
+}
+
+func TestSetConsistencyColumn(t *testing.T) {
+	checked := status.New(config.OperationPlan{})
+	checked.Consistency = "1 of 50 differ (2.0%)"
+	unchecked := status.New(config.OperationPlan{})
+
+	set := status.NewSet([]*status.Status{checked, unchecked})
+	header := set.Header()
+	if len(header) != 6 || header[4] != "CONSISTENCY" {
+		t.Fatalf("Expected a consistency column, got %v", header)
+	}
+
+	rows := set.ToFile()
+	if len(rows) != 5 || !strings.Contains(rows[3], checked.Consistency) {
+		t.Errorf("Expected the mismatch rate in the first row, got %q", rows)
+	}
+	if row := unchecked.DisplayWithConsistency(); len(row) != 6 || row[4] != "  --  " {
+		t.Errorf("Expected a placeholder for a stream without checks, got %v", row)
+	}
+}
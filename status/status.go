@@ -32,6 +32,24 @@ type Status struct {
 	Stream      string
 	Rate        string
 
+	// The stream's consistency check mismatch rate, when checks are enabled
+	Consistency string
+
+	// Set for the verify command, shown in place of the backfill and stream
+	Verify string
+
+	// Set for the repair command, shown in place of the backfill and stream
+	Repair string
+
+	// Set for the settings command, shown in place of the backfill and stream
+	Settings string
+
+	// Set for the cleanup command, shown in place of the backfill and stream
+	Cleanup string
+
+	// Set for the estimate command, shown in place of the backfill and stream
+	Estimate string
+
 	output []string
 }
 
@@ -50,12 +68,62 @@ func (s *Status) Display() []string {
 
 	s.addContent(s.formatTableDescription())
 	s.addContent(s.Description)
-	s.addContent(s.Backfill)
-	s.addContent(s.Stream)
+	if s.Estimating() {
+		s.addContent(s.Estimate)
+	} else if s.CleaningUp() {
+		s.addContent(s.Cleanup)
+	} else if s.SyncingSettings() {
+		s.addContent(s.Settings)
+	} else if s.Repairing() {
+		s.addContent(s.Repair)
+	} else if s.Verifying() {
+		s.addContent(s.Verify)
+	} else {
+		s.addContent(s.Backfill)
+		s.addContent(s.Stream)
+	}
 	s.addContent(s.Rate)
 	return s.output
 }
 
+// DisplayWithConsistency returns the status's cells with the consistency
+// check's mismatch rate before the rates
+func (s *Status) DisplayWithConsistency() []string {
+	output := s.Display()
+
+	consistency := s.Consistency
+	if consistency == "" {
+		consistency = "  --  "
+	}
+	rate := output[len(output)-1]
+	return append(output[:len(output)-1], consistency, rate)
+}
+
+// Verifying reports whether the status is for the verify command
+func (s *Status) Verifying() bool {
+	return s.Verify != ""
+}
+
+// SyncingSettings reports whether the status is for the settings command
+func (s *Status) SyncingSettings() bool {
+	return s.Settings != ""
+}
+
+// CleaningUp reports whether the status is for the cleanup command
+func (s *Status) CleaningUp() bool {
+	return s.Cleanup != ""
+}
+
+// Estimating reports whether the status is for the estimate command
+func (s *Status) Estimating() bool {
+	return s.Estimate != ""
+}
+
+// Repairing reports whether the status is for the repair command
+func (s *Status) Repairing() bool {
+	return s.Repair != ""
+}
+
 func (s *Status) formatTableDescription() string {
 	return fmt.Sprintf("⇨ [%s]", s.Plan.Output.TableName)
 }
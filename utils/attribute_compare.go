@@ -0,0 +1,120 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// AttributeValuesEqual reports whether two attribute values hold the same
+// data.  Sets are unordered, so their members are compared in any order.
+func AttributeValuesEqual(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	switch {
+	case a.S != nil:
+		return b.S != nil && *a.S == *b.S
+	case a.N != nil:
+		return b.N != nil && *a.N == *b.N
+	case a.B != nil:
+		return b.B != nil && bytes.Equal(a.B, b.B)
+	case a.BOOL != nil:
+		return b.BOOL != nil && *a.BOOL == *b.BOOL
+	case a.NULL != nil:
+		return b.NULL != nil
+	case a.SS != nil:
+		return b.SS != nil && stringSetsEqual(a.SS, b.SS)
+	case a.NS != nil:
+		return b.NS != nil && stringSetsEqual(a.NS, b.NS)
+	case a.BS != nil:
+		return b.BS != nil && binarySetsEqual(a.BS, b.BS)
+	case a.L != nil:
+		if b.L == nil || len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !AttributeValuesEqual(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case a.M != nil:
+		return b.M != nil && ItemsEqual(a.M, b.M)
+	}
+	return false
+}
+
+// ItemsEqual reports whether two items have the same attributes and values
+func ItemsEqual(a, b map[string]*dynamodb.AttributeValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || !AttributeValuesEqual(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringSetsEqual(a, b []*string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := make([]string, len(a))
+	sortedB := make([]string, len(b))
+	for i := range a {
+		sortedA[i] = *a[i]
+		sortedB[i] = *b[i]
+	}
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func binarySetsEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := append([][]byte(nil), a...)
+	sortedB := append([][]byte(nil), b...)
+	sort.Slice(sortedA, func(i, j int) bool { return bytes.Compare(sortedA[i], sortedA[j]) < 0 })
+	sort.Slice(sortedB, func(i, j int) bool { return bytes.Compare(sortedB[i], sortedB[j]) < 0 })
+
+	for i := range sortedA {
+		if !bytes.Equal(sortedA[i], sortedB[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestAttributeValuesEqualIgnoresSetOrder(t *testing.T) {
+	a := &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"a", "b", "c"})}
+	b := &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"c", "a", "b"})}
+	if !utils.AttributeValuesEqual(a, b) {
+		t.Errorf("Expected sets with the same members to be equal")
+	}
+
+	c := &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"a", "b", "d"})}
+	if utils.AttributeValuesEqual(a, c) {
+		t.Errorf("Expected sets with different members to differ")
+	}
+}
+
+func TestAttributeValuesEqualComparesTypes(t *testing.T) {
+	cases := []struct {
+		a, b  *dynamodb.AttributeValue
+		equal bool
+	}{
+		{&dynamodb.AttributeValue{S: aws.String("1")}, &dynamodb.AttributeValue{S: aws.String("1")}, true},
+		{&dynamodb.AttributeValue{S: aws.String("1")}, &dynamodb.AttributeValue{N: aws.String("1")}, false},
+		{&dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{{S: aws.String("a")}, {S: aws.String("b")}}}, &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{{S: aws.String("b")}, {S: aws.String("a")}}}, false},
+		{&dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"x": {BOOL: aws.Bool(true)}}}, &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"x": {BOOL: aws.Bool(true)}}}, true},
+		{&dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"x": {BOOL: aws.Bool(true)}}}, &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"y": {BOOL: aws.Bool(true)}}}, false},
+	}
+
+	for i, c := range cases {
+		if equal := utils.AttributeValuesEqual(c.a, c.b); equal != c.equal {
+			t.Errorf("Case %d: expected equal to be %t, got %t", i, c.equal, equal)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Item is a DynamoDB item that marshals to and from the DynamoDB JSON format,
+// e.g. {"id": {"S": "abc"}, "count": {"N": "3"}}
+type Item map[string]*dynamodb.AttributeValue
+
+func (i Item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodeItem(i))
+}
+
+func (i *Item) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	item, err := ItemFromJSON(raw)
+	if err != nil {
+		return err
+	}
+	*i = item
+	return nil
+}
+
+// UnmarshalYAML reads an item written in the DynamoDB JSON format in a YAML
+// document.  Numbers may be left unquoted, but the N type must be quoted as
+// YAML reads a bare N as false.
+func (i *Item) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	err := unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+
+	item, err := ItemFromJSON(fromYAML(raw))
+	if err != nil {
+		return err
+	}
+	*i = item
+	return nil
+}
+
+// fromYAML converts a decoded YAML document into the types a decoded JSON
+// document has, with numbers as strings
+func fromYAML(raw interface{}) interface{} {
+	switch value := raw.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, member := range value {
+			converted[fmt.Sprint(key)] = fromYAML(member)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, member := range value {
+			converted[i] = fromYAML(member)
+		}
+		return converted
+	case int, int64, uint64, float64:
+		return fmt.Sprint(value)
+	}
+	return raw
+}
+
+// AttributeValue is a single attribute value that marshals to and from the
+// DynamoDB JSON format, e.g. {"S": "abc"}
+type AttributeValue struct {
+	*dynamodb.AttributeValue
+}
+
+func (v AttributeValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodeAttributeValue(v.AttributeValue))
+}
+
+func (v *AttributeValue) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	v.AttributeValue, err = AttributeValueFromJSON(raw)
+	return err
+}
+
+// ItemFromJSON converts a decoded DynamoDB JSON document into an item
+func ItemFromJSON(raw interface{}) (Item, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	attributes, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Item must be an object")
+	}
+
+	item := make(Item, len(attributes))
+	for name, value := range attributes {
+		av, err := AttributeValueFromJSON(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		item[name] = av
+	}
+	return item, nil
+}
+
+// AttributeValueFromJSON converts a decoded DynamoDB JSON attribute value,
+// e.g. {"S": "abc"}, into an AttributeValue
+func AttributeValueFromJSON(raw interface{}) (*dynamodb.AttributeValue, error) {
+	typed, ok := raw.(map[string]interface{})
+	if !ok || len(typed) != 1 {
+		return nil, fmt.Errorf("attribute value must be an object with a single type key")
+	}
+
+	for dataType, value := range typed {
+		av := &dynamodb.AttributeValue{}
+		var err error
+
+		switch dataType {
+		case "S":
+			av.S, err = jsonString(value)
+		case "N":
+			av.N, err = jsonString(value)
+		case "B":
+			av.B, err = jsonBinary(value)
+		case "BOOL":
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("BOOL must be a boolean")
+			}
+			av.BOOL = aws.Bool(b)
+		case "NULL":
+			av.NULL = aws.Bool(true)
+		case "SS", "NS", "BS":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list", dataType)
+			}
+			for _, member := range list {
+				if dataType == "BS" {
+					b, err := jsonBinary(member)
+					if err != nil {
+						return nil, err
+					}
+					av.BS = append(av.BS, b)
+					continue
+				}
+
+				s, err := jsonString(member)
+				if err != nil {
+					return nil, err
+				}
+				if dataType == "SS" {
+					av.SS = append(av.SS, s)
+				} else {
+					av.NS = append(av.NS, s)
+				}
+			}
+		case "L":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("L must be a list")
+			}
+			av.L = []*dynamodb.AttributeValue{}
+			for _, member := range list {
+				memberAV, err := AttributeValueFromJSON(member)
+				if err != nil {
+					return nil, err
+				}
+				av.L = append(av.L, memberAV)
+			}
+		case "M":
+			item, err := ItemFromJSON(value)
+			if err != nil {
+				return nil, err
+			}
+			av.M = map[string]*dynamodb.AttributeValue(item)
+			if av.M == nil {
+				av.M = map[string]*dynamodb.AttributeValue{}
+			}
+		default:
+			return nil, fmt.Errorf("unknown attribute type %q", dataType)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		return av, nil
+	}
+	return nil, nil
+}
+
+func jsonString(value interface{}) (*string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string, got %v", value)
+	}
+	return aws.String(s), nil
+}
+
+func jsonBinary(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a base64 string, got %v", value)
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func encodeItem(item map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	if item == nil {
+		return nil
+	}
+
+	encoded := make(map[string]interface{}, len(item))
+	for name, av := range item {
+		encoded[name] = encodeAttributeValue(av)
+	}
+	return encoded
+}
+
+func encodeAttributeValue(av *dynamodb.AttributeValue) map[string]interface{} {
+	switch {
+	case av == nil:
+		return map[string]interface{}{"NULL": true}
+	case av.S != nil:
+		return map[string]interface{}{"S": *av.S}
+	case av.N != nil:
+		return map[string]interface{}{"N": *av.N}
+	case av.B != nil:
+		return map[string]interface{}{"B": av.B}
+	case av.BOOL != nil:
+		return map[string]interface{}{"BOOL": *av.BOOL}
+	case av.NULL != nil:
+		return map[string]interface{}{"NULL": true}
+	case av.SS != nil:
+		return map[string]interface{}{"SS": aws.StringValueSlice(av.SS)}
+	case av.NS != nil:
+		return map[string]interface{}{"NS": aws.StringValueSlice(av.NS)}
+	case av.BS != nil:
+		return map[string]interface{}{"BS": av.BS}
+	case av.L != nil:
+		list := make([]interface{}, 0, len(av.L))
+		for _, member := range av.L {
+			list = append(list, encodeAttributeValue(member))
+		}
+		return map[string]interface{}{"L": list}
+	case av.M != nil:
+		return map[string]interface{}{"M": encodeItem(av.M)}
+	}
+	return map[string]interface{}{"NULL": true}
+}
@@ -0,0 +1,113 @@
+/*
+ * ddb-sync
+ * Copyright (C) 2018 Instructure Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/instructure/ddb-sync/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestItemJSONRoundTrip(t *testing.T) {
+	item := utils.Item{
+		"id":      {S: aws.String("abc")},
+		"count":   {N: aws.String("12.50")},
+		"blob":    {B: []byte{0, 1, 2}},
+		"active":  {BOOL: aws.Bool(true)},
+		"missing": {NULL: aws.Bool(true)},
+		"tags":    {SS: aws.StringSlice([]string{"a", "b"})},
+		"list": {L: []*dynamodb.AttributeValue{
+			{S: aws.String("x")},
+			{N: aws.String("1")},
+		}},
+		"nested": {M: map[string]*dynamodb.AttributeValue{
+			"inner": {S: aws.String("y")},
+		}},
+	}
+
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling item: %v", err)
+	}
+
+	var decoded utils.Item
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatalf("Unexpected error unmarshaling item: %v", err)
+	}
+
+	if !reflect.DeepEqual(item, decoded) {
+		t.Errorf("Round trip didn't match\nExpected: %v\nReceived: %v", item, decoded)
+	}
+}
+
+func TestItemJSONFormat(t *testing.T) {
+	item := utils.Item{"id": {S: aws.String("abc")}}
+
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling item: %v", err)
+	}
+
+	expected := `{"id":{"S":"abc"}}`
+	if string(encoded) != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestItemJSONRejectsUnknownTypes(t *testing.T) {
+	var decoded utils.Item
+	err := json.Unmarshal([]byte(`{"id":{"X":"abc"}}`), &decoded)
+	if err == nil {
+		t.Errorf("Expected an unknown attribute type to fail")
+	}
+}
+
+func TestItemYAML(t *testing.T) {
+	document := `
+":tenant": {S: acme}
+":limit": {"N": 3}
+":states": {SS: [active, pending]}
+":meta": {M: {archived: {BOOL: false}}}
+`
+
+	var item utils.Item
+	err := yaml.Unmarshal([]byte(document), &item)
+	if err != nil {
+		t.Fatalf("Unexpected error unmarshaling item: %v", err)
+	}
+
+	expected := utils.Item{
+		":tenant": {S: aws.String("acme")},
+		":limit":  {N: aws.String("3")},
+		":states": {SS: aws.StringSlice([]string{"active", "pending"})},
+		":meta": {M: map[string]*dynamodb.AttributeValue{
+			"archived": {BOOL: aws.Bool(false)},
+		}},
+	}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("Expected %v, got %v", expected, item)
+	}
+}